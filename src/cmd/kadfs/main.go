@@ -0,0 +1,466 @@
+package main
+
+// kadfs runs a kademlia node and mounts its DFS as a FUSE filesystem.
+//
+//	kadfs LISTEN_IP:PORT PEER_IP:PORT MOUNTPOINT
+//
+// Every operation goes to the DHT by path, nothing is cached besides the
+// attribute validity the kernel keeps.
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"kademlia"
+	"kadnode"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long the kernel may cache attributes and entries
+const attrValid = 1 * time.Second
+
+// with encrypt new files are encrypted, replaced ones stay as they were
+type kadFS struct {
+	kadem   *kademlia.Kademlia
+	me      kademlia.Contact
+	encrypt bool
+
+	// the kernel knows nodes by identity and keeps them across a rename, so
+	// there is one node per path and a rename moves it to the new path
+	mu    sync.Mutex
+	nodes map[string]fs.Node
+}
+
+func (f *kadFS) Root() (fs.Node, error) {
+	return f.node("/", true), nil
+}
+
+// the node for a path, a new one if the path is unknown or changed its type
+func (f *kadFS) node(p string, isDir bool) fs.Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.nodes[p]; ok {
+		if _, wasDir := n.(*dir); wasDir == isDir {
+			return n
+		}
+	}
+	var n fs.Node
+	if isDir {
+		n = &dir{node{fs: f, path: p}}
+	} else {
+		n = &file{node{fs: f, path: p}}
+	}
+	if f.nodes == nil {
+		f.nodes = make(map[string]fs.Node)
+	}
+	f.nodes[p] = n
+	return n
+}
+
+// move the node at src and everything below it to dst
+func (f *kadFS) moved(src, dst string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for p, n := range f.nodes {
+		if p != src && strings.HasPrefix(p, src+"/") == false {
+			continue
+		}
+		np := dst + p[len(src):]
+		delete(f.nodes, p)
+		switch n := n.(type) {
+		case *dir:
+			n.path = np
+		case *file:
+			n.path = np
+		}
+		f.nodes[np] = n
+	}
+}
+
+// drop a node the kernel no longer holds, unless another took its path
+func (f *kadFS) forget(p string, n fs.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nodes[p] == n {
+		delete(f.nodes, p)
+	}
+}
+
+func (f *kadFS) findDir(p string) (*kademlia.FindDirResult, error) {
+	req := kademlia.FindDirRequest{Sender: f.me, MsgID: kademlia.NewRandomID(), Path: p}
+	res := new(kademlia.FindDirResult)
+	f.kadem.FindDir(req, res)
+	return res, toErrno(res.Err)
+}
+
+func (f *kadFS) findFile(p string) (*kademlia.FindFileResult, error) {
+	req := kademlia.FindFileRequest{Sender: f.me, MsgID: kademlia.NewRandomID(), Path: p}
+	res := new(kademlia.FindFileResult)
+	f.kadem.FindFile(req, res)
+	return res, toErrno(res.Err)
+}
+
+func (f *kadFS) writeFile(p string, content []byte) error {
+	req := kademlia.WriteFileRequest{Sender: f.me, MsgID: kademlia.NewRandomID(), Path: p, Content: content, Encrypt: f.encrypt}
+	res := new(kademlia.WriteFileResult)
+	f.kadem.WriteFile(req, res)
+	return toErrno(res.Err)
+}
+
+func (f *kadFS) readFile(p string) ([]byte, error) {
+	req := kademlia.ReadFileRequest{Sender: f.me, MsgID: kademlia.NewRandomID(), Path: p}
+	res := new(kademlia.ReadFileResult)
+	f.kadem.ReadFile(req, res)
+	return res.Content, toErrno(res.Err)
+}
+
+// map DFS errors to errnos the kernel understands
+func toErrno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, kademlia.ErrNotFound):
+		return fuse.ENOENT
+	case errors.Is(err, kademlia.ErrExists):
+		return fuse.EEXIST
+	case errors.Is(err, kademlia.ErrNotEmpty):
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case errors.Is(err, kademlia.ErrIsDir):
+		return fuse.Errno(syscall.EISDIR)
+	case errors.Is(err, kademlia.ErrInvalidPath):
+		return fuse.Errno(syscall.EINVAL)
+	case errors.Is(err, kademlia.ErrPermission):
+		return fuse.Errno(syscall.EACCES)
+	case errors.Is(err, kademlia.ErrQuotaExceeded), errors.Is(err, kademlia.ErrSenderLimit):
+		return fuse.Errno(syscall.ENOSPC)
+	case errors.Is(err, kademlia.ErrValueTooLarge):
+		return fuse.Errno(syscall.EFBIG)
+	case errors.Is(err, kademlia.ErrTimeout):
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+	log.Printf("kadfs: %v", err)
+	return fuse.EIO
+}
+
+// fill attributes from DFS metadata, the inode number is taken from the key
+func fillAttr(a *fuse.Attr, key kademlia.ID, meta kademlia.MetaData) {
+	a.Valid = attrValid
+	a.Inode = binary.BigEndian.Uint64(key[:8])
+	a.Size = uint64(meta.Size)
+	a.Blocks = (a.Size + 511) / 512
+	a.Atime = meta.LastRead
+	a.Mtime = meta.LastModified
+	a.Ctime = meta.LastModified
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	if meta.IsDir {
+		a.Mode = os.ModeDir | kademlia.DFS_DIR_MODE
+		a.Nlink = 2
+	} else {
+		a.Mode = kademlia.DFS_FILE_MODE
+		a.Nlink = 1
+	}
+	// inodes from before ownership existed have no mode
+	if meta.Mode != 0 {
+		a.Mode = a.Mode&os.ModeType | os.FileMode(meta.Mode)
+	}
+}
+
+// what dir and file share, path is guarded by fs.mu as a rename changes it
+type node struct {
+	fs   *kadFS
+	path string
+}
+
+func (n *node) where() string {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.path
+}
+
+type dir struct {
+	node
+}
+
+func (d *dir) Forget() {
+	d.fs.forget(d.where(), d)
+}
+
+func (d *dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	res, err := d.fs.findDir(d.where())
+	if err != nil {
+		return err
+	}
+	fillAttr(a, res.Key, res.Inode.Meta)
+	a.Mode |= os.ModeDir
+	return nil
+}
+
+func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	p := path.Join(d.where(), name)
+	res, err := d.fs.findFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return d.fs.node(p, res.Inode.Meta.IsDir), nil
+}
+
+func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	res, err := d.fs.findDir(d.where())
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]fuse.Dirent, 0, len(res.Inode.Files))
+	for name, key := range res.Inode.Files {
+		if name == ".." {
+			continue
+		}
+		ents = append(ents, fuse.Dirent{Inode: binary.BigEndian.Uint64(key[:8]), Name: name})
+	}
+	return ents, nil
+}
+
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	dirPath := d.where()
+	res, err := d.fs.findDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	cdReq := kademlia.CreateDirRequest{Sender: d.fs.me, MsgID: kademlia.NewRandomID(), Name: req.Name, DirKey: res.Key}
+	cdRes := new(kademlia.CreateDirResult)
+	d.fs.kadem.CreateDir(cdReq, cdRes)
+	if cdRes.Err != nil {
+		return nil, toErrno(cdRes.Err)
+	}
+	return d.fs.node(path.Join(dirPath, req.Name), true), nil
+}
+
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	p := path.Join(d.where(), req.Name)
+	if err := d.fs.writeFile(p, []byte{}); err != nil {
+		return nil, nil, err
+	}
+	f := d.fs.node(p, false).(*file)
+	return f, &handle{file: f, loaded: true}, nil
+}
+
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	dirPath := d.where()
+	p := path.Join(dirPath, req.Name)
+	res, err := d.fs.findFile(p)
+	if err != nil {
+		return err
+	}
+	if req.Dir && res.Inode.Meta.IsDir == false {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if req.Dir == false && res.Inode.Meta.IsDir {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	// rmdir only takes empty directories, even to the trash
+	if req.Dir {
+		dirRes, err := d.fs.findDir(p)
+		if err != nil {
+			return err
+		}
+		for name := range dirRes.Inode.Files {
+			if name != ".." {
+				return fuse.Errno(syscall.ENOTEMPTY)
+			}
+		}
+	}
+	// entries go to the trash, from which they are removed for good
+	if path.Base(dirPath) == kademlia.DFS_TRASH_NAME {
+		rmReq := kademlia.RemoveRequest{Sender: d.fs.me, MsgID: kademlia.NewRandomID(), Path: p}
+		rmRes := new(kademlia.RemoveResult)
+		d.fs.kadem.Remove(rmReq, rmRes)
+		return toErrno(rmRes.Err)
+	}
+	sdReq := kademlia.SoftDeleteRequest{Sender: d.fs.me, MsgID: kademlia.NewRandomID(), Path: p}
+	sdRes := new(kademlia.SoftDeleteResult)
+	d.fs.kadem.SoftDelete(sdReq, sdRes)
+	return toErrno(sdRes.Err)
+}
+
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	dst, ok := newDir.(*dir)
+	if ok == false {
+		return fuse.EIO
+	}
+	rnReq := kademlia.RenameRequest{Sender: d.fs.me,
+		MsgID:   kademlia.NewRandomID(),
+		SrcPath: path.Join(d.where(), req.OldName),
+		DstPath: path.Join(dst.where(), req.NewName)}
+	rnRes := new(kademlia.RenameResult)
+	d.fs.kadem.Rename(rnReq, rnRes)
+	if rnRes.Err != nil {
+		return toErrno(rnRes.Err)
+	}
+	d.fs.moved(rnReq.SrcPath, rnReq.DstPath)
+	return nil
+}
+
+type file struct {
+	node
+}
+
+func (f *file) Forget() {
+	f.fs.forget(f.where(), f)
+}
+
+func (f *file) Attr(ctx context.Context, a *fuse.Attr) error {
+	res, err := f.fs.findFile(f.where())
+	if err != nil {
+		return err
+	}
+	fillAttr(a, res.Key, res.Inode.Meta)
+	return nil
+}
+
+func (f *file) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	h := &handle{file: f}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		h.loaded, h.dirty = true, true
+	}
+	return h, nil
+}
+
+// only truncation is supported, the other attributes are derived from the
+// DFS metadata
+func (f *file) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		p := f.where()
+		content, err := f.fs.readFile(p)
+		if err != nil {
+			return err
+		}
+		resized := make([]byte, req.Size)
+		copy(resized, content)
+		if err = f.fs.writeFile(p, resized); err != nil {
+			return err
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// files are read whole on first use and written back whole on flush, DFS
+// blocks are immutable so there is no cheaper way to change part of one
+type handle struct {
+	file   *file
+	mu     sync.Mutex
+	data   []byte
+	loaded bool
+	dirty  bool
+}
+
+func (h *handle) load() error {
+	if h.loaded {
+		return nil
+	}
+	content, err := h.file.fs.readFile(h.file.where())
+	if err != nil {
+		return err
+	}
+	h.data, h.loaded = content, true
+	return nil
+}
+
+func (h *handle) ReadAll(ctx context.Context) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h.data, nil
+}
+
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		return err
+	}
+	end := int(req.Offset) + len(req.Data)
+	if end > len(h.data) {
+		grown := make([]byte, end)
+		copy(grown, h.data)
+		h.data = grown
+	}
+	copy(h.data[req.Offset:], req.Data)
+	h.dirty = true
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dirty == false {
+		return nil
+	}
+	if err := h.file.fs.writeFile(h.file.where(), h.data); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	allowOther := flag.Bool("allow_other", false, "let other users access the mount")
+	encrypt := flag.Bool("encrypt", false, "encrypt new files with the -dfs_key")
+	node := kadnode.AddFlags(flag.CommandLine)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 3 {
+		log.Fatal("Usage: kadfs [flags] LISTEN_IP:PORT[,LISTEN_IP:PORT...] PEER_IP:PORT[,PEER_IP:PORT...] MOUNTPOINT\n")
+	}
+	listenStr, peersStr, mountpoint := args[0], args[1], args[2]
+	if *encrypt && *node.DFSKeyPath == "" {
+		log.Fatal("-encrypt needs -dfs_key")
+	}
+	kadem, me, err := node.Start(listenStr, peersStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := []fuse.MountOption{fuse.FSName("kademlia"), fuse.Subtype("kadfs")}
+	if *allowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	c, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		log.Fatal("Mount: ", err)
+	}
+	defer c.Close()
+
+	// unmount on interrupt so the mountpoint isn't left dangling
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fuse.Unmount(mountpoint)
+	}()
+
+	fmt.Printf("kadfs %s mounted on %s\n", kadem.NodeID.AsString(), mountpoint)
+	if err = fs.Serve(c, &kadFS{kadem: kadem, me: me, encrypt: *encrypt}); err != nil {
+		log.Fatal("Serve: ", err)
+	}
+	<-c.Ready
+	if c.MountError != nil {
+		log.Fatal("Mount: ", c.MountError)
+	}
+}
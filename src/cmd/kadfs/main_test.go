@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"errors"
+	"flag"
+	"kademlia"
+	"kadnode"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestToErrno(t *testing.T) {
+	tests := []struct {
+		err   error
+		errno fuse.Errno
+	}{
+		{kademlia.ErrFileNotFound, fuse.ENOENT},
+		{kademlia.ErrNotFound, fuse.ENOENT},
+		{kademlia.ErrNotEmpty, fuse.Errno(syscall.ENOTEMPTY)},
+		{kademlia.ErrIsDir, fuse.Errno(syscall.EISDIR)},
+		{kademlia.ErrPermission, fuse.Errno(syscall.EACCES)},
+		{kademlia.ErrSenderLimit, fuse.Errno(syscall.ENOSPC)},
+		{&kademlia.RemoteError{Code: kademlia.ERR_QUOTA_EXCEEDED, Msg: "remote"}, fuse.Errno(syscall.ENOSPC)},
+		{errors.New("Something else"), fuse.EIO},
+	}
+	for _, test := range tests {
+		if errno := toErrno(test.err); errno != test.errno {
+			t.Errorf("%v mapped to %v, expected %v", test.err, errno, test.errno)
+		}
+	}
+	if toErrno(nil) != nil {
+		t.Error("No error mapped to an errno")
+	}
+}
+
+// a kadFS on the second of two nodes, a node alone can't read back what it
+// stored in the DFS
+func startTestFS(t *testing.T) *kadFS {
+	peers := ""
+	var kadem *kademlia.Kademlia
+	var me kademlia.Contact
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		if kadem, me, err = kadnode.AddFlags(fs).Start(addr, peers); err != nil {
+			t.Fatal(err)
+		}
+		peers = addr
+	}
+	return &kadFS{kadem: kadem, me: me}
+}
+
+func TestFileOperations(t *testing.T) {
+	f := startTestFS(t)
+	ctx := context.Background()
+	root, _ := f.Root()
+	d := root.(*dir)
+
+	node, err := d.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := node.(*dir)
+	if _, err = d.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"}); err != fuse.EEXIST {
+		t.Errorf("Second mkdir returned %v", err)
+	}
+
+	node, h, err := sub.Create(ctx, &fuse.CreateRequest{Name: "f"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := h.(*handle)
+	if err = fh.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fh.Write(ctx, &fuse.WriteRequest{Data: []byte("!"), Offset: 5}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	var a fuse.Attr
+	if err = node.Attr(ctx, &a); err != nil || a.Size != 6 || a.Mode.IsDir() {
+		t.Errorf("Attributes %v: %v", a, err)
+	}
+
+	if err = sub.Rename(ctx, &fuse.RenameRequest{OldName: "f", NewName: "g"}, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sub.Lookup(ctx, "f"); err != fuse.ENOENT {
+		t.Errorf("Lookup of the renamed file returned %v", err)
+	}
+	node, err = d.Lookup(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := node.(*file).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := opened.(*handle).ReadAll(ctx); err != nil || string(content) != "hello!" {
+		t.Errorf("Read %q: %v", content, err)
+	}
+
+	if err = d.Remove(ctx, &fuse.RemoveRequest{Name: "g", Dir: true}); err != fuse.Errno(syscall.ENOTDIR) {
+		t.Errorf("rmdir of a file returned %v", err)
+	}
+	if err = d.Remove(ctx, &fuse.RemoveRequest{Name: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := d.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range ents {
+		if ent.Name != kademlia.DFS_TRASH_NAME {
+			t.Errorf("%s left after removing it", ent.Name)
+		}
+	}
+}
+
+// files in a mount are written and read with plain system calls, an os.File
+// would register with the runtime's poller, which sends the file system poll
+// requests the FUSE library doesn't answer
+func writeMounted(p string, content string) error {
+	fd, err := syscall.Open(p, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = syscall.Write(fd, []byte(content))
+	if closeErr := syscall.Close(fd); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readMounted(p string) (string, error) {
+	fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 4096)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// the same through the kernel, where FUSE and fusermount are available
+func TestMount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("No FUSE device")
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("No fusermount")
+	}
+	f := startTestFS(t)
+	mountpoint := t.TempDir()
+	c, err := fuse.Mount(mountpoint, fuse.FSName("kademlia"), fuse.Subtype("kadfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	served := make(chan error, 1)
+	go func() { served <- fs.Serve(c, f) }()
+	mounted := true
+	defer func() {
+		if mounted {
+			fuse.Unmount(mountpoint)
+		}
+	}()
+
+	p := func(name string) string {
+		return filepath.Join(mountpoint, filepath.FromSlash(name))
+	}
+	if err = os.Mkdir(p("sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeMounted(p("sub/f"), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := readMounted(p("sub/f")); err != nil || content != "hello" {
+		t.Errorf("Read %q: %v", content, err)
+	}
+	if err = os.Rename(p("sub/f"), p("g")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(p("sub/f")); os.IsNotExist(err) == false {
+		t.Errorf("Stat of the renamed file returned %v", err)
+	}
+	if content, err := readMounted(p("g")); err != nil || content != "hello" {
+		t.Errorf("Read %q after the rename: %v", content, err)
+	}
+
+	if err = fuse.Unmount(mountpoint); err != nil {
+		t.Fatal(err)
+	}
+	mounted = false
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("Serving ended with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Still serving after the unmount")
+	}
+}
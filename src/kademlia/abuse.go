@@ -0,0 +1,260 @@
+package kademlia
+
+// Protection against peers flooding or misbehaving. Requests are rate limited
+// with token buckets, one for the IP they came from and one for the node in
+// the request's Sender. A Sender can be forged, so the IP's bucket is what
+// holds back a peer making up a new node ID for every request, it allows
+// RATE_LIMIT_IP_FACTOR times a node's rate as several nodes may share an IP
+// behind NAT. Loopback IPs aren't limited, a local test cluster shares them.
+// At most MAX_RATE_BUCKETS buckets are kept, once they are in use new node
+// IDs are only held back by their IP's bucket and new IPs are refused.
+// A node answering with a bad MsgID gets a strike, after AbuseLimits.Strikes
+// of them it is banned for BanTime: its requests are refused and it is kept
+// out of our buckets and lookups.
+// Contact updates from requests go through a queue served by CONTACT_WORKERS
+// goroutines, as updating a full bucket may dial out, and are dropped when
+// the queue is full.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// default limits, see AbuseLimits
+const RATE_LIMIT_PER_SECOND = 100
+const RATE_LIMIT_BURST = 500
+const BAN_STRIKES = 3
+const BAN_MINUTES = 10
+
+// how many times a node's rate all requests from one IP may make
+const RATE_LIMIT_IP_FACTOR = 4
+
+const MAX_RATE_BUCKETS = 10000
+
+const CONTACT_WORKERS = 4
+const CONTACT_QUEUE = 256
+
+var ErrRateLimited = errors.New("Too many requests")
+var ErrBanned = errors.New("Sender is banned")
+
+// Rate is how many requests a second a sender may make on average, Burst how
+// many at once. Zero Rate or Strikes disables rate limiting or banning
+type AbuseLimits struct {
+	Rate    float64
+	Burst   int
+	Strikes int
+	BanTime time.Duration
+}
+
+func DefaultAbuseLimits() AbuseLimits {
+	return AbuseLimits{Rate: RATE_LIMIT_PER_SECOND,
+		Burst:   RATE_LIMIT_BURST,
+		Strikes: BAN_STRIKES,
+		BanTime: BAN_MINUTES * time.Minute}
+}
+
+func (k *Kademlia) SetAbuseLimits(limits AbuseLimits) {
+	k.abuseMutex.Lock()
+	k.abuseLimits = limits
+	k.abuseMutex.Unlock()
+}
+
+// counts of refused requests and dropped contact updates since we started,
+// and the bans in force with when they end
+type AbuseStats struct {
+	RateLimited    uint64
+	BannedRequests uint64
+	Strikes        uint64
+	DroppedUpdates uint64
+	Bans           map[string]time.Time
+}
+
+func (s AbuseStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d rate limited, %d from banned senders, %d strikes, %d contact updates dropped, %d banned",
+		s.RateLimited, s.BannedRequests, s.Strikes, s.DroppedUpdates, len(s.Bans))
+	banned := make([]string, 0, len(s.Bans))
+	for key := range s.Bans {
+		banned = append(banned, key)
+	}
+	sort.Strings(banned)
+	for _, key := range banned {
+		fmt.Fprintf(&b, "\n  %s until %s", key, s.Bans[key].Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+func (k *Kademlia) AbuseStats() AbuseStats {
+	k.abuseMutex.Lock()
+	defer k.abuseMutex.Unlock()
+	stats := k.abuseStats
+	stats.Bans = make(map[string]time.Time, len(k.bans))
+	for key, until := range k.bans {
+		if time.Now().Before(until) {
+			stats.Bans[key] = until
+		}
+	}
+	return stats
+}
+
+// the IP of remote, a HOST:PORT address
+func remoteIP(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token from key's bucket, a node ID as hex or with ip set an IP,
+// false if it is empty
+func (k *Kademlia) allowRequest(key string, ip bool) bool {
+	k.abuseMutex.Lock()
+	defer k.abuseMutex.Unlock()
+	limits := k.abuseLimits
+	if limits.Rate <= 0 {
+		return true
+	}
+	rate, burst := limits.Rate, float64(limits.Burst)
+	if ip {
+		if parsed := net.ParseIP(key); parsed != nil && parsed.IsLoopback() {
+			return true
+		}
+		rate, burst = RATE_LIMIT_IP_FACTOR*rate, RATE_LIMIT_IP_FACTOR*burst
+	}
+	now := time.Now()
+	bucket, ok := k.rateBuckets[key]
+	if ok == false {
+		if len(k.rateBuckets) >= MAX_RATE_BUCKETS {
+			if ip {
+				k.abuseStats.RateLimited += 1
+			}
+			return ip == false
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		k.rateBuckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		k.abuseStats.RateLimited += 1
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+func (k *Kademlia) isBanned(key string) bool {
+	k.abuseMutex.Lock()
+	defer k.abuseMutex.Unlock()
+	until, ok := k.bans[key]
+	return ok && time.Now().Before(until)
+}
+
+// refuse a request from the peer at remote with sender in it if the sender is
+// banned or it or remote's IP is over its rate
+func (k *Kademlia) checkRequest(sender ID, remote string) error {
+	anonymous := sender.Equals(ID{})
+	if anonymous == false && k.isBanned(sender.AsString()) {
+		k.abuseMutex.Lock()
+		k.abuseStats.BannedRequests += 1
+		k.abuseMutex.Unlock()
+		return ErrBanned
+	}
+	if k.allowRequest(remoteIP(remote), true) == false ||
+		(anonymous == false && k.allowRequest(sender.AsString(), false) == false) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// give the node with id a strike, banning it once it has too many. A banned
+// node is dropped from our buckets
+func (k *Kademlia) misbehaved(id ID) {
+	key := id.AsString()
+	k.abuseMutex.Lock()
+	limits := k.abuseLimits
+	k.abuseStats.Strikes += 1
+	k.strikes[key] += 1
+	banned := limits.Strikes > 0 && k.strikes[key] >= limits.Strikes
+	if banned {
+		delete(k.strikes, key)
+		k.bans[key] = time.Now().Add(limits.BanTime)
+	}
+	k.abuseMutex.Unlock()
+
+	if banned {
+		k.dropContact(id)
+	}
+}
+
+// remove the contact for id from our buckets, if we have it
+func (k *Kademlia) dropContact(id ID) {
+	pre := k.NodeID.Xor(id).PrefixLen()
+	if pre >= BucketCount {
+		return
+	}
+	k.contactsMutex[pre].Lock()
+	defer k.contactsMutex[pre].Unlock()
+	bucket := k.Contacts[pre]
+	for el := bucket.Front(); el != nil; el = el.Next() {
+		if el.Value.(Contact).NodeID.Equals(id) {
+			k.removeContact(bucket, el)
+			return
+		}
+	}
+}
+
+// forget ended bans, old strikes and full token buckets
+func (k *Kademlia) expireAbuse() {
+	k.abuseMutex.Lock()
+	defer k.abuseMutex.Unlock()
+	now := time.Now()
+	for key, until := range k.bans {
+		if now.After(until) {
+			delete(k.bans, key)
+		}
+	}
+	if now.Sub(k.strikesReset) > k.abuseLimits.BanTime {
+		k.strikes = make(map[string]int)
+		k.strikesReset = now
+	}
+	if k.abuseLimits.Rate > 0 {
+		// IP buckets have the same refill time
+		refill := time.Duration(float64(k.abuseLimits.Burst) / k.abuseLimits.Rate * float64(time.Second))
+		for key, bucket := range k.rateBuckets {
+			if now.Sub(bucket.last) > refill {
+				delete(k.rateBuckets, key)
+			}
+		}
+	}
+}
+
+// have a worker update our contact for con, dropping the update if all are
+// busy
+func (k *Kademlia) queueContact(con Contact) {
+	select {
+	case k.contactQueue <- con:
+	default:
+		k.abuseMutex.Lock()
+		k.abuseStats.DroppedUpdates += 1
+		k.abuseMutex.Unlock()
+	}
+}
+
+func (k *Kademlia) contactWorker() {
+	for con := range k.contactQueue {
+		k.UpdateContacts(con)
+	}
+}
@@ -0,0 +1,90 @@
+package kademlia
+
+// Node addresses. A contact's Host and Port are where it is reached first,
+// Addrs lists further HOST:PORT addresses it listens on, so a dual-stack node
+// can be reached over IPv4 and IPv6 alike. Addresses are always built with
+// net.JoinHostPort so IPv6 hosts get their brackets.
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strconv"
+)
+
+// split a HOST:PORT address, IPv6 hosts in brackets. localhost is taken to be
+// 127.0.0.1, other names are resolved
+func ParseHostPort(addr string) (net.IP, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, errors.New("Invalid port " + portStr)
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+		ip = ipAddr.IP
+	}
+	return ip, uint16(port), nil
+}
+
+// the contact for id listening on addrs, the first address becomes Host and
+// Port and the others Addrs
+func NewContact(id ID, addrs []string) (Contact, error) {
+	con := Contact{NodeID: CopyID(id)}
+	if len(addrs) == 0 {
+		return con, errors.New("No address given")
+	}
+	for i, addr := range addrs {
+		ip, port, err := ParseHostPort(addr)
+		if err != nil {
+			return con, err
+		}
+		if i == 0 {
+			con.Host, con.Port = ip, port
+		} else {
+			con.Addrs = append(con.Addrs, JoinHostPort(ip.String(), port))
+		}
+	}
+	return con, nil
+}
+
+func JoinHostPort(host string, port uint16) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// all addresses of node, the primary one first
+func nodeAddrs(node FoundNode) []string {
+	addrs := make([]string, 0, 1+len(node.Addrs))
+	addrs = append(addrs, foundNodeToAddrStr(node))
+	return append(addrs, node.Addrs...)
+}
+
+// connect to node on the first of its addresses that answers, or through its
+// relay if it has one
+func (k *Kademlia) dialNode(node FoundNode) (*rpc.Client, error) {
+	if node.Relay != "" {
+		return k.dialRelayed(node)
+	}
+	var err error
+	for _, addr := range nodeAddrs(node) {
+		var client *rpc.Client
+		if client, err = k.dialRPC(addr, &node.NodeID); err == nil {
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+func (k *Kademlia) DialContact(con Contact) (*rpc.Client, error) {
+	return k.dialNode(ContactToFoundNode(con))
+}
@@ -0,0 +1,299 @@
+package kademlia
+
+// Finding bootstrap nodes and joining through them. Bootstrap addresses come
+// from the command line, a seed file listing one address per line, or DNS:
+// the SRV records of _kademlia._tcp.NAME and TXT records of NAME reading
+// "kademlia=HOST:PORT". Join asks all of them at once and succeeds as long as
+// one answers.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+)
+
+// how long Join waits for the bootstrap nodes to answer
+const BOOTSTRAP_TIMEOUT_SECONDS = 5
+
+// how long a DNS seed lookup may take
+const SEED_DNS_TIMEOUT_SECONDS = 5
+
+var ErrNoBootstrap = errors.New("No bootstrap node responded")
+
+// split a comma separated list of addresses, dropping empty entries
+func ParseSeedList(list string) []string {
+	seeds := make([]string, 0)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			seeds = append(seeds, addr)
+		}
+	}
+	return seeds
+}
+
+// read the addresses in a seed file, one per line, # starts a comment
+func LoadSeedFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seeds := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		seeds = append(seeds, ParseSeedList(line)...)
+	}
+	return seeds, scanner.Err()
+}
+
+// look up the bootstrap nodes published for name in DNS. With server set,
+// queries go to that DNS server instead of the system resolver
+func LookupSeeds(name string, server string) ([]string, error) {
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SEED_DNS_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	seeds := make([]string, 0)
+	_, srvs, srvErr := resolver.LookupSRV(ctx, "kademlia", "tcp", name)
+	for _, srv := range srvs {
+		seeds = append(seeds, JoinHostPort(strings.TrimSuffix(srv.Target, "."), srv.Port))
+	}
+	txts, txtErr := resolver.LookupTXT(ctx, name)
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "kademlia=") {
+			seeds = append(seeds, ParseSeedList(strings.TrimPrefix(txt, "kademlia="))...)
+		}
+	}
+	if len(seeds) == 0 {
+		if srvErr != nil {
+			return nil, srvErr
+		}
+		if txtErr != nil {
+			return nil, txtErr
+		}
+	}
+	return seeds, nil
+}
+
+// gather the bootstrap addresses from list, a comma separated list, the seed
+// file and DNS name if given, leaving out self, our own addresses
+func CollectSeeds(list string, seedFile string, dnsName string, dnsServer string, self []string) ([]string, error) {
+	seeds := ParseSeedList(list)
+	if seedFile != "" {
+		fileSeeds, err := LoadSeedFile(seedFile)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+	if dnsName != "" {
+		dnsSeeds, err := LookupSeeds(dnsName, dnsServer)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, dnsSeeds...)
+	}
+
+	others := make([]string, 0, len(seeds))
+	seen := make(map[string]bool)
+	for _, addr := range self {
+		seen[addr] = true
+	}
+	for _, addr := range seeds {
+		if seen[addr] == false {
+			seen[addr] = true
+			others = append(others, addr)
+		}
+	}
+	return others, nil
+}
+
+// JoinStats tells how a Join went. Bootstrapped counts the bootstrap nodes
+// that answered, Contacts and Buckets the contacts known after joining and
+// the buckets they are spread over, Refreshed the buckets looked up
+type JoinStats struct {
+	Seeds        int
+	Bootstrapped int
+	Contacts     int
+	Buckets      int
+	Refreshed    int
+	Duration     time.Duration
+}
+
+func (s JoinStats) String() string {
+	return fmt.Sprintf("joined through %d of %d bootstrap nodes, %d contacts in %d buckets, refreshed %d buckets in %v",
+		s.Bootstrapped, s.Seeds, s.Contacts, s.Buckets, s.Refreshed, s.Duration)
+}
+
+// ask the node at addr who it is and for the nodes closest to us, without
+// telling it who we are
+func (k *Kademlia) bootstrapFrom(addr string) (Contact, []FoundNode, error) {
+	var con Contact
+	// the address may be a name, keep the one we reach
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return con, nil, err
+	}
+	conn, err := k.dialConn(tcpAddr.String(), nil)
+	if err != nil {
+		return con, nil, err
+	}
+	if conn, err = httpConnect(conn, rpc.DefaultRPCPath); err != nil {
+		conn.Close()
+		return con, nil, err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	ping := Ping{MsgID: NewRandomID()}
+	pong := new(Pong)
+	if err = client.Call("Kademlia.Ping", ping, pong); err != nil {
+		return con, nil, callError(err)
+	}
+	if ping.MsgID.Equals(pong.MsgID) == false {
+		return con, nil, ErrBadMsgID
+	}
+	if pong.Sender.NodeID.Equals(k.NodeID) {
+		return con, nil, errors.New("Bootstrap node is ourselves")
+	}
+	// over TLS the node must be the one its certificate is bound to
+	if peer, ok := connNodeID(conn); ok && peer.Equals(pong.Sender.NodeID) == false {
+		return con, nil, ErrPeerID
+	}
+	k.observe(tcpAddr.IP.String(), pong.Observed)
+	con = Contact{NodeID: CopyID(pong.Sender.NodeID), Host: tcpAddr.IP, Port: uint16(tcpAddr.Port),
+		PublicKey: pong.Sender.PublicKey, Nonce: pong.Sender.Nonce}
+
+	req := FindNodeRequest{MsgID: NewRandomID(), NodeID: CopyID(k.NodeID)}
+	res := new(FindNodeResult)
+	if err = client.Call("Kademlia.FindNode", req, res); err != nil {
+		return con, nil, callError(err)
+	}
+	if res.Err != nil {
+		return con, nil, res.Err
+	}
+	if req.MsgID.Equals(res.MsgID) == false {
+		return con, nil, ErrBadMsgID
+	}
+	return con, res.Nodes, nil
+}
+
+// a random ID that falls into bucket i
+func (k *Kademlia) bucketRandomID(i int) ID {
+	dist := NewRandomID()
+	for bit := 0; bit < i; bit++ {
+		dist[bit/8] &^= 1 << uint(bit%8)
+	}
+	dist[i/8] |= 1 << uint(i%8)
+	return k.NodeID.Xor(dist)
+}
+
+// the number of contacts we know and of buckets holding them, and the closest
+// bucket in use, -1 if all are empty
+func (k *Kademlia) contactStats() (contacts int, buckets int, closest int) {
+	closest = -1
+	for i := 0; i < BucketCount; i++ {
+		k.contactsMutex[i].Lock()
+		n := k.Contacts[i].Len()
+		k.contactsMutex[i].Unlock()
+		if n > 0 {
+			contacts, buckets, closest = contacts+n, buckets+1, i
+		}
+	}
+	return
+}
+
+// join the network through any of seeds, which are HOST:PORT addresses with
+// IPv6 hosts in brackets, see Bootstrap and Announce
+func (k *Kademlia) Join(me Contact, seeds []string) (JoinStats, error) {
+	stats, err := k.Bootstrap(seeds)
+	if err != nil {
+		return stats, err
+	}
+	k.Announce(me, &stats)
+	return stats, nil
+}
+
+// learn contacts from seeds, which are HOST:PORT addresses with IPv6 hosts in
+// brackets, without making ourselves known. The bootstrap nodes and their
+// neighbours go into our buckets, and some of them are asked where they see
+// us, so BehindNAT can tell before we Announce our contact
+func (k *Kademlia) Bootstrap(seeds []string) (JoinStats, error) {
+	start := time.Now()
+	stats := JoinStats{Seeds: len(seeds)}
+	type bootstrapResult struct {
+		con   Contact
+		nodes []FoundNode
+		err   error
+	}
+	results := make(chan bootstrapResult, len(seeds))
+	for _, addr := range seeds {
+		go func(addr string) {
+			con, nodes, err := k.bootstrapFrom(addr)
+			results <- bootstrapResult{con, nodes, err}
+		}(addr)
+	}
+
+	deadline := time.After(BOOTSTRAP_TIMEOUT_SECONDS * time.Second)
+collect:
+	for range seeds {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				continue
+			}
+			stats.Bootstrapped += 1
+			k.UpdateContacts(res.con)
+			for _, node := range res.nodes {
+				if node.NodeID.Equals(k.NodeID) == false {
+					k.UpdateContacts(FoundNodeToContact(node))
+				}
+			}
+		case <-deadline:
+			break collect
+		}
+	}
+	stats.Duration = time.Since(start)
+	if stats.Bootstrapped == 0 {
+		return stats, ErrNoBootstrap
+	}
+	k.probeObserved()
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// make ourselves known as me after Bootstrap: we look ourselves up and
+// refresh every bucket farther than our closest neighbour, adding to stats
+func (k *Kademlia) Announce(me Contact, stats *JoinStats) {
+	start := time.Now()
+	fnReq := FindNodeRequest{Sender: me, MsgID: NewRandomID(), NodeID: CopyID(k.NodeID)}
+	k.IterFindNode(fnReq, new(FindNodeResult))
+
+	_, _, closest := k.contactStats()
+	for i := 0; i < closest; i++ {
+		fnReq := FindNodeRequest{Sender: me, MsgID: NewRandomID(), NodeID: k.bucketRandomID(i)}
+		k.IterFindNode(fnReq, new(FindNodeResult))
+		stats.Refreshed += 1
+	}
+
+	stats.Contacts, stats.Buckets, _ = k.contactStats()
+	stats.Duration += time.Since(start)
+}
@@ -0,0 +1,202 @@
+package kademlia
+
+// Client side encryption of DFS file contents. Every encrypted file gets a
+// fresh random key, each block is sealed with AES-GCM under it, and the file
+// key is wrapped for every authorized reader's X25519 public key so storing
+// nodes only ever see ciphertext.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const fileKeySize = 32
+
+// a file key sealed for one reader. Ephemeral is the public half of the
+// throwaway key pair used to derive the wrapping key
+type WrappedKey struct {
+	Reader    []byte
+	Ephemeral []byte
+	Sealed    []byte
+}
+
+// set the key pair used to wrap and unwrap DFS file keys
+func (k *Kademlia) SetDFSKey(priv *ecdh.PrivateKey) {
+	k.dfsKey = priv
+}
+
+// public key other clients list as reader to share encrypted files with us
+func (k *Kademlia) DFSPublicKey() []byte {
+	if k.dfsKey == nil {
+		return nil
+	}
+	return k.dfsKey.PublicKey().Bytes()
+}
+
+// load the hex encoded X25519 private key at path, generating and saving a
+// new one if the file doesn't exist yet
+func LoadDFSKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(priv.Bytes())+"\n"), 0600)
+		return priv, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal data with a random nonce which is prepended to the result
+func seal(aead cipher.AEAD, data []byte, extra []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, extra), nil
+}
+
+func unseal(aead cipher.AEAD, sealed []byte, extra []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], extra)
+}
+
+// the key wrapping key binds both public keys so a wrapped key can't be
+// replayed for a different reader
+func wrappingKey(shared, ephemeral, reader []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(reader)
+	return h.Sum(nil)
+}
+
+func wrapFileKey(fileKey []byte, reader []byte) (WrappedKey, error) {
+	pub, err := ecdh.X25519().NewPublicKey(reader)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	aead, err := newGCM(wrappingKey(shared, eph.PublicKey().Bytes(), reader))
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	sealed, err := seal(aead, fileKey, nil)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{Reader: reader, Ephemeral: eph.PublicKey().Bytes(), Sealed: sealed}, nil
+}
+
+// find the key wrapped for priv and unwrap it
+func unwrapFileKey(keys []WrappedKey, priv *ecdh.PrivateKey) ([]byte, error) {
+	if priv == nil {
+		return nil, errors.New("No DFS key to decrypt file")
+	}
+	me := priv.PublicKey().Bytes()
+	for _, wrapped := range keys {
+		if bytes.Equal(wrapped.Reader, me) == false {
+			continue
+		}
+		eph, err := ecdh.X25519().NewPublicKey(wrapped.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := priv.ECDH(eph)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(wrappingKey(shared, wrapped.Ephemeral, me))
+		if err != nil {
+			return nil, err
+		}
+		return unseal(aead, wrapped.Sealed, nil)
+	}
+	return nil, errors.New("Not an authorized reader of this file")
+}
+
+// create a file key and wrap it for us and every reader
+func (k *Kademlia) newFileKey(readers [][]byte) ([]byte, []WrappedKey, error) {
+	if k.dfsKey == nil {
+		return nil, nil, errors.New("No DFS key to encrypt file")
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped := make([]WrappedKey, 0, len(readers)+1)
+	for _, reader := range append([][]byte{k.DFSPublicKey()}, readers...) {
+		w, err := wrapFileKey(fileKey, reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapped = append(wrapped, w)
+	}
+	return fileKey, wrapped, nil
+}
+
+// the readers keys were wrapped for and more, each once and without me, who
+// is always a reader
+func fileReaders(keys []WrappedKey, more [][]byte, me []byte) [][]byte {
+	readers := make([][]byte, 0, len(keys)+len(more))
+	for _, reader := range append(wrappedReaders(keys), more...) {
+		known := bytes.Equal(reader, me)
+		for _, other := range readers {
+			known = known || bytes.Equal(reader, other)
+		}
+		if known == false {
+			readers = append(readers, reader)
+		}
+	}
+	return readers
+}
+
+func wrappedReaders(keys []WrappedKey) [][]byte {
+	readers := make([][]byte, len(keys))
+	for i, wrapped := range keys {
+		readers[i] = wrapped.Reader
+	}
+	return readers
+}
+
+// blocks are bound to their position so they can't be reordered
+func blockIndex(i int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
@@ -3,41 +3,364 @@ package kademlia
 import (
     "errors"
     "bytes"
+    "crypto/cipher"
+    "math/rand"
     "strings"
     "time"
     "encoding/gob"
 )
 
+// how many times a directory update is retried when another client changed
+// the directory inode concurrently
+const DFS_CAS_RETRIES = 8
+
+// file contents are cut into blocks of at most this many bytes
+const DFS_BLOCK_SIZE = 64 * 1024
+
+// the root directory inode is kept under a well known key
+var DFSRootKey ID = FromBytes([]byte("kademlia dfs root"))
+
+// DFS errors keep their own message but match one of these with errors.Is,
+// a missing file or directory also matches ErrNotFound
+var ErrExists = errors.New("Already exists")
+var ErrNotEmpty = errors.New("Directory not empty")
+var ErrIsDir = errors.New("Path is a directory")
+var ErrInvalidPath = errors.New("Invalid path")
+var ErrConflict = errors.New("Changed by a concurrent update")
+var ErrFileNotFound = dfsError("File doesn't exist under the path provided", ErrNotFound)
+var ErrDirNotFound = dfsError("Couldn't find directory inode with the given key", ErrNotFound)
+
+type wrappedError struct {
+    msg string
+    err error
+}
+
+func (e *wrappedError) Error() string {
+    return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+    return e.err
+}
+
+// an error with message msg that errors.Is matches against err
+func dfsError(msg string, err error) error {
+    return &wrappedError{msg, err}
+}
+
 // DFS Inode and Content Block
+// Previous is the key of the inode this one replaced, zero for the first
+// revision, so the history of a file is a chain of immutable inodes. Blocks
+// of encrypted files are sealed under a file key found wrapped in Keys
 type FileInode struct {
-    Meta    MetaData
-    Blocks  []ID
+    Meta      MetaData
+    Blocks    []ID
+    Previous  ID
+    Revision  int
+    Encrypted bool
+    Keys      []WrappedKey
 }
 
+// Directory inodes live under a stable key and are updated in place with
+// CompareAndStore, file inodes and blocks are stored under their content hash.
+// Perms holds the owner and mode of the owned files in Files, see perm.go
 type DirInode struct {
     Meta    MetaData
     Files   map[string]ID
+    Perms   map[string]EntryPerm
+}
 
+// Blocks above DFS_ERASURE_THRESHOLD are erasure coded, their FileContent
+// has no Content but the hash of every shard, see erasure.go
 type FileContent struct {
-    Content []byte
-    Next    ID
+    Content    []byte
+    Next       ID
+    Shards     []ID
+    DataShards int
+    Size       int
 }
 
+// Version mirrors the version of the stored value, a client sends it back as
+// the expected version when it replaces the inode. DeleteTime and TrashedFrom
+// are set while the entry sits in a trash directory
 type MetaData struct {
     Name     string
     Size     int
+    IsDir    bool
     LastRead     time.Time
     LastModified time.Time
     DeleteTime   time.Time
+    TrashedFrom  string
+    Version      uint64
+    Owner        []byte
+    Mode         uint32
+}
+
+// every DFS value starts with this marker so nodes can tell DFS inodes and
+// blocks apart from other stored values, see the garbage collector
+var dfsMagic = []byte("KDFS")
+
+func encodeDFS(v interface{}) ([]byte, error) {
+    b := bytes.NewBuffer(append([]byte{}, dfsMagic...))
+    if err := gob.NewEncoder(b).Encode(v); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func isDFSValue(data []byte) bool {
+    return bytes.HasPrefix(data, dfsMagic)
+}
+
+func decodeDFS(data []byte, v interface{}) error {
+    if isDFSValue(data) == false {
+        return errors.New("Value is not a DFS inode or block")
+    }
+    return gob.NewDecoder(bytes.NewBuffer(data[len(dfsMagic):])).Decode(v)
+}
+
+// encode a value and store it under the hash of its encoding
+func (k *Kademlia) storeContent(sender Contact, msgID ID, v interface{}) (ID, error) {
+    value, err := encodeDFS(v)
+    if err != nil {
+        return ID{}, err
+    }
+    key := FromBytes(value)
+
+    storeReq := StoreRequest{Sender: sender,
+                             MsgID:  CopyID(msgID),
+                             Key:    key,
+                             Value:  value}
+    storeRes := new(StoreResult)
+    k.IterStore(storeReq, storeRes)
+    return key, storeRes.Err
+}
+
+// fetch a value by key and decode it into v
+func (k *Kademlia) findContent(sender Contact, msgID ID, key ID, v interface{}) error {
+    fvReq := FindValueRequest{UpdateTimestamp: true,
+                              Sender:          sender,
+                              MsgID:           CopyID(msgID),
+                              Key:             CopyID(key)}
+    fvRes := new(FindValueResult)
+    k.IterFindValue(fvReq, fvRes)
+    if fvRes.Err != nil {
+        return fvRes.Err
+    }
+    if fvRes.Value == nil {
+        return ErrNotFound
+    }
+    return decodeDFS(fvRes.Value, v)
+}
+
+// decode our own copy of the value under key into v, lookups only ask
+// other nodes
+func (k *Kademlia) findLocalContent(key ID, v interface{}) error {
+    k.storedDataMutex.Lock()
+    val, ok := k.StoredData[key]
+    k.storedDataMutex.Unlock()
+    if ok == false {
+        return ErrNotFound
+    }
+    return decodeDFS(val.Data, v)
+}
+
+func (k *Kademlia) findDirInode(sender Contact, msgID ID, key ID) (*DirInode, error) {
+    dir := new(DirInode)
+    if err := k.findContent(sender, msgID, key, dir); err != nil {
+        return nil, ErrDirNotFound
+    }
+    if dir.Files == nil {
+        dir.Files = make(map[string]ID)
+    }
+    return dir, nil
+}
+
+// read the directory inode under key from every node a conditional store
+// goes to and take the copy most of them hold, a replica that took the update
+// of a client which lost a race must not be built on
+func (k *Kademlia) readDirQuorum(sender Contact, msgID ID, key ID) (*DirInode, error) {
+    nodes, self := k.replicaNodes(sender, key)
+    votes := make(map[ID]int)
+    var best []byte
+    count := func(value []byte) {
+        hash := FromBytes(value)
+        votes[hash] += 1
+        if best == nil || votes[hash] > votes[FromBytes(best)] {
+            best = value
+        }
+    }
+    if self {
+        k.storedDataMutex.Lock()
+        if val, ok := k.StoredData[key]; ok {
+            count(append([]byte(nil), val.Data...))
+        }
+        k.storedDataMutex.Unlock()
+    }
+    for _, node := range nodes {
+        fvReq := FindValueRequest{UpdateTimestamp: true,
+                                  Sender:          sender,
+                                  MsgID:           CopyID(msgID),
+                                  Key:             CopyID(key)}
+        fvRes := k.remoteFindValue(node, fvReq)
+        if fvRes.Err == nil && fvRes.Value != nil {
+            count(fvRes.Value)
+        }
+    }
+    if best == nil {
+        return nil, ErrDirNotFound
+    }
+    dir := new(DirInode)
+    if err := decodeDFS(best, dir); err != nil {
+        return nil, err
+    }
+    if dir.Files == nil {
+        dir.Files = make(map[string]ID)
+    }
+    return dir, nil
+}
+
+// read the directory inode under key, apply mutate and conditionally store it
+// back under the same key, retrying from the read when another client won
+// the race. mutate may be called several times and must not have side effects
+// besides changing the inode
+func (k *Kademlia) updateDirInode(sender Contact, msgID ID, key ID, mutate func(*DirInode) error) error {
+    for attempt := 0; attempt < DFS_CAS_RETRIES; attempt++ {
+        dir, err := k.readDirQuorum(sender, msgID, key)
+        if err != nil {
+            return err
+        }
+        if err = mutate(dir); err != nil {
+            return err
+        }
+
+        expected := dir.Meta.Version
+        dir.Meta.Version = expected + 1
+        dir.Meta.LastRead = time.Now()
+        dir.Meta.LastModified = time.Now()
+        value, err := encodeDFS(dir)
+        if err != nil {
+            return err
+        }
+
+        casReq := CompareAndStoreRequest{Sender:  sender,
+                                         MsgID:   CopyID(msgID),
+                                         Key:     CopyID(key),
+                                         Value:   value,
+                                         Version: expected}
+        k.signCompareAndStore(&casReq)
+        casRes := new(CompareAndStoreResult)
+        k.IterCompareAndStore(casReq, casRes)
+        if err = casRes.Err; errors.Is(err, ErrVersionMismatch) == false {
+            return err
+        }
+
+        // back off a random amount so racing clients don't collide again
+        time.Sleep(time.Duration(rand.Intn(50*(attempt+1))) * time.Millisecond)
+    }
+    return dfsError("Couldn't update directory, too many concurrent updates", ErrConflict)
+}
+
+// cut content into blocks and store each of them, returning their keys in
+// order. When encrypting, the blocks are sealed under a new file key which is
+// returned wrapped for us and the readers
+func (k *Kademlia) storeFileBlocks(sender Contact, msgID ID, content []byte,
+                                   encrypt bool, readers [][]byte) ([]ID, []WrappedKey, error) {
+    var aead cipher.AEAD
+    var wrapped []WrappedKey
+    if encrypt {
+        fileKey, keys, err := k.newFileKey(readers)
+        if err != nil {
+            return nil, nil, err
+        }
+        if aead, err = newGCM(fileKey); err != nil {
+            return nil, nil, err
+        }
+        wrapped = keys
+    }
+
+    keys := make([]ID, 0, len(content)/DFS_BLOCK_SIZE+1)
+    for start := 0; start < len(content) || start == 0; start += DFS_BLOCK_SIZE {
+        end := start + DFS_BLOCK_SIZE
+        if end > len(content) {
+            end = len(content)
+        }
+        data := content[start:end]
+        if aead != nil {
+            sealed, err := seal(aead, data, blockIndex(len(keys)))
+            if err != nil {
+                return nil, nil, err
+            }
+            data = sealed
+        }
+        var key ID
+        var err error
+        if len(data) > DFS_ERASURE_THRESHOLD {
+            key, err = k.storeErasureBlock(sender, msgID, data)
+        } else {
+            key, err = k.storeContent(sender, msgID, FileContent{Content: data})
+        }
+        if err != nil {
+            return nil, nil, err
+        }
+        keys = append(keys, key)
+        if end == len(content) {
+            break
+        }
+    }
+    return keys, wrapped, nil
+}
+
+// fetch all blocks of a file and join their contents, decrypting them if we
+// are one of the file's readers
+func (k *Kademlia) readFileBlocks(sender Contact, msgID ID, inode FileInode) ([]byte, error) {
+    var aead cipher.AEAD
+    if inode.Encrypted {
+        fileKey, err := unwrapFileKey(inode.Keys, k.dfsKey)
+        if err != nil {
+            return nil, err
+        }
+        if aead, err = newGCM(fileKey); err != nil {
+            return nil, err
+        }
+    }
+
+    content := make([]byte, 0, inode.Meta.Size)
+    for i, key := range inode.Blocks {
+        block := new(FileContent)
+        if err := k.findContent(sender, msgID, key, block); err != nil {
+            return nil, err
+        }
+        if len(block.Shards) > 0 {
+            data, err := k.readErasureBlock(sender, msgID, key, *block)
+            if err != nil {
+                return nil, err
+            }
+            block.Content = data
+        }
+        if aead != nil {
+            data, err := unseal(aead, block.Content, blockIndex(i))
+            if err != nil {
+                return nil, err
+            }
+            block.Content = data
+        }
+        content = append(content, block.Content...)
+    }
+    return content, nil
 }
 
 // Create File
+// Encrypt seals the content so only we and the Readers, given by their DFS
+// public keys, can read it
 type CreateFileRequest struct {
     Sender  Contact
     MsgID   ID
     Name    string
     DirKey  ID
     Content []byte
+    Encrypt bool
+    Readers [][]byte
 }
 
 type CreateFileResult struct {
@@ -51,95 +374,51 @@ type CreateFileResult struct {
 func (k *Kademlia) CreateFile(cfReq CreateFileRequest, cfRes *CreateFileResult) {
     cfRes.MsgID = CopyID(cfReq.MsgID)
 
-    fvReq := FindValueRequest{UpdateTimestamp: true,
-                              Sender:          cfReq.Sender,
-                              MsgID:           CopyID(cfReq.MsgID),
-                              Key:             CopyID(cfReq.DirKey)}
-    fvRes := new(FindValueResult)
-    k.IterFindValue(fvReq, fvRes)
-    if fvRes.Err != nil {
-        cfRes.Err = fvRes.Err
+    dir, err := k.findDirInode(cfReq.Sender, cfReq.MsgID, cfReq.DirKey)
+    if err != nil {
+        cfRes.Err = err
+        return
+    }
+    if _, ok := dir.Files[cfReq.Name]; ok {
+        cfRes.Err = dfsError("Couldn't create file already exists", ErrExists)
         return
     }
 
-    if len(fvRes.Nodes) > 0 {
-        b = bytes.NewBuffer(fvRes.Value)
-        dir := new(DirInode)
-        gob.NewDecoder(b).Decode(dir)
-        if _, ok := dir.Files[cfReq.Name]; ok {
-            cfRes.Err = errors.New("Couldn't create file already exists")
-            return
-        }
+    fileBlockKeys, wrapped, err := k.storeFileBlocks(cfReq.Sender, cfReq.MsgID, cfReq.Content,
+                                                     cfReq.Encrypt, cfReq.Readers)
+    if err != nil {
+        cfRes.Err = err
+        return
+    }
 
-        delReq := DeleteValueRequest{Sender: cfReq.Sender,
-                                     MsgID:  CopyID(cfReq.MsgID),
-                                     Key:    CopyID(cfReq.DirKey)}
-        delRes := new(DeleteValueResult)
-        go (k.IterDelete(delReq, delRes))
-
-        // ToDo: cut big content into pieces and have multiple blocks
-        fileContent := FileContent{Content: cfReq.Content, Next: nil}
-        b := new(bytes.Buffer)
-        gob.NewEncoder(b).Encode(fileContent)
-        fileBlockValue := b.Bytes()
-        fileBlockKey := FromBytes(fileBlockValue)
-
-        storeReq := StoreRequest{Sender: cfReq.Sender,
-                                 MsgID:  CopyID(cfReq.MsgID),
-                                 Key:    fileBlockKey,
-                                 Value:  fileBlockValue}
-        storeRes := new(StoreResult)
-        k.IterStore(storeReq, storeRes)
-        if storeRes.Err != nil {
-            cfRes.Err = storeRes.Err
-            return
-        }
+    fileMeta := MetaData{Name:          cfReq.Name,
+                         Size:          len(cfReq.Content),
+                         LastRead:      time.Now(),
+                         LastModified:  time.Now(),
+                         Owner:         k.SigningPublicKey(),
+                         Mode:          DFS_FILE_MODE}
+    fileInode := FileInode{Meta:      fileMeta,
+                           Blocks:    fileBlockKeys,
+                           Encrypted: cfReq.Encrypt,
+                           Keys:      wrapped}
+    fileInodeKey, err := k.storeContent(cfReq.Sender, cfReq.MsgID, fileInode)
+    if err != nil {
+        cfRes.Err = err
+        return
+    }
 
-        fileMeta := MetaData{Name:          cfReq.Name,
-                             Size:          len(cfReq.Content),
-                             LastRead:      time.Now(),
-                             LastModified:  time.Now(),
-                             DeleteTime:    nil}
-        fileBlockKeys := []ID
-        append(fileBlockKeys, fileBlockKey)
-        fileInode := FileInode{Meta:   fileMeta,
-                               Blocks: fileBlockKeys}
-        b = new(bytes.Buffer)
-        gob.NewEncoder(b).Encode(fileInode)
-        fileInodeValue := b.Bytes()
-        fileInodeKey := FromBytes(fileInodeValue)
-
-        storeReq = StoreRequest{Sender: cfReq.Sender,
-                                MsgID:  CopyID(cfReq.MsgID),
-                                Key:    fileInodeKey,
-                                Value:  fileInodeValue}
-        storeRes = new(StoreResult)
-        k.IterStore(storeReq, storeRes)
-        if storeRes.Err != nil {
-            cfRes.Err = storeRes.Err
-            return
+    err = k.updateDirInode(cfReq.Sender, cfReq.MsgID, cfReq.DirKey, func(dir *DirInode) error {
+        if _, ok := dir.Files[cfReq.Name]; ok {
+            return dfsError("Couldn't create file already exists", ErrExists)
         }
-
-        dir.Meta.LastRead = time.Now()
-        dir.Meta.LastModified = time.Now()
-        dir.Files[cfReq.Name] = fileInodeKey
-        b = new(bytes.Buffer)
-        gob.NewEncoder(b).Encode(dir)
-        dirInodeValue := b.Bytes()
-        dirInodeKey := FromBytes(dirInodeValue)
-        storeReq = StoreRequest{Sender: cfReq.Sender,
-                                MsgID:  CopyID(cfReq.MsgID),
-                                Key:    dirInodeKey,
-                                Value:  dirInodeValue}
-        storeRes = new(StoreResult)
-        k.IterStore(storeReq, storeRes)
-        if storeRes.Err != nil {
-            cfRes.Err = storeRes.Err
-        }
-        cfRes.Key = fileInodeKey
-    } else {
-        cfRes.Err = errors.New("Couldn't find directory inode with the given key")
+        linkEntry(dir, cfReq.Name, fileInodeKey, entryPerm(fileMeta))
+        return nil
+    })
+    if err != nil {
+        cfRes.Err = err
+        return
     }
+    cfRes.Key = fileInodeKey
     return
 }
 
@@ -157,86 +436,78 @@ type CreateDirResult struct {
     Err     error
 }
 
-func (k *Kademlia) CreateDir(cdReq CreateDirRequest, cdRes CreateDirResult) {
+func (k *Kademlia) CreateDir(cdReq CreateDirRequest, cdRes *CreateDirResult) {
+    k.createDir(cdReq, cdRes, k.SigningPublicKey(), DFS_DIR_MODE)
+}
+
+// create the directory with the given owner, nil for none, and mode
+func (k *Kademlia) createDir(cdReq CreateDirRequest, cdRes *CreateDirResult, owner []byte, mode uint32) {
     cdRes.MsgID = CopyID(cdReq.MsgID)
 
-    fvReq := FindValueRequest{UpdateTimestamp: true,
-                              Sender:          cdReq.Sender,
-                              MsgID:           CopyID(cdReq.MsgID),
-                              Key:             CopyID(cdReq.DirKey)}
-    fvRes := new(FindValueResult)
-    k.IterFindValue(fvReq, fvRes)
-    if fvRes.Err != nil {
-        cdRes.Err = fvRes.Err
+    upperDir, err := k.findDirInode(cdReq.Sender, cdReq.MsgID, cdReq.DirKey)
+    if err != nil {
+        cdRes.Err = err
+        return
+    }
+    if _, ok := upperDir.Files[cdReq.Name]; ok {
+        cdRes.Err = dfsError("Couldn't create directory already exists", ErrExists)
         return
     }
 
-    if len(fvRes.Nodes) > 0 {
-        b = bytes.NewBuffer(fvRes.Value)
-        upperDir := new(DirInode)
-        gob.NewDecoder(b).Decode(upperDir)
-        if _, ok := upperDir.Files[cdReq.Name]; ok {
-            cdRes.Err = errors.New("Couldn't create directory already exists")
-            return
-        }
+    // the new inode's initial content hash becomes its permanent key, the
+    // creation time keeps it unique among equally named directories
+    meta := MetaData{Name:           cdReq.Name,
+                     Size:           0,
+                     IsDir:          true,
+                     LastRead:       time.Now(),
+                     LastModified:   time.Now(),
+                     Owner:          owner,
+                     Mode:           mode}
+    files := make(map[string]ID)
+    files[".."] = cdReq.DirKey
+    dirInode := DirInode{Meta:  meta,
+                         Files: files}
+    dirInodeKey, err := k.storeContent(cdReq.Sender, cdReq.MsgID, dirInode)
+    if err != nil {
+        cdRes.Err = err
+        return
+    }
 
-        delReq := DeleteValueRequest{Sender: cdReq.Sender,
-                                     MsgID:  CopyID(cdReq.MsgID),
-                                     Key:    CopyID(cdReq.DirKey)}
-        delRes := new(DeleteValueResult)
-        go (k.IterDelete(delReq, delRes))
-
-        meta := MetaData{Name:           cdReq.Name,
-                         Size:           0,
-                         LastRead:       time.Now(),
-                         LastModified    time.Now(),
-                         DeleteTime      nil}
-        files := make(map[string]ID)
-        files[".."] = cdReq.DirKey
-        dirInode := DirInode{Meta:  meta,
-                             Files: files}
-        b := new(bytes.Buffer)
-        gob.NewEncoder(b).Encode(dirInode)
-        dirInodeValue := b.Bytes()
-        dirInodeKey := FromBytes(dirInodeValue)
-        storeReq := StoreRequest{Sender: cdReq.Sender,
-                                 MsgID:  CopyID(cdReq.MsgID),
-                                 Key:    dirInodeKey,
-                                 Value:  dirInodeValue}
-        storeRes := new(StoreResult)
-        k.IterStore(storeReq, storeRes)
-        if storeRes.Err != nil {
-            cdRes.Err = storeRes.Err
-            return
+    err = k.updateDirInode(cdReq.Sender, cdReq.MsgID, cdReq.DirKey, func(dir *DirInode) error {
+        if _, ok := dir.Files[cdReq.Name]; ok {
+            return dfsError("Couldn't create directory already exists", ErrExists)
         }
-
-        upperDir.Meta.LastRead = time.Now()
-        upperDir.Meta.LastModified = time.Now()
-        upperDir.Files[cdReq.Name] = dirInodeKey
-        b = new(bytes.Buffer)
-        gob.NewEncoder(b).Encode(upperDir)
-        upperDirInodeValue := b.Bytes()
-        upperDirInodeKey := FromBytes(upperDirInodeValue)
-        storeReq = StoreRequest{Sender: cdReq.Sender,
-                                MsgID:  CopyID(cdReq.MsgID),
-                                Key:    upperDirInodeKey,
-                                Value:  upperDirInodeValue}
-        storeRes = new(StoreResult)
-        k.IterStore(storeReq, storeRes)
-        if storeRes.Err != nil {
-            cdRes.Err = storeRes.Err
-        }
-        cdRes.Key = dirInodeKey
-    } else {
-        cdRes.Err = errors.New("Couldn't find directory inode with the given key")
+        linkEntry(dir, cdReq.Name, dirInodeKey, entryPerm(meta))
+        return nil
+    })
+    if err != nil {
+        cdRes.Err = err
+        return
     }
+    cdRes.Key = dirInodeKey
     return
 }
 
+// split a path into its directory and last element, "/1/2/3" gives "/1/2"
+// and "3", "/3" gives "/" and "3"
+func splitPath(path string) (string, string) {
+    if len(path) > 1 {
+        path = strings.TrimRight(path, "/")
+    }
+    i := strings.LastIndex(path, "/")
+    switch {
+    case i < 0:
+        return "", path
+    case i == 0:
+        return "/", path[1:]
+    }
+    return path[:i], path[i+1:]
+}
+
 // Find File
 type FindFileRequest struct {
     Sender    Contact
-    MsgD      ID
+    MsgID     ID
     Path      string
     RootInode DirInode
     RootKey   ID
@@ -251,9 +522,7 @@ type FindFileResult struct {
 
 func (k *Kademlia) FindFile(req FindFileRequest, res *FindFileResult) {
     res.MsgID = CopyID(req.MsgID)
-    l := strings.Split(req.Path, "/") // Path, e.g. "/1/2/..."
-    dirPath := strings.Join(l[:-1], "/")
-    fileName := l[-1]
+    dirPath, fileName := splitPath(req.Path) // Path, e.g. "/1/2/..."
 
     fdReq := FindDirRequest{Sender:     req.Sender,
                             MsgID:      CopyID(req.MsgID),
@@ -267,31 +536,18 @@ func (k *Kademlia) FindFile(req FindFileRequest, res *FindFileResult) {
         return
     }
 
-    if fdRes.Inode != nil {
-        upperDir := fdRes.Inode
-        if key, ok := upperDir.Files[fileName]; ok {
-            res.Key = key
-            fvReq := FindValueRequest{UpdateTimestamp: true,
-                                      Sender:          req.Sender,
-                                      MsgID:           CopyID(req.MsgID),
-                                      Key:             key}
-            fvRes := new(FindValueResult)
-            k.IterFindValue(fvReq, fvRes)
-            if fvRes.Err != nil {
-                res.Err = fvRes.Err
-                return
-            }
-
-            b := bytes.NewBuffer(fvRes.Value)
-            fileInode := new(FileInode)
-            gob.NewDecoder(b).Decode(fileInode)
-            res.Inode = fileInode
-            // do we update LastRead attr in metadata?
-        } else {
-            res.Err = errors.New("File doesn't exist under the path provided")
+    upperDir := fdRes.Inode
+    if key, ok := upperDir.Files[fileName]; ok {
+        res.Key = key
+        fileInode := new(FileInode)
+        if err := k.findContent(req.Sender, req.MsgID, key, fileInode); err != nil {
+            res.Err = err
+            return
         }
+        res.Inode = *fileInode
+        // do we update LastRead attr in metadata?
     } else {
-        res.Err = errors.New("Couldn't find directory with path provided")
+        res.Err = ErrFileNotFound
     }
     return
 }
@@ -315,26 +571,25 @@ type FindDirResult struct {
 func (k *Kademlia) FindDir(req FindDirRequest, res *FindDirResult) {
     res.MsgID = CopyID(req.MsgID)
 
-    if len(l) == 0 {
+    if len(req.Path) == 0 {
         res.Inode = req.StartInode
         res.Key = req.StartKey
         return
     }
 
     // req.Path, e.g. "/1/2/...", "1/2/..."
-    if req.Path[0] == "/" {
-        if req.StartKey != nil {
-            startInode := req.StartInode
-            startKey := req.StartKey
-        } else {
+    if req.Path[0] == '/' {
+        startInode := req.StartInode
+        startKey := req.StartKey
+        if startKey.Equals(ID{}) {
             rootRes := new(FindDirResult)
             k.FindRoot(req, rootRes)
             if rootRes.Err != nil {
                 res.Err = rootRes.Err
                 return
             }
-            startInode := rootRes.Inode
-            startKey := rooRes.Key
+            startInode = rootRes.Inode
+            startKey = rootRes.Key
         }
 
         fdReq := FindDirRequest{Sender:     req.Sender,
@@ -346,47 +601,519 @@ func (k *Kademlia) FindDir(req FindDirRequest, res *FindDirResult) {
     } else {
         dirs := strings.Split(req.Path, "/")
         if key, ok := req.StartInode.Files[dirs[0]]; ok {
-            fvReq := FindValueRequest{UpdateTimestamp: true,
-                                      Sender:          req.Sender,
-                                      MsgID:           CopyID(req.MsgID),
-                                      Key:             key}
-            fvRes := new(FindValueResult)
-            k.IterFindValue(fvReq, fvRes)
-            if fvRes.Err != nil {
-                res.Err = fvRes.Err
+            dirInode, err := k.findDirInode(req.Sender, req.MsgID, key)
+            if err != nil {
+                res.Err = err
                 return
             }
 
-            if len(fvRes.Nodes) > 0 {
-                b := bytes.NewBuffer(fvRes.Value)
-                dirInode := new(DirInode)
-                gob.NewDecoder(b).Decode(dirInode)
-                if len(dirs) > 1 {
-                    restPath := strings.Join(dirs[1:], "/")
-                } else {
-                    restPath := ""
-                }
-                fdReq := FindDirRequest{Sender:     req.Sender,
-                                        MsgID:      CopyID(req.MsgID),
-                                        Path:       restPath,
-                                        StartInode: dirInode,
-                                        StartKey:   key}
-                k.FindDir(fdReq, res)
-            } else {
-                res.Err = errors.New("Couldn't find directory inode with key provided")
+            restPath := ""
+            if len(dirs) > 1 {
+                restPath = strings.Join(dirs[1:], "/")
             }
+            fdReq := FindDirRequest{Sender:     req.Sender,
+                                    MsgID:      CopyID(req.MsgID),
+                                    Path:       restPath,
+                                    StartInode: *dirInode,
+                                    StartKey:   key}
+            k.FindDir(fdReq, res)
         } else {
-            res.Err = errors.New("The target directory is not under this path")
+            res.Err = dfsError("The target directory is not under this path", ErrNotFound)
+        }
+    }
+    return
+}
+
+// Rename
+type RenameRequest struct {
+    Sender    Contact
+    MsgID     ID
+    SrcPath   string
+    DstPath   string
+    RootInode DirInode
+    RootKey   ID
+}
+
+type RenameResult struct {
+    MsgID ID
+    Key   ID
+    Err   error
+}
+
+// how far up the ".." chain we look before giving up, guards against cycles
+const DFS_MAX_DEPTH = 256
+
+// rename or move a file or directory. Moves within one directory are a
+// single conditional store, plus one renaming a directory's own inode first,
+// moves between directories first link the
+// destination and then unlink the source, undoing the link if that fails, so
+// a failure never loses the entry but can briefly show it in both places
+func (k *Kademlia) Rename(req RenameRequest, res *RenameResult) {
+    res.MsgID = CopyID(req.MsgID)
+
+    srcDirPath, srcName := splitPath(req.SrcPath)
+    dstDirPath, dstName := splitPath(req.DstPath)
+    if srcName == "" || dstName == "" || srcName == ".." || dstName == ".." ||
+       srcName == "." || dstName == "." {
+        res.Err = dfsError("Invalid source or destination name", ErrInvalidPath)
+        return
+    }
+
+    srcDir, err := k.findDirPath(req.Sender, req.MsgID, srcDirPath, req.RootInode, req.RootKey)
+    if err != nil {
+        res.Err = err
+        return
+    }
+    dstDir, err := k.findDirPath(req.Sender, req.MsgID, dstDirPath, req.RootInode, req.RootKey)
+    if err != nil {
+        res.Err = err
+        return
+    }
+
+    srcKey, ok := srcDir.Inode.Files[srcName]
+    if ok == false {
+        res.Err = ErrFileNotFound
+        return
+    }
+    if _, ok := dstDir.Inode.Files[dstName]; ok {
+        res.Err = dfsError("Destination already exists", ErrExists)
+        return
+    }
+
+    // directories keep their key, files are content addressed so the renamed
+    // inode gets a new one
+    dstKey := srcKey
+    fileInode := new(FileInode)
+    if err = k.findContent(req.Sender, req.MsgID, srcKey, fileInode); err != nil {
+        res.Err = err
+        return
+    }
+    isDir := fileInode.Meta.IsDir
+    if isDir {
+        if err = k.checkNotDescendant(req, dstDir.Key, srcKey); err != nil {
+            res.Err = err
+            return
+        }
+    } else if srcName != dstName {
+        fileInode.Meta.Name = dstName
+        if dstKey, err = k.storeContent(req.Sender, req.MsgID, *fileInode); err != nil {
+            res.Err = err
+            return
+        }
+    }
+
+    if srcDir.Key.Equals(dstDir.Key) {
+        // a directory takes its new name first and gets its old one back if
+        // the parent refuses, so a failed rename leaves both as they were.
+        // A node without a copy of the inode takes any update, so one the
+        // inode's owner and mode refuse isn't tried at all
+        renameDir := isDir && srcName != dstName
+        if renameDir && canWrite(fileInode.Meta, k.SigningPublicKey()) == false {
+            res.Err = ErrPermission
+            return
+        }
+        if renameDir {
+            if err = k.relinkDir(req, srcKey, dstName, srcDir.Key); err != nil {
+                res.Err = err
+                return
+            }
+        }
+        err = k.updateDirInode(req.Sender, req.MsgID, srcDir.Key, func(dir *DirInode) error {
+            if key, ok := dir.Files[srcName]; ok == false || key.Equals(srcKey) == false {
+                return dfsError("Source changed during rename", ErrConflict)
+            }
+            if _, ok := dir.Files[dstName]; ok {
+                return dfsError("Destination already exists", ErrExists)
+            }
+            unlinkEntry(dir, srcName)
+            linkEntry(dir, dstName, dstKey, entryPerm(fileInode.Meta))
+            return nil
+        })
+        if err != nil && renameDir {
+            k.relinkDir(req, srcKey, srcName, srcDir.Key)
+        }
+        res.Err, res.Key = err, dstKey
+        return
+    }
+
+    var fix, undo func(*DirInode)
+    if isDir {
+        fix = func(dir *DirInode) {
+            dir.Meta.Name = dstName
+            dir.Files[".."] = dstDir.Key
+        }
+        undo = func(dir *DirInode) {
+            dir.Meta.Name = srcName
+            dir.Files[".."] = srcDir.Key
+        }
+    }
+    res.Err = k.moveEntry(req.Sender, req.MsgID, srcDir.Key, srcName, srcKey,
+                          dstDir.Key, dstName, dstKey, entryPerm(fileInode.Meta), fix, undo)
+    if res.Err == nil {
+        res.Key = dstKey
+    }
+    return
+}
+
+// link newKey with perm as dstName in the directory dstDirKey and then unlink srcName
+// from srcDirKey if it still points at oldKey. A moved directory keeps its
+// key, fix points its inode at the new place and undo puts it back when the
+// move fails. Failures roll back on a best effort basis
+func (k *Kademlia) moveEntry(sender Contact, msgID ID, srcDirKey ID, srcName string, oldKey ID,
+                             dstDirKey ID, dstName string, newKey ID, perm EntryPerm,
+                             fix func(*DirInode), undo func(*DirInode)) error {
+    err := k.updateDirInode(sender, msgID, dstDirKey, func(dir *DirInode) error {
+        if _, ok := dir.Files[dstName]; ok {
+            return dfsError("Destination already exists", ErrExists)
+        }
+        linkEntry(dir, dstName, newKey, perm)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    if fix != nil {
+        err = k.updateDirInode(sender, msgID, oldKey, func(dir *DirInode) error {
+            fix(dir)
+            return nil
+        })
+    }
+    if err == nil {
+        err = k.updateDirInode(sender, msgID, srcDirKey, func(dir *DirInode) error {
+            if key, ok := dir.Files[srcName]; ok == false || key.Equals(oldKey) == false {
+                return dfsError("Source changed during move", ErrConflict)
+            }
+            unlinkEntry(dir, srcName)
+            return nil
+        })
+    }
+    if err != nil {
+        if undo != nil {
+            k.updateDirInode(sender, msgID, oldKey, func(dir *DirInode) error {
+                undo(dir)
+                return nil
+            })
+        }
+        k.updateDirInode(sender, msgID, dstDirKey, func(dir *DirInode) error {
+            if key, ok := dir.Files[dstName]; ok && key.Equals(newKey) {
+                unlinkEntry(dir, dstName)
+            }
+            return nil
+        })
+    }
+    return err
+}
+
+// resolve a directory path, relative paths start at rootInode
+func (k *Kademlia) findDirPath(sender Contact, msgID ID, path string, rootInode DirInode, rootKey ID) (*FindDirResult, error) {
+    fdReq := FindDirRequest{Sender:     sender,
+                            MsgID:      CopyID(msgID),
+                            Path:       path,
+                            StartInode: rootInode,
+                            StartKey:   rootKey}
+    fdRes := new(FindDirResult)
+    k.FindDir(fdReq, fdRes)
+    if fdRes.Inode.Files == nil && fdRes.Err == nil {
+        fdRes.Inode.Files = make(map[string]ID)
+    }
+    return fdRes, fdRes.Err
+}
+
+// point the ".." entry of a moved directory at its new parent
+func (k *Kademlia) relinkDir(req RenameRequest, key ID, name string, parent ID) error {
+    return k.updateDirInode(req.Sender, req.MsgID, key, func(dir *DirInode) error {
+        dir.Meta.Name = name
+        dir.Files[".."] = parent
+        return nil
+    })
+}
+
+// walk the ".." chain up from key and fail if it passes through ancestor,
+// moving a directory below itself would detach it from the tree
+func (k *Kademlia) checkNotDescendant(req RenameRequest, key ID, ancestor ID) error {
+    for depth := 0; depth < DFS_MAX_DEPTH; depth++ {
+        if key.Equals(ancestor) {
+            return dfsError("Can't move a directory into itself", ErrInvalidPath)
+        }
+        if key.Equals(req.RootKey) {
+            return nil
+        }
+        dir, err := k.findDirInode(req.Sender, req.MsgID, key)
+        if err != nil {
+            return err
+        }
+        parent, ok := dir.Files[".."]
+        if ok == false || parent.Equals(key) {
+            return nil
+        }
+        key = parent
+    }
+    return errors.New("Directory tree too deep")
+}
+
+// Read File
+type ReadFileRequest struct {
+    Sender    Contact
+    MsgID     ID
+    Path      string
+    RootInode DirInode
+    RootKey   ID
+}
+
+type ReadFileResult struct {
+    MsgID   ID
+    Inode   FileInode
+    Key     ID
+    Content []byte
+    Err     error
+}
+
+func (k *Kademlia) ReadFile(req ReadFileRequest, res *ReadFileResult) {
+    res.MsgID = CopyID(req.MsgID)
+    ffReq := FindFileRequest{Sender:    req.Sender,
+                             MsgID:     CopyID(req.MsgID),
+                             Path:      req.Path,
+                             RootInode: req.RootInode,
+                             RootKey:   req.RootKey}
+    ffRes := new(FindFileResult)
+    k.FindFile(ffReq, ffRes)
+    if ffRes.Err != nil {
+        res.Err = ffRes.Err
+        return
+    }
+    if ffRes.Inode.Meta.IsDir {
+        res.Err = ErrIsDir
+        return
+    }
+    res.Inode, res.Key = ffRes.Inode, ffRes.Key
+    res.Content, res.Err = k.readFileBlocks(req.Sender, req.MsgID, ffRes.Inode)
+    return
+}
+
+// Write File
+// Encrypt and Readers work as for CreateFileRequest. A replaced encrypted file
+// stays encrypted for its readers, Readers adds more. ModTime is recorded as
+// the file's modification time, the current time if zero
+type WriteFileRequest struct {
+    Sender    Contact
+    MsgID     ID
+    Path      string
+    Content   []byte
+    Encrypt   bool
+    Readers   [][]byte
+    ModTime   time.Time
+    RootInode DirInode
+    RootKey   ID
+}
+
+type WriteFileResult struct {
+    MsgID ID
+    Key   ID
+    Err   error
+}
+
+// replace the contents of the file at Path, creating it if it doesn't exist
+func (k *Kademlia) WriteFile(req WriteFileRequest, res *WriteFileResult) {
+    res.MsgID = CopyID(req.MsgID)
+    dirPath, name := splitPath(req.Path)
+    if name == "" || name == ".." || name == "." {
+        res.Err = dfsError("Invalid file name", ErrInvalidPath)
+        return
+    }
+
+    fdReq := FindDirRequest{Sender:     req.Sender,
+                            MsgID:      CopyID(req.MsgID),
+                            Path:       dirPath,
+                            StartInode: req.RootInode,
+                            StartKey:   req.RootKey}
+    fdRes := new(FindDirResult)
+    k.FindDir(fdReq, fdRes)
+    if fdRes.Err != nil {
+        res.Err = fdRes.Err
+        return
+    }
+
+    encrypt, readers := req.Encrypt, req.Readers
+    if key, ok := fdRes.Inode.Files[name]; ok {
+        old := new(FileInode)
+        if err := k.findContent(req.Sender, req.MsgID, key, old); err != nil {
+            res.Err = err
+            return
         }
+        if old.Encrypted {
+            encrypt, readers = true, fileReaders(old.Keys, req.Readers, k.DFSPublicKey())
+        }
+    }
+    blockKeys, wrapped, err := k.storeFileBlocks(req.Sender, req.MsgID, req.Content, encrypt, readers)
+    if err != nil {
+        res.Err = err
+        return
     }
+    meta := MetaData{Name:         name,
+                     Size:         len(req.Content),
+                     LastRead:     time.Now(),
+                     LastModified: req.ModTime,
+                     Owner:        k.SigningPublicKey(),
+                     Mode:         DFS_FILE_MODE}
+    if meta.LastModified.IsZero() {
+        meta.LastModified = time.Now()
+    }
+
+    // the new inode links the one it replaces, it's stored inside the update
+    // so a retry links whatever version won the race. Unlinked attempts are
+    // collected like any other unreferenced value. A replaced file keeps its
+    // owner and mode
+    var inodeKey ID
+    err = k.updateDirInode(req.Sender, req.MsgID, fdRes.Key, func(dir *DirInode) error {
+        inode := FileInode{Meta: meta, Blocks: blockKeys, Encrypted: encrypt, Keys: wrapped}
+        if key, ok := dir.Files[name]; ok {
+            old := new(FileInode)
+            if err := k.findContent(req.Sender, req.MsgID, key, old); err != nil {
+                return err
+            }
+            if old.Meta.IsDir {
+                return ErrIsDir
+            }
+            if canWrite(old.Meta, k.SigningPublicKey()) == false {
+                return ErrPermission
+            }
+            if old.Encrypted && encrypt == false {
+                return dfsError("File was encrypted while writing it", ErrConflict)
+            }
+            inode.Previous, inode.Revision = key, old.Revision+1
+            inode.Meta.Owner, inode.Meta.Mode = old.Meta.Owner, old.Meta.Mode
+        }
+        key, err := k.storeContent(req.Sender, req.MsgID, inode)
+        if err != nil {
+            return err
+        }
+        inodeKey = key
+        linkEntry(dir, name, inodeKey, entryPerm(inode.Meta))
+        return nil
+    })
+    res.Key, res.Err = inodeKey, err
     return
 }
 
-// Note: this is only placeholder
-// ToDo: find root directory and return its inode and key in dht
+// Remove
+type RemoveRequest struct {
+    Sender    Contact
+    MsgID     ID
+    Path      string
+    RootInode DirInode
+    RootKey   ID
+}
+
+type RemoveResult struct {
+    MsgID ID
+    Key   ID
+    Err   error
+}
+
+// unlink a file or an empty directory from its parent, the removed inode's
+// key is returned in the result
+func (k *Kademlia) Remove(req RemoveRequest, res *RemoveResult) {
+    res.MsgID = CopyID(req.MsgID)
+    dirPath, name := splitPath(req.Path)
+    if name == "" || name == ".." || name == "." {
+        res.Err = dfsError("Invalid file name", ErrInvalidPath)
+        return
+    }
+
+    fdReq := FindDirRequest{Sender:     req.Sender,
+                            MsgID:      CopyID(req.MsgID),
+                            Path:       dirPath,
+                            StartInode: req.RootInode,
+                            StartKey:   req.RootKey}
+    fdRes := new(FindDirResult)
+    k.FindDir(fdReq, fdRes)
+    if fdRes.Err != nil {
+        res.Err = fdRes.Err
+        return
+    }
+    key, ok := fdRes.Inode.Files[name]
+    if ok == false {
+        res.Err = ErrFileNotFound
+        return
+    }
+
+    inode := new(FileInode)
+    if err := k.findContent(req.Sender, req.MsgID, key, inode); err != nil {
+        res.Err = err
+        return
+    }
+    if inode.Meta.IsDir {
+        dir, err := k.findDirInode(req.Sender, req.MsgID, key)
+        if err != nil {
+            res.Err = err
+            return
+        }
+        for entry := range dir.Files {
+            if entry != ".." {
+                res.Err = ErrNotEmpty
+                return
+            }
+        }
+    }
+
+    res.Err = k.updateDirInode(req.Sender, req.MsgID, fdRes.Key, func(dir *DirInode) error {
+        if cur, ok := dir.Files[name]; ok == false || cur.Equals(key) == false {
+            return dfsError("File changed during remove", ErrConflict)
+        }
+        unlinkEntry(dir, name)
+        return nil
+    })
+    res.Key = key
+    return
+}
+
+// create an empty directory inode under a well known key if there is none.
+// The directory is its own parent. Nodes already holding one refuse the
+// version 0 store, so a concurrently created directory isn't replaced
+func (k *Kademlia) ensureDirInode(sender Contact, msgID ID, key ID, name string) error {
+    if _, err := k.findDirInode(sender, msgID, key); err == nil {
+        return nil
+    }
+    files := make(map[string]ID)
+    files[".."] = key
+    dir := DirInode{Meta:  MetaData{Name:         name,
+                                    IsDir:        true,
+                                    LastRead:     time.Now(),
+                                    LastModified: time.Now(),
+                                    Version:      1},
+                    Files: files}
+    value, err := encodeDFS(dir)
+    if err != nil {
+        return err
+    }
+    casReq := CompareAndStoreRequest{Sender:  sender,
+                                     MsgID:   CopyID(msgID),
+                                     Key:     key,
+                                     Value:   value,
+                                     Version: 0}
+    casRes := new(CompareAndStoreResult)
+    k.IterCompareAndStore(casReq, casRes)
+    if err = casRes.Err; errors.Is(err, ErrVersionMismatch) {
+        // somebody else created it first
+        return nil
+    }
+    return err
+}
+
+// find the root directory under DFSRootKey, creating an empty one the first
+// time the DFS is used
 func (k *Kademlia) FindRoot(req FindDirRequest, res *FindDirResult) {
     res.MsgID = CopyID(req.MsgID)
-    res.Inode = req.StartInode
-    res.Key = req.StartKey
+    res.Key = DFSRootKey
+    if res.Err = k.ensureDirInode(req.Sender, req.MsgID, DFSRootKey, "/"); res.Err != nil {
+        return
+    }
+    dir, err := k.findDirInode(req.Sender, req.MsgID, DFSRootKey)
+    if err != nil {
+        res.Err = err
+        return
+    }
+    res.Inode = *dir
     return
 }
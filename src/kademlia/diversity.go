@@ -0,0 +1,187 @@
+package kademlia
+
+// Address diversity of the routing table. A single host running many node IDs
+// could otherwise fill our buckets and eclipse us, so only so many contacts
+// may share an IP or a subnet, within a bucket and across the whole table.
+// A contact counts under every address it can be reached on. Subnets are /24
+// for IPv4 and /64 for IPv6. Loopback addresses aren't counted, a local test
+// cluster shares them.
+
+import (
+	"container/list"
+	"net"
+)
+
+// default limits, see DiversityLimits
+const BUCKET_IP_LIMIT = 2
+const BUCKET_SUBNET_LIMIT = 5
+const TABLE_IP_LIMIT = 10
+const TABLE_SUBNET_LIMIT = 20
+
+// how many contacts may share an IP or subnet, zero disables a limit
+type DiversityLimits struct {
+	BucketIP     int
+	BucketSubnet int
+	TableIP      int
+	TableSubnet  int
+}
+
+func DefaultDiversityLimits() DiversityLimits {
+	return DiversityLimits{BucketIP: BUCKET_IP_LIMIT,
+		BucketSubnet: BUCKET_SUBNET_LIMIT,
+		TableIP:      TABLE_IP_LIMIT,
+		TableSubnet:  TABLE_SUBNET_LIMIT}
+}
+
+// applies to contacts added from now on
+func (k *Kademlia) SetDiversityLimits(limits DiversityLimits) {
+	k.diversityMutex.Lock()
+	k.diversity = limits
+	k.diversityMutex.Unlock()
+}
+
+// the IPs and subnets con is counted under, every one it can be dialed on:
+// its Host, its other addresses and its relay's, as a host could advertise
+// any Host while others reach it on the rest. Loopback and unspecified
+// addresses aren't counted
+func diversityKeys(con Contact) (ips []string, subnets []string) {
+	hosts := []net.IP{con.Host}
+	for _, addr := range con.Addrs {
+		if ip, _, err := ParseHostPort(addr); err == nil {
+			hosts = append(hosts, ip)
+		}
+	}
+	if con.Relay != "" {
+		if ip, _, err := ParseHostPort(con.Relay); err == nil {
+			hosts = append(hosts, ip)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if host == nil || host.IsLoopback() || host.IsUnspecified() {
+			continue
+		}
+		ip, subnet := subnetOf(host)
+		if seen[ip] == false {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+		if seen[subnet] == false {
+			seen[subnet] = true
+			subnets = append(subnets, subnet)
+		}
+	}
+	return ips, subnets
+}
+
+// ip as a string and its /24, or /64 for IPv6
+func subnetOf(ip net.IP) (string, string) {
+	mask := net.CIDRMask(64, 128)
+	if v4 := ip.To4(); v4 != nil {
+		mask = net.CIDRMask(24, 32)
+	}
+	network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return ip.String(), network.String()
+}
+
+func sameKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// count con into bucket unless that would break a limit, old is the element
+// con replaces if any. Assumes bucket is locked
+func (k *Kademlia) admitContact(bucket *list.List, con Contact, old *list.Element) bool {
+	ips, subnets := diversityKeys(con)
+	// a contact replacing old doesn't count against itself
+	oldIPs, oldSubnets := make(map[string]bool), make(map[string]bool)
+	if old != nil {
+		ipList, subnetList := diversityKeys(old.Value.(Contact))
+		if sameKeys(ips, ipList) && sameKeys(subnets, subnetList) {
+			return true
+		}
+		for _, ip := range ipList {
+			oldIPs[ip] = true
+		}
+		for _, subnet := range subnetList {
+			oldSubnets[subnet] = true
+		}
+	}
+	bucketIPs, bucketSubnets := make(map[string]int), make(map[string]int)
+	for el := bucket.Front(); el != nil; el = el.Next() {
+		if el == old {
+			continue
+		}
+		elIPs, elSubnets := diversityKeys(el.Value.(Contact))
+		for _, ip := range elIPs {
+			bucketIPs[ip] += 1
+		}
+		for _, subnet := range elSubnets {
+			bucketSubnets[subnet] += 1
+		}
+	}
+
+	k.diversityMutex.Lock()
+	defer k.diversityMutex.Unlock()
+	limits := k.diversity
+	for _, ip := range ips {
+		table := k.tableIPs[ip]
+		if oldIPs[ip] {
+			table -= 1
+		}
+		if (limits.BucketIP > 0 && bucketIPs[ip] >= limits.BucketIP) ||
+			(limits.TableIP > 0 && table >= limits.TableIP) {
+			return false
+		}
+	}
+	for _, subnet := range subnets {
+		table := k.tableSubnets[subnet]
+		if oldSubnets[subnet] {
+			table -= 1
+		}
+		if (limits.BucketSubnet > 0 && bucketSubnets[subnet] >= limits.BucketSubnet) ||
+			(limits.TableSubnet > 0 && table >= limits.TableSubnet) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		k.tableIPs[ip] += 1
+	}
+	for _, subnet := range subnets {
+		k.tableSubnets[subnet] += 1
+	}
+	if old != nil {
+		k.forgetContact(old.Value.(Contact))
+	}
+	return true
+}
+
+// stop counting con, which left the table. Assumes diversityMutex is held
+func (k *Kademlia) forgetContact(con Contact) {
+	ips, subnets := diversityKeys(con)
+	for _, ip := range ips {
+		if k.tableIPs[ip] -= 1; k.tableIPs[ip] <= 0 {
+			delete(k.tableIPs, ip)
+		}
+	}
+	for _, subnet := range subnets {
+		if k.tableSubnets[subnet] -= 1; k.tableSubnets[subnet] <= 0 {
+			delete(k.tableSubnets, subnet)
+		}
+	}
+}
+
+// remove el from bucket, which must be locked
+func (k *Kademlia) removeContact(bucket *list.List, el *list.Element) {
+	k.diversityMutex.Lock()
+	k.forgetContact(el.Value.(Contact))
+	k.diversityMutex.Unlock()
+	bucket.Remove(el)
+}
@@ -0,0 +1,394 @@
+package kademlia
+
+// Reed-Solomon erasure coding of large DFS blocks. A block is split into
+// ERASURE_DATA_SHARDS data shards plus ERASURE_PARITY_SHARDS parity shards,
+// any ERASURE_DATA_SHARDS of them are enough to rebuild it. Each shard is
+// stored on DFS_SHARD_REPLICAS nodes under a key derived from the block key,
+// which holds a small FileContent listing the shard hashes instead of the
+// content. A repair job regenerates shards that went missing.
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const ERASURE_DATA_SHARDS = 6
+const ERASURE_PARITY_SHARDS = 4
+
+// blocks larger than this many bytes are erasure coded
+const DFS_ERASURE_THRESHOLD = 16 * 1024
+
+// how many nodes hold each shard
+const DFS_SHARD_REPLICAS = 1
+
+// how long to wait between shard repair runs, in seconds
+const DFS_REPAIR_SECONDS = 15 * 60
+
+// a shard of an erasure coded block, Block is the key of the block it
+// belongs to so the garbage collector can tell whether it's still used
+type BlockShard struct {
+	Block   ID
+	Index   int
+	Content []byte
+}
+
+// arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	res := newGFMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// Gauss-Jordan elimination on a square matrix
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for r := 0; r < n; r++ {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("Matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(factor, work[c][i])
+			}
+		}
+	}
+	inv := newGFMatrix(n, n)
+	for r := 0; r < n; r++ {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+// systematic encoding matrix, the top rows are the identity so data shards
+// are stored as they are. Any dataShards rows of it are invertible
+func encodingMatrix(dataShards, totalShards int) gfMatrix {
+	vander := newGFMatrix(totalShards, dataShards)
+	for r := 0; r < totalShards; r++ {
+		for c := 0; c < dataShards; c++ {
+			vander[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, _ := vander[:dataShards].invert()
+	return vander.mul(top)
+}
+
+// split data into dataShards equally sized shards, padding the last one, and
+// append parityShards parity shards
+func erasureSplit(data []byte, dataShards, parityShards int) [][]byte {
+	size := (len(data) + dataShards - 1) / dataShards
+	if size == 0 {
+		size = 1
+	}
+	padded := make([]byte, size*dataShards)
+	copy(padded, data)
+	shards := make([][]byte, dataShards+parityShards)
+	for i := 0; i < dataShards; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	matrix := encodingMatrix(dataShards, dataShards+parityShards)
+	for i := dataShards; i < len(shards); i++ {
+		shards[i] = encodeShard(matrix[i], shards[:dataShards], size)
+	}
+	return shards
+}
+
+func encodeShard(row []byte, inputs [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for j, input := range inputs {
+		if row[j] == 0 {
+			continue
+		}
+		for b := 0; b < size; b++ {
+			out[b] ^= gfMul(row[j], input[b])
+		}
+	}
+	return out
+}
+
+// fill in the missing, nil, shards from any dataShards present ones
+func erasureReconstruct(shards [][]byte, dataShards, parityShards int) error {
+	present := make([]int, 0, dataShards)
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < dataShards {
+			present = append(present, i)
+			size = len(shard)
+		}
+	}
+	if len(present) < dataShards {
+		return errors.New("Not enough shards to reconstruct block")
+	}
+
+	matrix := encodingMatrix(dataShards, dataShards+parityShards)
+	sub := newGFMatrix(dataShards, dataShards)
+	inputs := make([][]byte, dataShards)
+	for i, index := range present {
+		copy(sub[i], matrix[index])
+		inputs[i] = shards[index]
+		if len(inputs[i]) != size {
+			return errors.New("Shards differ in size")
+		}
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < dataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = encodeShard(decode[i], inputs, size)
+		}
+	}
+	for i := dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = encodeShard(matrix[i], shards[:dataShards], size)
+		}
+	}
+	return nil
+}
+
+func erasureJoin(shards [][]byte, dataShards int, size int) []byte {
+	data := make([]byte, 0, size)
+	for i := 0; i < dataShards && len(data) < size; i++ {
+		data = append(data, shards[i]...)
+	}
+	return data[:size]
+}
+
+func shardKey(block ID, index int) ID {
+	b := make([]byte, IDBytes+8)
+	copy(b, block[:])
+	binary.BigEndian.PutUint64(b[IDBytes:], uint64(index))
+	return FromBytes(b)
+}
+
+// store value on the replicas closest nodes to key
+func (k *Kademlia) storeOnClosest(req StoreRequest, replicas int) error {
+	k.signStore(&req)
+	fnReq := FindNodeRequest{Sender: req.Sender, MsgID: NewRandomID(), NodeID: CopyID(req.Key)}
+	fnRes := new(FindNodeResult)
+	k.IterFindNode(fnReq, fnRes)
+	stored := 0
+	var err error
+	for _, node := range fnRes.Nodes {
+		res := new(StoreResult)
+		k.makeStoreRequest(node, req, res)
+		if res.Err != nil {
+			err = res.Err
+			continue
+		}
+		if stored += 1; stored == replicas {
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("Could not find a node to store on")
+	}
+	return err
+}
+
+// erasure code data and store the shards, then store the manifest under the
+// key the whole block would have had
+func (k *Kademlia) storeErasureBlock(sender Contact, msgID ID, data []byte) (ID, error) {
+	value, err := encodeDFS(FileContent{Content: data})
+	if err != nil {
+		return ID{}, err
+	}
+	blockKey := FromBytes(value)
+
+	shards := erasureSplit(data, ERASURE_DATA_SHARDS, ERASURE_PARITY_SHARDS)
+	manifest := FileContent{Shards: make([]ID, len(shards)), DataShards: ERASURE_DATA_SHARDS, Size: len(data)}
+	for i, shard := range shards {
+		manifest.Shards[i] = FromBytes(shard)
+		if err = k.storeShard(sender, msgID, blockKey, i, shard); err != nil {
+			return ID{}, err
+		}
+	}
+
+	if value, err = encodeDFS(manifest); err != nil {
+		return ID{}, err
+	}
+	storeReq := StoreRequest{Sender: sender, MsgID: CopyID(msgID), Key: blockKey, Value: value}
+	storeRes := new(StoreResult)
+	k.IterStore(storeReq, storeRes)
+	return blockKey, storeRes.Err
+}
+
+func (k *Kademlia) storeShard(sender Contact, msgID ID, blockKey ID, index int, shard []byte) error {
+	value, err := encodeDFS(BlockShard{Block: blockKey, Index: index, Content: shard})
+	if err != nil {
+		return err
+	}
+	storeReq := StoreRequest{Sender: sender, MsgID: CopyID(msgID), Key: shardKey(blockKey, index), Value: value}
+	return k.storeOnClosest(storeReq, DFS_SHARD_REPLICAS)
+}
+
+// fetch all shards of a block in parallel, missing or corrupt shards are nil
+func (k *Kademlia) findShards(sender Contact, msgID ID, blockKey ID, manifest FileContent) [][]byte {
+	type foundShard struct {
+		index int
+		data  []byte
+	}
+	found := make(chan foundShard, len(manifest.Shards))
+	for i := range manifest.Shards {
+		go func(i int) {
+			shard := new(BlockShard)
+			err := k.findLocalContent(shardKey(blockKey, i), shard)
+			if err != nil {
+				err = k.findContent(sender, msgID, shardKey(blockKey, i), shard)
+			}
+			if err != nil || FromBytes(shard.Content).Equals(manifest.Shards[i]) == false {
+				found <- foundShard{index: i}
+				return
+			}
+			found <- foundShard{index: i, data: shard.Content}
+		}(i)
+	}
+	shards := make([][]byte, len(manifest.Shards))
+	for range manifest.Shards {
+		s := <-found
+		shards[s.index] = s.data
+	}
+	return shards
+}
+
+func (k *Kademlia) readErasureBlock(sender Contact, msgID ID, blockKey ID, manifest FileContent) ([]byte, error) {
+	shards := k.findShards(sender, msgID, blockKey, manifest)
+	parity := len(shards) - manifest.DataShards
+	if err := erasureReconstruct(shards, manifest.DataShards, parity); err != nil {
+		return nil, err
+	}
+	return erasureJoin(shards, manifest.DataShards, manifest.Size), nil
+}
+
+// start the shard repair job, me is used as the sender of its requests
+func (k *Kademlia) StartErasureRepair(me Contact) {
+	go k.repairShards(me)
+}
+
+// every node holding a copy of a manifest checks its shards and stores any
+// that are lost again. Holders sleep a random extra time so they rarely
+// repair the same block at once, repeated stores are harmless though
+func (k *Kademlia) repairShards(me Contact) {
+	dur := time.Duration(DFS_REPAIR_SECONDS) * time.Second
+	for {
+		time.Sleep(dur + time.Duration(rand.Int63n(int64(dur))))
+		k.repairStoredBlocks(me)
+	}
+}
+
+// check the shards of every manifest we hold, returning how many shards were
+// stored again
+func (k *Kademlia) repairStoredBlocks(me Contact) int {
+	manifests := make(map[ID]FileContent)
+	k.storedDataMutex.Lock()
+	for key, val := range k.StoredData {
+		block := new(FileContent)
+		if isDFSValue(val.Data) && decodeDFS(val.Data, block) == nil && len(block.Shards) > 0 {
+			manifests[key] = *block
+		}
+	}
+	k.storedDataMutex.Unlock()
+
+	repaired := 0
+	for blockKey, manifest := range manifests {
+		msgID := NewRandomID()
+		shards := k.findShards(me, msgID, blockKey, manifest)
+		missing := make([]int, 0)
+		for i, shard := range shards {
+			if shard == nil {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		parity := len(shards) - manifest.DataShards
+		if erasureReconstruct(shards, manifest.DataShards, parity) != nil {
+			// lost for good
+			continue
+		}
+		for _, i := range missing {
+			if k.storeShard(me, msgID, blockKey, i, shards[i]) == nil {
+				repaired += 1
+			}
+		}
+	}
+	return repaired
+}
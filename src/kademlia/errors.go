@@ -0,0 +1,115 @@
+package kademlia
+
+// Errors sent between nodes. The Err field of an RPC result only ever holds a
+// *RemoteError when it crosses the wire, gob can't encode other error types.
+// A RemoteError carries a code for the sentinel error it stands for, so
+// errors.Is(res.Err, ErrNotFound) works the same on both ends.
+
+import (
+	"encoding/gob"
+	"errors"
+	"net/rpc"
+)
+
+type ErrorCode int
+
+const (
+	ERR_UNKNOWN ErrorCode = iota + 1
+	ERR_NOT_FOUND
+	ERR_QUOTA_EXCEEDED
+	ERR_BAD_MSG_ID
+	ERR_TIMEOUT
+	ERR_VALUE_TOO_LARGE
+	ERR_SENDER_LIMIT
+	ERR_PERMISSION
+	ERR_VERSION_MISMATCH
+	ERR_CHUNK_CHECKSUM
+	ERR_VALUE_CHECKSUM
+	ERR_DELETED
+	ERR_NOT_RELAYED
+	ERR_SENDER_MISMATCH
+	ERR_RATE_LIMITED
+	ERR_BANNED
+	ERR_TOO_MANY_UPLOADS
+)
+
+var ErrNotFound = errors.New("Couldn't find value with the given key")
+var ErrBadMsgID = errors.New("Invalid message id returned")
+var ErrTimeout = errors.New("Request timed out")
+
+// the sentinel errors each code stands for
+var codeErrors = map[ErrorCode]error{
+	ERR_NOT_FOUND:        ErrNotFound,
+	ERR_QUOTA_EXCEEDED:   ErrQuotaExceeded,
+	ERR_BAD_MSG_ID:       ErrBadMsgID,
+	ERR_TIMEOUT:          ErrTimeout,
+	ERR_VALUE_TOO_LARGE:  ErrValueTooLarge,
+	ERR_SENDER_LIMIT:     ErrSenderLimit,
+	ERR_PERMISSION:       ErrPermission,
+	ERR_VERSION_MISMATCH: ErrVersionMismatch,
+	ERR_CHUNK_CHECKSUM:   ErrChunkChecksum,
+	ERR_VALUE_CHECKSUM:   ErrValueChecksum,
+	ERR_DELETED:          ErrDeleted,
+	ERR_NOT_RELAYED:      ErrNotRelayed,
+	ERR_SENDER_MISMATCH:  ErrSenderMismatch,
+	ERR_RATE_LIMITED:     ErrRateLimited,
+	ERR_BANNED:           ErrBanned,
+	ERR_TOO_MANY_UPLOADS: ErrTooManyUploads,
+}
+
+func init() {
+	gob.Register(&RemoteError{})
+}
+
+type RemoteError struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Msg
+}
+
+func (e *RemoteError) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// the code of err, ERR_UNKNOWN for errors without a sentinel
+func CodeOf(err error) ErrorCode {
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return remote.Code
+	}
+	for code, sentinel := range codeErrors {
+		if errors.Is(err, sentinel) {
+			return code
+		}
+	}
+	return ERR_UNKNOWN
+}
+
+// err in the form an RPC handler puts in its result
+func wireError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return remote
+	}
+	return &RemoteError{Code: CodeOf(err), Msg: err.Error()}
+}
+
+// the error of a failed RPC call, errors a handler returned instead of
+// putting in its result arrive as bare strings and are matched up again
+func callError(err error) error {
+	if _, ok := err.(rpc.ServerError); ok == false {
+		return err
+	}
+	for code, sentinel := range codeErrors {
+		if err.Error() == sentinel.Error() {
+			return &RemoteError{Code: code, Msg: err.Error()}
+		}
+	}
+	return &RemoteError{Code: ERR_UNKNOWN, Msg: err.Error()}
+}
@@ -2,6 +2,7 @@ package kademlia
 // Contains definitions for the 160-bit identifiers used throughout kademlia.
 
 import (
+    "crypto/sha1"
     "encoding/hex"
     "math/rand"
 )
@@ -90,10 +91,10 @@ func FromString(idstr string) (ret ID, err error) {
     return
 }
 
-// Generate a ID matching a given []byte.
-func FromBytes(idbytes []byte) (ret ID, err error) {
-    n, err := hex.Decode(ret, idbytes)
-    if err != nil {
-        return
-    }
+// Generate a ID from the SHA-1 hash of a given []byte, used as the key of
+// content-addressed values.
+func FromBytes(data []byte) (ret ID) {
+    sum := sha1.Sum(data)
+    copy(ret[:], sum[:])
+    return
 }
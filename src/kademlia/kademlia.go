@@ -7,10 +7,12 @@ package kademlia
 
 import (
 	"container/list"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"net"
-	"net/rpc"
 	"sync"
 	"time"
 )
@@ -26,12 +28,18 @@ const ALPHA = 3
 // how long to wait between checks for stale data, in seconds
 const CLEANUP_SECONDS = 10
 
-// how old data must be to be cleaned up, in minutes
+// how old data must be to be cleaned up, in minutes. DFS values aren't, the
+// DFS collector keeps them for DFS_RETENTION_HOURS after their last use
 const DATA_STALENESS_MIN = 1
 
+// Version counts the conditional stores applied to the value, see
+// CompareAndStore. Publisher is the key that signed the store, if any, see
+// tombstone.go
 type TimeValue struct {
-	time time.Time
-	Data []byte
+	time      time.Time
+	Data      []byte
+	Version   uint64
+	Publisher []byte
 }
 
 type Kademlia struct {
@@ -40,6 +48,41 @@ type Kademlia struct {
 	StoredData      map[ID]TimeValue
 	Contacts        BucketList
 	contactsMutex   [BucketCount]sync.Mutex
+	dfsKey          *ecdh.PrivateKey
+	signKey         ed25519.PrivateKey
+	uploadsMutex    sync.Mutex
+	uploads         map[ID]*upload
+	uploadBytes     int
+	limits          StorageLimits
+	storedBytes     int
+	sendersMutex    sync.Mutex
+	senders         map[string]*senderUsage
+	tombstones      map[ID]tombstone
+	unreferenced    map[ID]time.Time
+	gcRetention     time.Duration
+	observedMutex   sync.Mutex
+	observed        map[string]observation
+	relayMutex      sync.Mutex
+	relayed         map[ID]*relayedNode
+	relayIdentity   ed25519.PrivateKey
+	tlsCert         *tls.Certificate
+	tlsCAs          *x509.CertPool
+	puzzle          Puzzle
+	puzzleKey       []byte
+	puzzleNonce     ID
+	puzzlePrivate   ed25519.PrivateKey
+	diversityMutex  sync.Mutex
+	diversity       DiversityLimits
+	tableIPs        map[string]int
+	tableSubnets    map[string]int
+	abuseMutex      sync.Mutex
+	abuseLimits     AbuseLimits
+	abuseStats      AbuseStats
+	rateBuckets     map[string]*tokenBucket
+	bans            map[string]time.Time
+	strikes         map[string]int
+	strikesReset    time.Time
+	contactQueue    chan Contact
 }
 
 func CreateBucketList() (blist BucketList) {
@@ -66,13 +109,11 @@ func (k *Kademlia) ContactFromID(id ID) (c Contact, e error) {
 func (k *Kademlia) removeOldContacts(bucketNum int) (removed int) {
 	removed = 0
 	curBucket := k.Contacts[bucketNum]
-	var addr string
 	for el := curBucket.Front(); el != nil; {
-		addr = fmt.Sprintf("%s:%d", el.Value.(Contact).Host.String(), el.Value.(Contact).Port)
-		client, err := rpc.DialHTTP("tcp", addr)
+		client, err := k.DialContact(el.Value.(Contact))
 		if err != nil {
 			nextEl := el.Next()
-			_ = curBucket.Remove(el)
+			k.removeContact(curBucket, el)
 			el, removed = nextEl, removed+1
 			continue
 		}
@@ -82,7 +123,7 @@ func (k *Kademlia) removeOldContacts(bucketNum int) (removed int) {
 		err = client.Call("Kademlia.Ping", ping, &pong)
 		if err != nil {
 			nextEl := el.Next()
-			_ = curBucket.Remove(el)
+			k.removeContact(curBucket, el)
 			el, removed = nextEl, removed+1
 			client.Close()
 			continue
@@ -94,6 +135,21 @@ func (k *Kademlia) removeOldContacts(bucketNum int) (removed int) {
 }
 
 func (k *Kademlia) UpdateContacts(con Contact) {
+	// anonymous requests have no contact to add
+	if con.NodeID.Equals(ID{}) || (con.Unreachable && con.Relay == "") {
+		return
+	}
+	if k.puzzle.enabled() && VerifyPuzzle(con, k.puzzle) != nil {
+		return
+	}
+	if k.isBanned(con.NodeID.AsString()) {
+		return
+	}
+	// anyone can claim a node ID, so a known contact only moves to addresses
+	// where its node answers
+	if old, err := k.ContactFromID(con.NodeID); err == nil && sameAddress(old, con) == false && k.provenAddress(con) == false {
+		con = old
+	}
 	pre := k.NodeID.Xor(con.NodeID).PrefixLen()
 	k.contactsMutex[pre].Lock()
 	defer k.contactsMutex[pre].Unlock()
@@ -107,25 +163,88 @@ func (k *Kademlia) UpdateContacts(con Contact) {
 	}
 
 	if oldCon != nil {
+		// the contact may come with proven new addresses or a relay, unless
+		// its new address is one too many of its kind
+		if k.admitContact(curBucket, con, oldCon) {
+			oldCon.Value = con
+		}
 		curBucket.MoveToFront(oldCon)
-	} else {
+	} else if k.admitContact(curBucket, con, nil) {
 		if curBucket.Len() <= MaxBucketSize {
 			curBucket.PushFront(con)
 		} else {
 			rem := k.removeOldContacts(pre)
 			if rem > 0 {
 				curBucket.PushFront(con)
+			} else {
+				k.diversityMutex.Lock()
+				k.forgetContact(con)
+				k.diversityMutex.Unlock()
+			}
+		}
+	}
+}
+
+// whether a and b are reached the same way
+func sameAddress(a Contact, b Contact) bool {
+	if a.Host.Equal(b.Host) == false || a.Port != b.Port || a.Relay != b.Relay ||
+		a.Unreachable != b.Unreachable || len(a.Addrs) != len(b.Addrs) {
+		return false
+	}
+	for i := range a.Addrs {
+		if a.Addrs[i] != b.Addrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// whether con's node answers a ping on each of its addresses, or through its
+// relay if it has one. Over TLS the answer is also proven to come from it
+func (k *Kademlia) provenAddress(con Contact) bool {
+	node := ContactToFoundNode(con)
+	targets := []FoundNode{node}
+	if node.Relay == "" {
+		targets = targets[:0]
+		for _, addr := range nodeAddrs(node) {
+			ip, port, err := ParseHostPort(addr)
+			if err != nil {
+				return false
 			}
+			targets = append(targets, FoundNode{IPAddr: ip.String(), Port: port, NodeID: node.NodeID})
+		}
+	}
+	for _, target := range targets {
+		if k.pingNode(target) == false {
+			return false
 		}
 	}
+	return true
+}
+
+// whether node answers a ping as itself
+func (k *Kademlia) pingNode(node FoundNode) bool {
+	client, err := k.dialNode(node)
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+	ping := Ping{MsgID: NewRandomID()}
+	var pong Pong
+	if err = client.Call("Kademlia.Ping", ping, &pong); err != nil {
+		return false
+	}
+	return ping.MsgID.Equals(pong.MsgID) && node.NodeID.Equals(pong.Sender.NodeID)
 }
 
 func ContactToFoundNode(con Contact) FoundNode {
-	return FoundNode{IPAddr: con.Host.String(), Port: con.Port, NodeID: CopyID(con.NodeID)}
+	return FoundNode{IPAddr: con.Host.String(), Port: con.Port, NodeID: CopyID(con.NodeID), Addrs: con.Addrs, Relay: con.Relay,
+		PublicKey: con.PublicKey, Nonce: con.Nonce}
 }
 
 func FoundNodeToContact(node FoundNode) Contact {
-	return Contact{NodeID: CopyID(node.NodeID), Port: node.Port, Host: net.ParseIP(node.IPAddr)}
+	return Contact{NodeID: CopyID(node.NodeID), Port: node.Port, Host: net.ParseIP(node.IPAddr), Addrs: node.Addrs, Relay: node.Relay,
+		PublicKey: node.PublicKey, Nonce: node.Nonce}
 }
 
 // assumes bucket is already locked, slice has proper capacity
@@ -183,41 +302,38 @@ func (k *Kademlia) FindCloseContacts(key ID, requester ID, totalNum int) []Conta
 
 func (k *Kademlia) cleanup() {
 	dur := time.Duration(CLEANUP_SECONDS) * time.Second
-	time_diff := time.Duration(DATA_STALENESS_MIN) * time.Minute
-	var now time.Time
 	for {
 		time.Sleep(dur)
-		k.storedDataMutex.Lock()
-		now = time.Now()
-
-		for key, v := range k.StoredData {
-			if now.After(v.time.Add(time_diff)) {
-				delete(k.StoredData, key)
-			}
-		}
-		k.storedDataMutex.Unlock()
+		k.cleanupStale()
 	}
 }
 
-func (k *Kademlia) Join(me Contact, ip string, port string) error {
-	// do an rpc call of findnode
-	req := FindNodeRequest{Sender: me, MsgID: NewRandomID(), NodeID: k.NodeID}
-	res := new(FindNodeResult)
-
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%s", ip, port))
+// drop data untouched for DATA_STALENESS_MIN. DFS values are kept for as long
+// as the DFS references them, revisions, trash and snapshots included, and
+// are left to the collector, see trash.go
+func (k *Kademlia) cleanupStale() {
+	time_diff := time.Duration(DATA_STALENESS_MIN) * time.Minute
+	k.storedDataMutex.Lock()
+	now := time.Now()
 
-	if err != nil {
-		return err
-	}
-	defer client.Close()
-	err = client.Call("Kademlia.FindNode", req, res)
-	if err != nil {
-		return err
+	for key, v := range k.StoredData {
+		if now.After(v.time.Add(time_diff)) && isDFSValue(v.Data) == false {
+			k.dropValue(key)
+		}
 	}
-	for _, node := range res.Nodes {
-		go k.UpdateContacts(FoundNodeToContact(node))
+	k.expireTombstones()
+	k.storedDataMutex.Unlock()
+
+	// drop streamed uploads the sender gave up on
+	k.uploadsMutex.Lock()
+	for id, up := range k.uploads {
+		if now.After(up.touched.Add(time_diff)) {
+			k.dropUpload(id)
+		}
 	}
-	return nil
+	k.uploadsMutex.Unlock()
+	k.expireSenders()
+	k.expireAbuse()
 }
 
 func NewKademlia() *Kademlia {
@@ -225,6 +341,25 @@ func NewKademlia() *Kademlia {
 	var inst *Kademlia = new(Kademlia)
 	inst.NodeID = NewRandomID()
 	inst.StoredData = make(map[ID]TimeValue)
+	inst.uploads = make(map[ID]*upload)
+	inst.limits = DefaultStorageLimits()
+	inst.senders = make(map[string]*senderUsage)
+	inst.tombstones = make(map[ID]tombstone)
+	inst.unreferenced = make(map[ID]time.Time)
+	inst.observed = make(map[string]observation)
+	inst.relayed = make(map[ID]*relayedNode)
+	inst.diversity = DefaultDiversityLimits()
+	inst.tableIPs = make(map[string]int)
+	inst.tableSubnets = make(map[string]int)
+	inst.abuseLimits = DefaultAbuseLimits()
+	inst.rateBuckets = make(map[string]*tokenBucket)
+	inst.bans = make(map[string]time.Time)
+	inst.strikes = make(map[string]int)
+	inst.strikesReset = time.Now()
+	inst.contactQueue = make(chan Contact, CONTACT_QUEUE)
+	for i := 0; i < CONTACT_WORKERS; i++ {
+		go inst.contactWorker()
+	}
 	inst.Contacts = CreateBucketList()
 	go inst.cleanup()
 	return inst
@@ -2,14 +2,27 @@ package kademlia
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	crand "crypto/rand"
 	"fmt"
+	"hash/crc32"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func checkMessageId(t *testing.T, expected ID, actual ID) {
@@ -95,6 +108,22 @@ func startRpcClosure() func(Contact) error {
 
 var startRpcServer = startRpcClosure()
 
+// serve a new node on a loopback port, stopped when the test ends
+func startTestNode(t *testing.T) (*Kademlia, Contact) {
+	k := NewKademlia()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go k.Serve(l)
+	con, err := NewContact(k.NodeID, []string{l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, con
+}
+
 func TestPingWorks(t *testing.T) {
 	k := NewKademlia()
 	sender, msgId := makeRandomContact(), NewRandomID()
@@ -358,3 +387,2149 @@ func TestFindKeyWithoutNodeHavingKey(t *testing.T) {
 		}
 	}
 }
+
+func TestCompareAndStoreVersions(t *testing.T) {
+	k := NewKademlia()
+	con, key := makeRandomContact(), NewRandomID()
+
+	req := CompareAndStoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("first"), Version: 0}
+	res := new(CompareAndStoreResult)
+	k.CompareAndStore(req, res)
+	checkMessageId(t, req.MsgID, res.MsgID)
+	if res.Swapped == false || res.Version != 1 {
+		t.Errorf("Initial store not applied, swapped %v version %d", res.Swapped, res.Version)
+	}
+
+	// a stale writer still expecting version 0 must be refused
+	req = CompareAndStoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("stale"), Version: 0}
+	res = new(CompareAndStoreResult)
+	k.CompareAndStore(req, res)
+	if res.Swapped || res.Version != 1 {
+		t.Errorf("Stale store applied, swapped %v version %d", res.Swapped, res.Version)
+	}
+	if false == bytes.Equal(k.StoredData[key].Data, []byte("first")) {
+		t.Error("Value was overwritten by stale store")
+	}
+
+	req = CompareAndStoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("second"), Version: 1}
+	res = new(CompareAndStoreResult)
+	k.CompareAndStore(req, res)
+	if res.Swapped == false || res.Version != 2 {
+		t.Errorf("Second store not applied, swapped %v version %d", res.Swapped, res.Version)
+	}
+	if false == bytes.Equal(k.StoredData[key].Data, []byte("second")) {
+		t.Error("Value stored is incorrect")
+	}
+}
+
+func TestDFSRoundTrip(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 4)
+
+	// every node adds a file to the root at once, each directory update is a
+	// compare and store on all nodes that only one of the racers wins
+	var wg sync.WaitGroup
+	errs := make([]error, len(nodes))
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := WriteFileRequest{Sender: cons[i], MsgID: NewRandomID(), Path: fmt.Sprintf("/f%d", i),
+				Content: []byte(fmt.Sprintf("from %d", i))}
+			res := new(WriteFileResult)
+			nodes[i].WriteFile(req, res)
+			errs[i] = res.Err
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Write of node %d failed: %v", i, err)
+		}
+	}
+
+	// any node sees every write
+	last := len(nodes) - 1
+	dirRes := new(FindDirResult)
+	nodes[last].FindDir(FindDirRequest{Sender: cons[last], MsgID: NewRandomID(), Path: "/"}, dirRes)
+	if dirRes.Err != nil {
+		t.Fatal(dirRes.Err)
+	}
+	// racers that lost may have moved some replicas on before retrying
+	if version := dirRes.Inode.Meta.Version; version < uint64(len(nodes)+1) {
+		t.Errorf("Root at version %d after %d updates", version, len(nodes))
+	}
+	for i := range nodes {
+		readRes := new(ReadFileResult)
+		nodes[last].ReadFile(ReadFileRequest{Sender: cons[last], MsgID: NewRandomID(), Path: fmt.Sprintf("/f%d", i)}, readRes)
+		if readRes.Err != nil || string(readRes.Content) != fmt.Sprintf("from %d", i) {
+			t.Errorf("Read /f%d as %q: %v", i, readRes.Content, readRes.Err)
+		}
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	cases := [][3]string{
+		{"/1/2/3", "/1/2", "3"},
+		{"/3", "/", "3"},
+		{"3", "", "3"},
+		{"1/2/", "1", "2"},
+	}
+	for _, c := range cases {
+		dir, name := splitPath(c[0])
+		if dir != c[1] || name != c[2] {
+			t.Errorf("splitPath(%q) = %q, %q, expected %q, %q", c[0], dir, name, c[1], c[2])
+		}
+	}
+}
+
+func TestTrashDirPath(t *testing.T) {
+	cases := [][2]string{
+		{"/proj/a/b", "/proj/.trash"},
+		{"/proj/a", "/proj/.trash"},
+		{"/proj", "/.trash"},
+		{"/a.txt", "/.trash"},
+	}
+	for _, c := range cases {
+		if trash := trashDirPath(c[0]); trash != c[1] {
+			t.Errorf("trashDirPath(%q) = %q, expected %q", c[0], trash, c[1])
+		}
+	}
+}
+
+func TestSoftDeleteRestore(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[0], cons[0]
+	testMkdir(t, k, me, "/proj")
+	testMkdir(t, k, me, "/proj/dir")
+	testWrite(t, k, me, "/proj/dir/f", "kept")
+	testWrite(t, k, me, "/proj/g", "gone")
+
+	trash := func(p string) string {
+		res := new(SoftDeleteResult)
+		k.SoftDelete(SoftDeleteRequest{Sender: me, MsgID: NewRandomID(), Path: p}, res)
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if strings.HasPrefix(res.TrashPath, "/proj/.trash/") == false {
+			t.Errorf("%s trashed to %s", p, res.TrashPath)
+		}
+		return res.TrashPath
+	}
+	dirTrash, fileTrash := trash("/proj/dir"), trash("/proj/g")
+	if _, err := testRead(k, me, "/proj/dir/f"); err == nil {
+		t.Error("Trashed directory still reachable")
+	}
+	if content, err := testRead(nodes[1], cons[1], dirTrash+"/f"); err != nil || content != "kept" {
+		t.Errorf("Read %q from the trash: %v", content, err)
+	}
+
+	// the file's path is taken meanwhile, the directory comes back whole
+	testWrite(t, k, me, "/proj/g", "new")
+	restore := func(p string) error {
+		res := new(RestoreResult)
+		nodes[2].Restore(RestoreRequest{Sender: cons[2], MsgID: NewRandomID(), TrashPath: p}, res)
+		return res.Err
+	}
+	if err := restore(fileTrash); err == nil {
+		t.Error("Restore replaced a file written since")
+	}
+	if err := restore(dirTrash); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := testRead(k, me, "/proj/dir/f"); err != nil || content != "kept" {
+		t.Errorf("Read %q from the restored directory: %v", content, err)
+	}
+	fdRes := new(FindDirResult)
+	k.FindDir(FindDirRequest{Sender: me, MsgID: NewRandomID(), Path: "/proj/dir"}, fdRes)
+	if fdRes.Err != nil || fdRes.Inode.Meta.TrashedFrom != "" || fdRes.Inode.Meta.DeleteTime.IsZero() == false {
+		t.Errorf("Restored directory still marked deleted: %v", fdRes.Err)
+	}
+}
+
+// give each node a signing key of its own
+func setTestSigningKeys(t *testing.T, nodes ...*Kademlia) {
+	for _, k := range nodes {
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.SetSigningKey(priv)
+	}
+}
+
+// whoever deletes first doesn't own the trash
+func TestSharedTrash(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	setTestSigningKeys(t, nodes[1], nodes[2])
+	for i, name := range []string{"/a", "/b"} {
+		k, me := nodes[i+1], cons[i+1]
+		testWrite(t, k, me, name, "mine")
+		res := new(SoftDeleteResult)
+		k.SoftDelete(SoftDeleteRequest{Sender: me, MsgID: NewRandomID(), Path: name}, res)
+		if res.Err != nil {
+			t.Fatalf("Deleting %s: %v", name, res.Err)
+		}
+	}
+	fdRes := new(FindDirResult)
+	nodes[2].FindDir(FindDirRequest{Sender: cons[2], MsgID: NewRandomID(), Path: "/" + DFS_TRASH_NAME}, fdRes)
+	if fdRes.Err != nil || len(fdRes.Inode.Meta.Owner) > 0 || len(fdRes.Inode.Files) != 3 {
+		t.Errorf("Trash owned by %x holding %v: %v", fdRes.Inode.Meta.Owner, fdRes.Inode.Files, fdRes.Err)
+	}
+}
+
+// entries of directories are protected like those of files
+func TestOwnedDirEntries(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	setTestSigningKeys(t, nodes[1], nodes[2])
+	owner, ownerCon, other, otherCon := nodes[1], cons[1], nodes[2], cons[2]
+	testMkdir(t, owner, ownerCon, "/proj")
+	testMkdir(t, owner, ownerCon, "/empty")
+	testWrite(t, owner, ownerCon, "/proj/f", "mine")
+
+	renRes := new(RenameResult)
+	other.Rename(RenameRequest{Sender: otherCon, MsgID: NewRandomID(), SrcPath: "/proj", DstPath: "/stolen"}, renRes)
+	if errors.Is(renRes.Err, ErrPermission) == false {
+		t.Errorf("Renaming another owner's directory returned %v", renRes.Err)
+	}
+	if _, err := testRead(other, otherCon, "/stolen/f"); err == nil {
+		t.Error("Refused rename left the directory under its new name")
+	}
+	if content, err := testRead(other, otherCon, "/proj/f"); err != nil || content != "mine" {
+		t.Errorf("Read %q after the refused rename: %v", content, err)
+	}
+	sdRes := new(SoftDeleteResult)
+	other.SoftDelete(SoftDeleteRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/proj"}, sdRes)
+	if errors.Is(sdRes.Err, ErrPermission) == false {
+		t.Errorf("Trashing another owner's directory returned %v", sdRes.Err)
+	}
+	rmRes := new(RemoveResult)
+	other.Remove(RemoveRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/empty"}, rmRes)
+	if errors.Is(rmRes.Err, ErrPermission) == false {
+		t.Errorf("Removing another owner's directory returned %v", rmRes.Err)
+	}
+
+	// the entry follows the directory's mode, and the owner may move it
+	chRes := new(ChmodResult)
+	owner.Chmod(ChmodRequest{Sender: ownerCon, MsgID: NewRandomID(), Path: "/empty", Mode: 0757}, chRes)
+	if chRes.Err != nil {
+		t.Fatal(chRes.Err)
+	}
+	fdRes := new(FindDirResult)
+	other.FindDir(FindDirRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/"}, fdRes)
+	if perm := fdRes.Inode.Perms["empty"]; fdRes.Err != nil || perm.Mode != 0757 {
+		t.Errorf("Entry mode %o after chmod: %v", perm.Mode, fdRes.Err)
+	}
+	owner.Rename(RenameRequest{Sender: ownerCon, MsgID: NewRandomID(), SrcPath: "/proj", DstPath: "/moved"}, renRes)
+	if content, err := testRead(other, otherCon, "/moved/f"); renRes.Err != nil || err != nil || content != "mine" {
+		t.Errorf("Read %q after the owner's rename: %v, %v", content, renRes.Err, err)
+	}
+}
+
+func TestFileRevisions(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[1], cons[1]
+	testWrite(t, k, me, "/f", "zero")
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	testWrite(t, k, me, "/f", "one")
+	testWrite(t, k, me, "/f", "two")
+
+	readAt := func(req ReadFileAtRequest) (string, error) {
+		req.Sender, req.MsgID, req.Path = me, NewRandomID(), "/f"
+		res := new(ReadFileResult)
+		k.ReadFileAt(req, res)
+		return string(res.Content), res.Err
+	}
+	for revision, expected := range []string{"zero", "one", "two"} {
+		if content, err := readAt(ReadFileAtRequest{Revision: revision}); err != nil || content != expected {
+			t.Errorf("Revision %d read as %q: %v", revision, content, err)
+		}
+	}
+	if _, err := readAt(ReadFileAtRequest{Revision: 3}); err == nil {
+		t.Error("Read a revision not written yet")
+	}
+	if content, err := readAt(ReadFileAtRequest{At: between}); err != nil || content != "zero" {
+		t.Errorf("File read at a time as %q: %v", content, err)
+	}
+	if _, err := readAt(ReadFileAtRequest{At: between.Add(-time.Hour)}); err == nil {
+		t.Error("Read a file before it was written")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[0], cons[0]
+	testMkdir(t, k, me, "/proj")
+	testMkdir(t, k, me, "/proj/sub")
+	testWrite(t, k, me, "/proj/sub/f", "before")
+
+	snapRes := new(CreateSnapshotResult)
+	k.CreateSnapshot(CreateSnapshotRequest{Sender: me, MsgID: NewRandomID(), Name: "monday"}, snapRes)
+	if snapRes.Err != nil {
+		t.Fatal(snapRes.Err)
+	}
+	k.CreateSnapshot(CreateSnapshotRequest{Sender: me, MsgID: NewRandomID(), Name: "monday"}, snapRes)
+	if snapRes.Err == nil {
+		t.Error("Snapshot name taken twice")
+	}
+	testWrite(t, k, me, "/proj/sub/f", "after")
+
+	// the snapshot keeps the tree as it was, browsed from another node
+	findRes := new(FindSnapshotResult)
+	nodes[2].FindSnapshot(FindSnapshotRequest{Sender: cons[2], MsgID: NewRandomID(), Name: "monday"}, findRes)
+	if findRes.Err != nil {
+		t.Fatal(findRes.Err)
+	}
+	readRes := new(ReadFileResult)
+	nodes[2].ReadFile(ReadFileRequest{Sender: cons[2], MsgID: NewRandomID(), Path: "/proj/sub/f",
+		RootInode: findRes.Inode, RootKey: findRes.Key}, readRes)
+	if readRes.Err != nil || string(readRes.Content) != "before" {
+		t.Errorf("Snapshot file read as %q: %v", readRes.Content, readRes.Err)
+	}
+	nodes[2].FindSnapshot(FindSnapshotRequest{Sender: cons[2], MsgID: NewRandomID(), Name: "tuesday"}, findRes)
+	if findRes.Err == nil {
+		t.Error("Found a snapshot never taken")
+	}
+
+	restore := func(path string) error {
+		res := new(RestoreSnapshotResult)
+		k.RestoreSnapshot(RestoreSnapshotRequest{Sender: me, MsgID: NewRandomID(), Name: "monday",
+			SnapshotPath: "/proj", Path: path}, res)
+		return res.Err
+	}
+	if err := restore("/proj"); err == nil {
+		t.Error("Snapshot restored over an existing directory")
+	}
+	if err := restore("/old"); err != nil {
+		t.Fatal(err)
+	}
+	// the restored copy is live again and independent of the original
+	testWrite(t, k, me, "/old/sub/g", "new")
+	if content, err := testRead(k, me, "/old/sub/f"); err != nil || content != "before" {
+		t.Errorf("Restored file read as %q: %v", content, err)
+	}
+	if content, err := testRead(k, me, "/proj/sub/f"); err != nil || content != "after" {
+		t.Errorf("Original file read as %q: %v", content, err)
+	}
+	if _, err := testRead(k, me, "/proj/sub/g"); err == nil {
+		t.Error("Write to the restored copy showed up in the original")
+	}
+}
+
+// snapshots keep owners and modes, and only their taker may drop them
+func TestSnapshotPerms(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	setTestSigningKeys(t, nodes[1], nodes[2])
+	owner, ownerCon, other, otherCon := nodes[1], cons[1], nodes[2], cons[2]
+	testMkdir(t, owner, ownerCon, "/proj")
+	testWrite(t, owner, ownerCon, "/proj/f", "mine")
+	snapRes := new(CreateSnapshotResult)
+	owner.CreateSnapshot(CreateSnapshotRequest{Sender: ownerCon, MsgID: NewRandomID(), Name: "s"}, snapRes)
+	if snapRes.Err != nil {
+		t.Fatal(snapRes.Err)
+	}
+
+	err := other.updateDirInode(otherCon, NewRandomID(), DFSSnapshotsKey, func(dir *DirInode) error {
+		linkEntry(dir, "s", NewRandomID(), EntryPerm{})
+		return nil
+	})
+	if errors.Is(err, ErrPermission) == false {
+		t.Errorf("Replacing another owner's snapshot returned %v", err)
+	}
+	err = other.updateDirInode(otherCon, NewRandomID(), DFSSnapshotsKey, func(dir *DirInode) error {
+		unlinkEntry(dir, "s")
+		return nil
+	})
+	if errors.Is(err, ErrPermission) == false {
+		t.Errorf("Removing another owner's snapshot returned %v", err)
+	}
+
+	// anybody may restore, the copy belongs to the original owner
+	restoreRes := new(RestoreSnapshotResult)
+	other.RestoreSnapshot(RestoreSnapshotRequest{Sender: otherCon, MsgID: NewRandomID(), Name: "s",
+		SnapshotPath: "/proj", Path: "/copy"}, restoreRes)
+	if restoreRes.Err != nil {
+		t.Fatal(restoreRes.Err)
+	}
+	ownerKey := owner.SigningPublicKey()
+	fdRes := new(FindDirResult)
+	other.FindDir(FindDirRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/copy"}, fdRes)
+	if fdRes.Err != nil || bytes.Equal(fdRes.Inode.Meta.Owner, ownerKey) == false ||
+		bytes.Equal(fdRes.Inode.Perms["f"].Owner, ownerKey) == false {
+		t.Errorf("Restored directory owned by %x, its file's entry by %x: %v",
+			fdRes.Inode.Meta.Owner, fdRes.Inode.Perms["f"].Owner, fdRes.Err)
+	}
+	other.FindDir(FindDirRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/"}, fdRes)
+	if perm := fdRes.Inode.Perms["copy"]; bytes.Equal(perm.Owner, ownerKey) == false || perm.Mode != DFS_DIR_MODE {
+		t.Errorf("Restored directory's entry owned by %x with mode %o", perm.Owner, perm.Mode)
+	}
+	rmRes := new(RemoveResult)
+	other.Remove(RemoveRequest{Sender: otherCon, MsgID: NewRandomID(), Path: "/copy/f"}, rmRes)
+	if errors.Is(rmRes.Err, ErrPermission) == false {
+		t.Errorf("Removing a restored file of another owner returned %v", rmRes.Err)
+	}
+}
+
+// serve n nodes that all know each other and share a DFS root
+func TestRename(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[1], cons[1]
+	testMkdir(t, k, me, "/a")
+	subKey := testMkdir(t, k, me, "/a/b")
+	cKey := testMkdir(t, k, me, "/c")
+	testWrite(t, k, me, "/a/f", "file")
+	testWrite(t, k, me, "/a/b/x", "inside")
+
+	rename := func(src string, dst string) error {
+		res := new(RenameResult)
+		k.Rename(RenameRequest{Sender: me, MsgID: NewRandomID(), SrcPath: src, DstPath: dst}, res)
+		return res.Err
+	}
+	readMoved := func(from string, to string, content string) {
+		if _, err := testRead(nodes[2], cons[2], from); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("%s still readable after the move: %v", from, err)
+		}
+		if read, err := testRead(nodes[2], cons[2], to); err != nil || read != content {
+			t.Errorf("Read %q from %s: %v", read, to, err)
+		}
+	}
+
+	// within a directory, then into another one
+	if err := rename("/a/f", "/a/g"); err != nil {
+		t.Fatal(err)
+	}
+	readMoved("/a/f", "/a/g", "file")
+	if err := rename("/a/g", "/c/h"); err != nil {
+		t.Fatal(err)
+	}
+	readMoved("/a/g", "/c/h", "file")
+	ffRes := new(FindFileResult)
+	k.FindFile(FindFileRequest{Sender: me, MsgID: NewRandomID(), Path: "/c/h"}, ffRes)
+	if ffRes.Err != nil || ffRes.Inode.Meta.Name != "h" {
+		t.Errorf("Moved file is named %q: %v", ffRes.Inode.Meta.Name, ffRes.Err)
+	}
+
+	// a directory keeps its key and contents and points at its new parent
+	if err := rename("/a/b", "/c/d"); err != nil {
+		t.Fatal(err)
+	}
+	readMoved("/a/b/x", "/c/d/x", "inside")
+	fdRes := new(FindDirResult)
+	k.FindDir(FindDirRequest{Sender: me, MsgID: NewRandomID(), Path: "/c/d"}, fdRes)
+	if fdRes.Err != nil || fdRes.Key.Equals(subKey) == false || fdRes.Inode.Files[".."].Equals(cKey) == false ||
+		fdRes.Inode.Meta.Name != "d" {
+		t.Errorf("Moved directory has key %v, parent %v and name %q: %v",
+			fdRes.Key.AsString(), fdRes.Inode.Files[".."].AsString(), fdRes.Inode.Meta.Name, fdRes.Err)
+	}
+
+	if err := rename("/c", "/c/d/e"); errors.Is(err, ErrInvalidPath) == false {
+		t.Errorf("Moved a directory below itself: %v", err)
+	}
+	if err := rename("/c", "/c/e"); errors.Is(err, ErrInvalidPath) == false {
+		t.Errorf("Moved a directory into itself: %v", err)
+	}
+	if err := rename("/c/h", "/c/d"); errors.Is(err, ErrExists) == false {
+		t.Errorf("Moved over an existing entry: %v", err)
+	}
+	if err := rename("/a/missing", "/c/m"); errors.Is(err, ErrNotFound) == false {
+		t.Errorf("Moved a missing file: %v", err)
+	}
+	if read, err := testRead(nodes[2], cons[2], "/c/d/x"); err != nil || read != "inside" {
+		t.Errorf("Read %q after the refused moves: %v", read, err)
+	}
+
+	// the owner of the parent may rename entries but not another owner's
+	// directory inode, which the rename must then leave alone
+	setTestSigningKeys(t, nodes[0], nodes[2])
+	testMkdir(t, nodes[0], cons[0], "/p")
+	chRes := new(ChmodResult)
+	nodes[0].Chmod(ChmodRequest{Sender: cons[0], MsgID: NewRandomID(), Path: "/p", Mode: 0757}, chRes)
+	if chRes.Err != nil {
+		t.Fatal(chRes.Err)
+	}
+	testMkdir(t, nodes[2], cons[2], "/p/s")
+	res := new(RenameResult)
+	nodes[0].Rename(RenameRequest{Sender: cons[0], MsgID: NewRandomID(), SrcPath: "/p/s", DstPath: "/p/t"}, res)
+	if errors.Is(res.Err, ErrPermission) == false {
+		t.Errorf("Renaming another owner's directory returned %v", res.Err)
+	}
+	k.FindDir(FindDirRequest{Sender: me, MsgID: NewRandomID(), Path: "/p/s"}, fdRes)
+	if fdRes.Err != nil || fdRes.Inode.Meta.Name != "s" {
+		t.Errorf("Directory named %q after the refused rename: %v", fdRes.Inode.Meta.Name, fdRes.Err)
+	}
+}
+
+func TestDFSErrors(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[1], cons[1]
+	dirKey := testMkdir(t, k, me, "/d")
+	testWrite(t, k, me, "/d/f", "x")
+
+	if _, err := testRead(k, me, "/d/missing"); errors.Is(err, ErrNotFound) == false || errors.Is(err, ErrFileNotFound) == false {
+		t.Errorf("Read of a missing file: %v", err)
+	}
+	if _, err := testRead(k, me, "/d"); errors.Is(err, ErrIsDir) == false {
+		t.Errorf("Read of a directory: %v", err)
+	}
+	cdRes := new(CreateDirResult)
+	k.CreateDir(CreateDirRequest{Sender: me, MsgID: NewRandomID(), Name: "f", DirKey: dirKey}, cdRes)
+	if errors.Is(cdRes.Err, ErrExists) == false || cdRes.Err.Error() != "Couldn't create directory already exists" {
+		t.Errorf("Create over a file: %v", cdRes.Err)
+	}
+	rmRes := new(RemoveResult)
+	k.Remove(RemoveRequest{Sender: me, MsgID: NewRandomID(), Path: "/d"}, rmRes)
+	if errors.Is(rmRes.Err, ErrNotEmpty) == false {
+		t.Errorf("Remove of a full directory: %v", rmRes.Err)
+	}
+	mvRes := new(RenameResult)
+	k.Rename(RenameRequest{Sender: me, MsgID: NewRandomID(), SrcPath: "/d", DstPath: "/d/e"}, mvRes)
+	if errors.Is(mvRes.Err, ErrInvalidPath) == false {
+		t.Errorf("Move into itself: %v", mvRes.Err)
+	}
+	if CodeOf(ErrFileNotFound) != ERR_NOT_FOUND {
+		t.Error("Missing file has no not found code")
+	}
+}
+
+func startTestNetwork(t *testing.T, n int) ([]*Kademlia, []Contact) {
+	nodes, cons := make([]*Kademlia, n), make([]Contact, n)
+	for i := range nodes {
+		nodes[i], cons[i] = startTestNode(t)
+	}
+	for i := range nodes {
+		for j := range nodes {
+			if i != j {
+				nodes[i].UpdateContacts(cons[j])
+			}
+		}
+	}
+	if err := nodes[0].ensureDirInode(cons[0], NewRandomID(), DFSRootKey, ""); err != nil {
+		t.Fatal(err)
+	}
+	return nodes, cons
+}
+
+// create the directory p, its parent must exist
+func testMkdir(t *testing.T, k *Kademlia, me Contact, p string) ID {
+	dirPath, name := splitPath(p)
+	fdRes := new(FindDirResult)
+	k.FindDir(FindDirRequest{Sender: me, MsgID: NewRandomID(), Path: dirPath}, fdRes)
+	if fdRes.Err != nil {
+		t.Fatal(fdRes.Err)
+	}
+	res := new(CreateDirResult)
+	k.CreateDir(CreateDirRequest{Sender: me, MsgID: NewRandomID(), Name: name, DirKey: fdRes.Key}, res)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	return res.Key
+}
+
+func testWrite(t *testing.T, k *Kademlia, me Contact, p string, content string) ID {
+	res := new(WriteFileResult)
+	k.WriteFile(WriteFileRequest{Sender: me, MsgID: NewRandomID(), Path: p, Content: []byte(content)}, res)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	return res.Key
+}
+
+func testRead(k *Kademlia, me Contact, p string) (string, error) {
+	res := new(ReadFileResult)
+	k.ReadFile(ReadFileRequest{Sender: me, MsgID: NewRandomID(), Path: p}, res)
+	return string(res.Content), res.Err
+}
+
+func TestWrapFileKey(t *testing.T) {
+	reader, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := NewKademlia()
+	k.SetDFSKey(reader)
+	fileKey, wrapped, err := k.newFileKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := unwrapFileKey(wrapped, reader)
+	if err != nil || false == bytes.Equal(unwrapped, fileKey) {
+		t.Errorf("Reader could not unwrap file key: %v", err)
+	}
+	if _, err = unwrapFileKey(wrapped, other); err == nil {
+		t.Error("Unauthorized reader unwrapped file key")
+	}
+
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(aead, []byte("thisismydata"), blockIndex(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unseal(aead, sealed, blockIndex(1)); err == nil {
+		t.Error("Block opened at the wrong position")
+	}
+	data, err := unseal(aead, sealed, blockIndex(0))
+	if err != nil || false == bytes.Equal(data, []byte("thisismydata")) {
+		t.Errorf("Block did not decrypt: %v", err)
+	}
+}
+
+func TestWriteFileEncryption(t *testing.T) {
+	a, aCon := startTestNode(t)
+	b, bCon := startTestNode(t)
+	a.UpdateContacts(bCon)
+	b.UpdateContacts(aCon)
+	keys := make([]*ecdh.PrivateKey, 3)
+	for i := range keys {
+		key, err := ecdh.X25519().GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	a.SetDFSKey(keys[0])
+	if err := a.ensureDirInode(aCon, NewRandomID(), DFSRootKey, ""); err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string, encrypt bool, readers ...[]byte) FileInode {
+		req := WriteFileRequest{Sender: aCon, MsgID: NewRandomID(), Path: "/secret", Content: []byte(content),
+			Encrypt: encrypt, Readers: readers}
+		res := new(WriteFileResult)
+		a.WriteFile(req, res)
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		inode := new(FileInode)
+		if err := a.findContent(aCon, NewRandomID(), res.Key, inode); err != nil {
+			t.Fatal(err)
+		}
+		return *inode
+	}
+	write("first", true, keys[1].PublicKey().Bytes())
+
+	// a plain rewrite keeps the file encrypted for the same readers, and
+	// more may be added
+	inode := write("second", false)
+	if inode.Encrypted == false || len(inode.Keys) != 2 {
+		t.Fatalf("Rewrite dropped encryption, %v with %d keys", inode.Encrypted, len(inode.Keys))
+	}
+	if _, err := unwrapFileKey(inode.Keys, keys[1]); err != nil {
+		t.Errorf("Reader lost access: %v", err)
+	}
+	inode = write("third", false, keys[2].PublicKey().Bytes(), keys[1].PublicKey().Bytes())
+	if len(inode.Keys) != 3 {
+		t.Errorf("File key wrapped %d times for 3 readers", len(inode.Keys))
+	}
+	for _, reader := range keys {
+		if _, err := unwrapFileKey(inode.Keys, reader); err != nil {
+			t.Errorf("Reader can't unwrap the file key: %v", err)
+		}
+	}
+
+	readRes := new(ReadFileResult)
+	a.ReadFile(ReadFileRequest{Sender: aCon, MsgID: NewRandomID(), Path: "/secret"}, readRes)
+	if readRes.Err != nil || string(readRes.Content) != "third" {
+		t.Errorf("Read back %q: %v", readRes.Content, readRes.Err)
+	}
+	readRes = new(ReadFileResult)
+	b.ReadFile(ReadFileRequest{Sender: bCon, MsgID: NewRandomID(), Path: "/secret"}, readRes)
+	if readRes.Err == nil {
+		t.Errorf("Node without a DFS key read %q", readRes.Content)
+	}
+}
+
+func TestErasureReconstruct(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(rand.Intn(256))
+	}
+	shards := erasureSplit(data, ERASURE_DATA_SHARDS, ERASURE_PARITY_SHARDS)
+	if len(shards) != ERASURE_DATA_SHARDS+ERASURE_PARITY_SHARDS {
+		t.Fatalf("Got %d shards", len(shards))
+	}
+
+	// lose as many shards as there is parity, data shards included
+	for _, i := range rand.Perm(len(shards))[:ERASURE_PARITY_SHARDS] {
+		shards[i] = nil
+	}
+	if err := erasureReconstruct(shards, ERASURE_DATA_SHARDS, ERASURE_PARITY_SHARDS); err != nil {
+		t.Fatal(err)
+	}
+	if false == bytes.Equal(erasureJoin(shards, ERASURE_DATA_SHARDS, len(data)), data) {
+		t.Error("Reconstructed block differs")
+	}
+
+	for i := 0; i <= ERASURE_PARITY_SHARDS; i++ {
+		shards[i] = nil
+	}
+	if err := erasureReconstruct(shards, ERASURE_DATA_SHARDS, ERASURE_PARITY_SHARDS); err == nil {
+		t.Error("Reconstructed block from too few shards")
+	}
+}
+
+func TestErasureRepair(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 4)
+	content := make([]byte, 2*DFS_ERASURE_THRESHOLD)
+	rand.Read(content)
+	testWrite(t, nodes[1], cons[1], "/big", string(content))
+	ffRes := new(FindFileResult)
+	nodes[1].FindFile(FindFileRequest{Sender: cons[1], MsgID: NewRandomID(), Path: "/big"}, ffRes)
+	if ffRes.Err != nil || len(ffRes.Inode.Blocks) != 1 {
+		t.Fatalf("Found %d blocks: %v", len(ffRes.Inode.Blocks), ffRes.Err)
+	}
+	blockKey := ffRes.Inode.Blocks[0]
+	lose := func(indexes ...int) {
+		for _, k := range nodes {
+			k.storedDataMutex.Lock()
+			for _, i := range indexes {
+				delete(k.StoredData, shardKey(blockKey, i))
+			}
+			k.storedDataMutex.Unlock()
+		}
+	}
+	holds := func(i int) bool {
+		for _, k := range nodes {
+			if k.findLocalContent(shardKey(blockKey, i), new(BlockShard)) == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	// data shards are lost, the parity shards rebuild them
+	lose(0, 1, 2, 3)
+	if n := nodes[0].repairStoredBlocks(cons[0]); n != 4 {
+		t.Errorf("Repaired %d shards instead of 4", n)
+	}
+	for i := 0; i < ERASURE_DATA_SHARDS+ERASURE_PARITY_SHARDS; i++ {
+		if holds(i) == false {
+			t.Errorf("Shard %d not stored again", i)
+		}
+	}
+	if n := nodes[0].repairStoredBlocks(cons[0]); n != 0 {
+		t.Errorf("Repaired %d shards of a complete block", n)
+	}
+	if read, err := testRead(nodes[2], cons[2], "/big"); err != nil || read != string(content) {
+		t.Errorf("Read %d bytes after the repair: %v", len(read), err)
+	}
+
+	// more shards are lost than there are parity shards
+	lose(0, 1, 2, 3, 4)
+	if n := nodes[0].repairStoredBlocks(cons[0]); n != 0 || holds(0) {
+		t.Errorf("Repaired %d shards of a lost block", n)
+	}
+}
+
+func TestSignedDirUpdate(t *testing.T) {
+	owner, other := NewKademlia(), NewKademlia()
+	for _, k := range []*Kademlia{owner, other} {
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.SetSigningKey(priv)
+	}
+	node, con, key := NewKademlia(), makeRandomContact(), NewRandomID()
+
+	store := func(writer *Kademlia, dir DirInode, version uint64) error {
+		value, err := encodeDFS(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := CompareAndStoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: value, Version: version}
+		writer.signCompareAndStore(&req)
+		res := new(CompareAndStoreResult)
+		node.CompareAndStore(req, res)
+		return res.Err
+	}
+
+	meta := MetaData{Name: "d", IsDir: true, Owner: owner.SigningPublicKey(), Mode: DFS_DIR_MODE}
+	dir := DirInode{Meta: meta, Files: map[string]ID{}}
+	if err := store(owner, dir, 0); err != nil {
+		t.Fatalf("Owner could not create directory: %v", err)
+	}
+	dir.Files["x"] = NewRandomID()
+	if err := store(other, dir, 1); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Other writer changed a private directory: %v", err)
+	}
+
+	dir.Meta.Mode = 0777
+	if err := store(owner, dir, 1); err != nil {
+		t.Fatalf("Owner could not chmod directory: %v", err)
+	}
+	dir.Files["y"] = NewRandomID()
+	if err := store(other, dir, 2); err != nil {
+		t.Errorf("Other writer could not change a writable directory: %v", err)
+	}
+	dir.Meta.Owner = other.SigningPublicKey()
+	if err := store(other, dir, 3); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Other writer took over the directory: %v", err)
+	}
+
+	value, _ := encodeDFS(DirInode{Meta: meta})
+	storeRes := new(StoreResult)
+	node.Store(StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: value}, storeRes)
+	if errors.Is(storeRes.Err, ErrPermission) == false {
+		t.Errorf("Plain store overwrote an owned directory: %v", storeRes.Err)
+	}
+}
+
+func TestSignedFileEntries(t *testing.T) {
+	owner, other := NewKademlia(), NewKademlia()
+	for _, k := range []*Kademlia{owner, other} {
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.SetSigningKey(priv)
+	}
+	node, con, key := NewKademlia(), makeRandomContact(), NewRandomID()
+	version := uint64(0)
+	store := func(writer *Kademlia, dir DirInode) error {
+		value, err := encodeDFS(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := CompareAndStoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: value, Version: version}
+		if writer != nil {
+			writer.signCompareAndStore(&req)
+		}
+		res := new(CompareAndStoreResult)
+		node.CompareAndStore(req, res)
+		if res.Err == nil {
+			version++
+		}
+		return res.Err
+	}
+	// an unowned directory anybody may change, holding an owned file
+	dir := func(fileKey ID, perm EntryPerm) DirInode {
+		d := DirInode{Meta: MetaData{Name: "d", IsDir: true}, Files: map[string]ID{}}
+		linkEntry(&d, "f", fileKey, perm)
+		return d
+	}
+	private := EntryPerm{Owner: owner.SigningPublicKey(), Mode: DFS_FILE_MODE}
+	fileKey := NewRandomID()
+	if err := store(owner, dir(fileKey, private)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store(nil, dir(NewRandomID(), private)); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Unsigned update replaced an owned file: %v", err)
+	}
+	if err := store(other, dir(NewRandomID(), private)); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Other writer replaced an owned file: %v", err)
+	}
+	if err := store(other, DirInode{Meta: MetaData{Name: "d", IsDir: true}, Files: map[string]ID{}}); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Other writer removed an owned file: %v", err)
+	}
+	value, _ := encodeDFS(DirInode{})
+	storeRes := new(StoreResult)
+	node.Store(StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: value}, storeRes)
+	if errors.Is(storeRes.Err, ErrPermission) == false {
+		t.Errorf("Plain store overwrote owned entries: %v", storeRes.Err)
+	}
+
+	// with the others write bit the contents may change, not owner and mode
+	shared := EntryPerm{Owner: owner.SigningPublicKey(), Mode: 0646}
+	if err := store(owner, dir(fileKey, shared)); err != nil {
+		t.Fatalf("Owner could not chmod the file: %v", err)
+	}
+	fileKey = NewRandomID()
+	if err := store(nil, dir(fileKey, shared)); err != nil {
+		t.Errorf("Unsigned update could not write a writable file: %v", err)
+	}
+	if err := store(other, dir(fileKey, EntryPerm{Owner: other.SigningPublicKey(), Mode: 0646})); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Other writer took over the file: %v", err)
+	}
+
+	// through the DFS API a node without the key can't remove the file either
+	nodes, cons := startTestNetwork(t, 3)
+	nodes[1].SetSigningKey(owner.signKey)
+	testWrite(t, nodes[1], cons[1], "/f", "mine")
+	rmRes := new(RemoveResult)
+	nodes[2].Remove(RemoveRequest{Sender: cons[2], MsgID: NewRandomID(), Path: "/f"}, rmRes)
+	if errors.Is(rmRes.Err, ErrPermission) == false {
+		t.Errorf("Node without the key removed an owned file: %v", rmRes.Err)
+	}
+	if content, err := testRead(nodes[2], cons[2], "/f"); err != nil || content != "mine" {
+		t.Errorf("Read %q after the refused remove: %v", content, err)
+	}
+}
+
+func TestStoreChunkResume(t *testing.T) {
+	k := NewKademlia()
+	con, key := makeRandomContact(), NewRandomID()
+	value := make([]byte, 3*STREAM_CHUNK_SIZE+100)
+	rand.Read(value)
+	chunk := func(offset int) StoreChunkRequest {
+		end := offset + STREAM_CHUNK_SIZE
+		if end > len(value) {
+			end = len(value)
+		}
+		return StoreChunkRequest{Sender: con, MsgID: NewRandomID(), Key: key, Hash: FromBytes(value),
+			Total: len(value), Offset: offset, Chunk: value[offset:end], Checksum: crc32.ChecksumIEEE(value[offset:end])}
+	}
+
+	res := new(StoreChunkResult)
+	if k.StoreChunk(chunk(0), res); res.Err != nil || res.Received != STREAM_CHUNK_SIZE {
+		t.Fatalf("First chunk not taken, received %d: %v", res.Received, res.Err)
+	}
+	// a chunk past the gap tells the sender where to resume
+	res = new(StoreChunkResult)
+	if k.StoreChunk(chunk(2*STREAM_CHUNK_SIZE), res); res.Err != nil || res.Received != STREAM_CHUNK_SIZE {
+		t.Fatalf("Out of order chunk taken, received %d: %v", res.Received, res.Err)
+	}
+	bad := chunk(STREAM_CHUNK_SIZE)
+	bad.Checksum += 1
+	if k.StoreChunk(bad, res); errors.Is(res.Err, ErrChunkChecksum) == false {
+		t.Errorf("Corrupt chunk taken: %v", res.Err)
+	}
+	for offset := STREAM_CHUNK_SIZE; res.Done == false; offset = res.Received {
+		res = new(StoreChunkResult)
+		if k.StoreChunk(chunk(offset), res); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if false == bytes.Equal(k.StoredData[key].Data, value) {
+		t.Error("Streamed value stored is incorrect")
+	}
+
+	fetched := make([]byte, 0, len(value))
+	for len(fetched) < len(value) {
+		fetchRes := new(FetchChunkResult)
+		req := FetchChunkRequest{Sender: con, MsgID: NewRandomID(), Key: key, Offset: len(fetched), Length: STREAM_CHUNK_SIZE}
+		if k.FetchChunk(req, fetchRes); fetchRes.Err != nil {
+			t.Fatal(fetchRes.Err)
+		}
+		if fetchRes.Total != len(value) || crc32.ChecksumIEEE(fetchRes.Chunk) != fetchRes.Checksum {
+			t.Fatal("Fetched chunk does not match")
+		}
+		fetched = append(fetched, fetchRes.Chunk...)
+	}
+	if false == bytes.Equal(fetched, value) {
+		t.Error("Fetched value is incorrect")
+	}
+
+	// a huge announced size costs nothing up front, and only so many values
+	// are received at once
+	limits := DefaultStorageLimits()
+	limits.MaxValueSize = 0
+	k.SetStorageLimits(limits)
+	for i := 0; i < MAX_UPLOADS; i++ {
+		req := chunk(0)
+		req.Key, req.Total = NewRandomID(), 1<<40
+		res = new(StoreChunkResult)
+		if k.StoreChunk(req, res); res.Err != nil {
+			t.Fatalf("Upload %d refused: %v", i, res.Err)
+		}
+	}
+	for _, up := range k.uploads {
+		if cap(up.data) > 2*STREAM_CHUNK_SIZE {
+			t.Fatalf("Upload buffer of %d bytes for one chunk", cap(up.data))
+		}
+	}
+	req := chunk(0)
+	req.Key = NewRandomID()
+	if k.StoreChunk(req, res); errors.Is(res.Err, ErrTooManyUploads) == false {
+		t.Errorf("Upload past the limit answered with %v", res.Err)
+	}
+}
+
+func TestStorageLimits(t *testing.T) {
+	k := NewKademlia()
+	k.SetStorageLimits(StorageLimits{MaxValueSize: 100, Quota: 250, SenderStores: 5, SenderWindow: time.Minute})
+	// every store comes from another node ID but the same IP
+	peer := &peerKademlia{k: k, remote: "192.0.2.1:4000"}
+	store := func(key ID, size int) error {
+		res := new(StoreResult)
+		peer.Store(StoreRequest{Sender: makeRandomContact(), MsgID: NewRandomID(), Key: key, Value: make([]byte, size)}, res)
+		return res.Err
+	}
+	// keys at growing distance from our ID
+	near, mid, far := CopyID(k.NodeID), CopyID(k.NodeID), CopyID(k.NodeID)
+	near[IDBytes-1] ^= 1
+	mid[0] ^= 0x01
+	far[0] ^= 0x80
+
+	if err := store(near, 101); errors.Is(err, ErrValueTooLarge) == false {
+		t.Errorf("Oversized value stored: %v", err)
+	}
+	if err := store(mid, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := store(far, 100); err != nil {
+		t.Fatal(err)
+	}
+	// the far value makes way for a nearer one
+	if err := store(near, 100); err != nil {
+		t.Fatalf("Near value refused: %v", err)
+	}
+	if _, ok := k.StoredData[far]; ok {
+		t.Error("Farthest value was not evicted")
+	}
+	if _, ok := k.StoredData[mid]; ok == false {
+		t.Error("Nearer value was evicted")
+	}
+	// nothing farther than this one is left to evict
+	if err := store(far, 100); errors.Is(err, ErrQuotaExceeded) == false {
+		t.Errorf("Store over quota accepted: %v", err)
+	}
+	// refused stores weren't charged, three of the five were made
+	for i := 0; i < 2; i++ {
+		if err := store(NewRandomID(), 1); err != nil {
+			t.Fatalf("Store within the limit refused: %v", err)
+		}
+	}
+	if err := store(NewRandomID(), 1); errors.Is(err, ErrSenderLimit) == false {
+		t.Errorf("Sender over its limit accepted: %v", err)
+	}
+	other := &peerKademlia{k: k, remote: "192.0.2.2:4000"}
+	res := new(StoreResult)
+	other.Store(StoreRequest{Sender: makeRandomContact(), MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte{1}}, res)
+	if res.Err != nil {
+		t.Errorf("Store from another IP refused: %v", res.Err)
+	}
+}
+
+func TestRemoteErrorWire(t *testing.T) {
+	var buf bytes.Buffer
+	sent := StoreResult{MsgID: NewRandomID(), Err: wireError(ErrQuotaExceeded)}
+	if err := gob.NewEncoder(&buf).Encode(sent); err != nil {
+		t.Fatal(err)
+	}
+	received := new(StoreResult)
+	if err := gob.NewDecoder(&buf).Decode(received); err != nil {
+		t.Fatal(err)
+	}
+	if errors.Is(received.Err, ErrQuotaExceeded) == false || CodeOf(received.Err) != ERR_QUOTA_EXCEEDED {
+		t.Errorf("Error did not survive encoding: %v", received.Err)
+	}
+
+	// errors returned by a handler only arrive as their message
+	if err := callError(rpc.ServerError(ErrNotFound.Error())); errors.Is(err, ErrNotFound) == false {
+		t.Errorf("Server error not matched: %v", err)
+	}
+	if err := callError(rpc.ServerError("something else")); CodeOf(err) != ERR_UNKNOWN {
+		t.Errorf("Unknown server error got code %d", CodeOf(err))
+	}
+}
+
+func TestAuthorizedDelete(t *testing.T) {
+	k, publisher, other := NewKademlia(), NewKademlia(), NewKademlia()
+	for _, p := range []*Kademlia{publisher, other} {
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetSigningKey(priv)
+	}
+	con, key := makeRandomContact(), NewRandomID()
+	store := func(req StoreRequest) error {
+		res := new(StoreResult)
+		k.Store(req, res)
+		return res.Err
+	}
+	del := func(signer *Kademlia) error {
+		req := DeleteValueRequest{Sender: con, MsgID: NewRandomID(), Key: key}
+		signer.signDelete(&req)
+		res := new(DeleteValueResult)
+		k.Delete(req, res)
+		checkMessageId(t, req.MsgID, res.MsgID)
+		return res.Err
+	}
+
+	req := StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("thisismydata")}
+	publisher.signStore(&req)
+	if err := store(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := del(other); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Delete by another key accepted: %v", err)
+	}
+	if _, ok := k.StoredData[key]; ok == false {
+		t.Fatal("Value deleted by another key")
+	}
+	if err := del(publisher); err != nil {
+		t.Fatalf("Delete by publisher refused: %v", err)
+	}
+	if _, ok := k.StoredData[key]; ok {
+		t.Fatal("Value not deleted")
+	}
+
+	// neither a plain store nor the original signed one bring it back
+	if err := store(StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("again")}); errors.Is(err, ErrDeleted) == false {
+		t.Errorf("Plain store of deleted key accepted: %v", err)
+	}
+	if err := store(req); errors.Is(err, ErrDeleted) == false {
+		t.Errorf("Republish of deleted value accepted: %v", err)
+	}
+	fresh := StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("new")}
+	publisher.signStore(&fresh)
+	if err := store(fresh); err != nil {
+		t.Errorf("Publisher could not store again: %v", err)
+	}
+
+	// nobody else may take the value over, signed or not
+	steal := StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("stolen")}
+	if err := store(steal); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Plain store over a published value accepted: %v", err)
+	}
+	other.signStore(&steal)
+	if err := store(steal); errors.Is(err, ErrPermission) == false {
+		t.Errorf("Store signed by another key accepted: %v", err)
+	}
+	if !bytes.Equal(k.StoredData[key].Publisher, publisher.SigningPublicKey()) {
+		t.Error("Publisher changed")
+	}
+
+	// a node without the key only refuses the signer's earlier copies
+	k = NewKademlia()
+	if err := del(publisher); err != nil {
+		t.Fatalf("Delete of a key not held refused: %v", err)
+	}
+	if err := store(req); errors.Is(err, ErrDeleted) == false {
+		t.Errorf("Republish to a node that didn't hold the key accepted: %v", err)
+	}
+	if err := del(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := store(StoreRequest{Sender: con, MsgID: NewRandomID(), Key: key, Value: []byte("plain")}); err != nil {
+		t.Errorf("Plain store after another key's delete refused: %v", err)
+	}
+}
+
+// stale data is dropped, but old revisions, trash and snapshots outlive it
+func TestDFSRetention(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 3)
+	k, me := nodes[1], cons[1]
+	testWrite(t, k, me, "/f", "old")
+	testWrite(t, k, me, "/f", "new")
+	snapRes := new(CreateSnapshotResult)
+	k.CreateSnapshot(CreateSnapshotRequest{Sender: me, MsgID: NewRandomID(), Name: "s"}, snapRes)
+	if snapRes.Err != nil {
+		t.Fatal(snapRes.Err)
+	}
+	sdRes := new(SoftDeleteResult)
+	k.SoftDelete(SoftDeleteRequest{Sender: me, MsgID: NewRandomID(), Path: "/f"}, sdRes)
+	if sdRes.Err != nil {
+		t.Fatal(sdRes.Err)
+	}
+	plain := NewRandomID()
+	nodes[0].StoredData[plain] = TimeValue{Data: []byte("plain")}
+
+	for _, node := range nodes {
+		node.storedDataMutex.Lock()
+		for key, val := range node.StoredData {
+			val.time = time.Now().Add(-time.Hour)
+			node.StoredData[key] = val
+		}
+		node.storedDataMutex.Unlock()
+		node.cleanupStale()
+	}
+	if _, ok := nodes[0].StoredData[plain]; ok {
+		t.Error("Stale plain value kept")
+	}
+	if content, err := testRead(k, me, sdRes.TrashPath); err != nil || content != "new" {
+		t.Errorf("Trashed file read as %q: %v", content, err)
+	}
+	readRes := new(ReadFileResult)
+	k.ReadFileAt(ReadFileAtRequest{Sender: me, MsgID: NewRandomID(), Path: sdRes.TrashPath, Revision: 0}, readRes)
+	if readRes.Err != nil || string(readRes.Content) != "old" {
+		t.Errorf("Old revision read as %q: %v", readRes.Content, readRes.Err)
+	}
+	findRes := new(FindSnapshotResult)
+	k.FindSnapshot(FindSnapshotRequest{Sender: me, MsgID: NewRandomID(), Name: "s"}, findRes)
+	if findRes.Err != nil {
+		t.Fatal(findRes.Err)
+	}
+	k.ReadFile(ReadFileRequest{Sender: me, MsgID: NewRandomID(), Path: "/f", RootInode: findRes.Inode, RootKey: findRes.Key}, readRes)
+	if readRes.Err != nil || string(readRes.Content) != "new" {
+		t.Errorf("Snapshot file read as %q: %v", readRes.Content, readRes.Err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	a, aCon := startTestNode(t)
+	b, bCon := startTestNode(t)
+	_, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetSigningKey(priv)
+	a.UpdateContacts(bCon)
+	b.UpdateContacts(aCon)
+	// each creates the root on the other
+	for _, n := range []struct {
+		k  *Kademlia
+		me Contact
+	}{{a, aCon}, {b, bCon}} {
+		if err := n.k.ensureDirInode(n.me, NewRandomID(), DFSRootKey, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := encodeDFS(FileContent{Content: []byte("orphan")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := FromBytes(value)
+	req := StoreRequest{Sender: aCon, MsgID: NewRandomID(), Key: key, Value: value}
+	a.signStore(&req)
+	for _, k := range []*Kademlia{a, b} {
+		if err := k.storeLocal(req, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sweep := func(k *Kademlia, me Contact) {
+		marked, err := k.markDFS(me, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.sweepDFS(me, marked, 0)
+	}
+
+	// peers can't have a node collect for them
+	client, err := a.DialContact(bCon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.Call("Kademlia.IterDelete", DeleteValueRequest{Sender: aCon, Key: key}, new(DeleteValueResult)); err == nil {
+		t.Error("IterDelete served over RPC")
+	}
+	// nor collect a value the node still sees linked
+	delRes := new(DeleteValueResult)
+	b.Delete(DeleteValueRequest{Sender: aCon, MsgID: NewRandomID(), Key: DFSRootKey, Collect: true}, delRes)
+	if errors.Is(delRes.Err, ErrPermission) == false {
+		t.Errorf("Collecting the root returned %v", delRes.Err)
+	}
+
+	// b has seen the value unreferenced, a collects it on both
+	sweep(b, bCon)
+	if _, ok := b.StoredData[key]; ok == false {
+		t.Fatal("Value collected on first sight")
+	}
+	sweep(a, aCon)
+	time.Sleep(10 * time.Millisecond)
+	sweep(a, aCon)
+	for _, k := range []*Kademlia{a, b} {
+		k.storedDataMutex.Lock()
+		_, held := k.StoredData[key]
+		_, root := k.StoredData[DFSRootKey]
+		k.storedDataMutex.Unlock()
+		if held || root == false {
+			t.Fatalf("Collection left the value %v and the root %v", held, root)
+		}
+	}
+	if err := b.storeLocal(req, ""); errors.Is(err, ErrDeleted) == false {
+		t.Errorf("Republish of a collected value accepted: %v", err)
+	}
+	rewrite := StoreRequest{Sender: aCon, MsgID: NewRandomID(), Key: key, Value: value}
+	a.signStore(&rewrite)
+	if err := b.storeLocal(rewrite, ""); err != nil {
+		t.Errorf("New write of a collected value refused: %v", err)
+	}
+}
+
+func TestLookupQueriesOnce(t *testing.T) {
+	k := NewKademlia()
+	k.SetDiversityLimits(DiversityLimits{})
+	nodes := make([]FoundNode, 0, 30)
+	failing := make(map[ID]bool)
+	for i, con := range createContacts(30) {
+		k.UpdateContacts(con)
+		nodes = append(nodes, ContactToFoundNode(con))
+		if i%3 == 0 {
+			failing[con.NodeID] = true
+		}
+	}
+	// the holder is the node closest to the target, so the lookup gets to it
+	holder := nodes[1].NodeID
+	target := CopyID(holder)
+	target[IDBytes-1] ^= 1
+
+	// every node answers with all the others, so each is learned many times
+	var mutex sync.Mutex
+	queries := make(map[ID]int)
+	query := func(node FoundNode) lookupReply {
+		mutex.Lock()
+		queries[node.NodeID] += 1
+		mutex.Unlock()
+		if failing[node.NodeID] {
+			return lookupReply{err: errors.New("unreachable")}
+		}
+		if node.NodeID.Equals(holder) {
+			return lookupReply{value: []byte("value")}
+		}
+		return lookupReply{nodes: nodes}
+	}
+	out := k.lookup(target, query, true, 1, nil)
+	for id, n := range queries {
+		if n > 1 {
+			t.Errorf("Node %s queried %d times", id.AsString(), n)
+		}
+	}
+	for _, node := range out.closest {
+		if failing[node.NodeID] {
+			t.Errorf("Failed node %s among the closest", node.NodeID.AsString())
+		}
+	}
+	if string(out.value) != "value" || out.valueSource.Equals(holder) == false {
+		t.Errorf("Lookup found %q from %s", out.value, out.valueSource.AsString())
+	}
+}
+
+// a node counting the chunks it hands out
+type fetchCounter struct {
+	*Kademlia
+	mutex   sync.Mutex
+	fetches int
+}
+
+func (f *fetchCounter) FetchChunk(req FetchChunkRequest, res *FetchChunkResult) error {
+	f.mutex.Lock()
+	f.fetches += 1
+	f.mutex.Unlock()
+	return f.Kademlia.FetchChunk(req, res)
+}
+
+func TestStreamedLookupFetchesOnce(t *testing.T) {
+	client, clientCon := startTestNode(t)
+	value := make([]byte, 3*STREAM_THRESHOLD)
+	crand.Read(value)
+	key := FromBytes(value)
+	holders := make([]*fetchCounter, 2)
+	for i := range holders {
+		holders[i] = &fetchCounter{Kademlia: NewKademlia()}
+		server := rpc.NewServer()
+		server.RegisterName("Kademlia", holders[i])
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go http.Serve(l, server)
+		con, err := NewContact(holders[i].NodeID, []string{l.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = holders[i].storeLocal(StoreRequest{Sender: con, Key: key, Value: value}, ""); err != nil {
+			t.Fatal(err)
+		}
+		client.UpdateContacts(con)
+	}
+
+	// the lookup touches every holder but takes the value from one
+	req := FindValueRequest{UpdateTimestamp: true, Sender: clientCon, MsgID: NewRandomID(), Key: key}
+	res := new(FindValueResult)
+	client.IterFindValue(req, res)
+	if res.Err != nil || bytes.Equal(res.Value, value) == false {
+		t.Fatalf("Lookup returned %d bytes: %v", len(res.Value), res.Err)
+	}
+	if holders[0].fetches > 0 && holders[1].fetches > 0 {
+		t.Errorf("Value fetched from both holders, %d and %d chunks", holders[0].fetches, holders[1].fetches)
+	}
+}
+
+func TestLookupTrace(t *testing.T) {
+	k := NewKademlia()
+	trace := new(LookupTrace)
+	out := k.lookup(NewRandomID(), func(node FoundNode) lookupReply { return lookupReply{} }, false, 1, trace)
+	if len(out.closest) != 0 || trace.Termination != LOOKUP_NO_CONTACTS {
+		t.Errorf("Lookup without contacts ended with %q", trace.Termination)
+	}
+
+	contacts := createContacts(ALPHA + 2)
+	for _, con := range contacts {
+		k.UpdateContacts(con)
+	}
+	failing := contacts[0].NodeID
+	query := func(node FoundNode) lookupReply {
+		if node.NodeID.Equals(failing) {
+			return lookupReply{err: errors.New("unreachable")}
+		}
+		return lookupReply{}
+	}
+	trace = new(LookupTrace)
+	out = k.lookup(NewRandomID(), query, false, 1, trace)
+	if trace.Termination != LOOKUP_CONVERGED || len(trace.Rounds) != 2 {
+		t.Errorf("Lookup ended with %q after %d rounds", trace.Termination, len(trace.Rounds))
+	}
+	if len(out.closest) != len(contacts)-1 {
+		t.Errorf("Lookup returned %d nodes instead of %d", len(out.closest), len(contacts)-1)
+	}
+	for _, node := range out.closest {
+		if node.NodeID.Equals(failing) {
+			t.Error("Lookup returned the node that failed")
+		}
+	}
+
+	holder := contacts[1].NodeID
+	query = func(node FoundNode) lookupReply {
+		if node.NodeID.Equals(holder) {
+			return lookupReply{value: []byte("value")}
+		}
+		return lookupReply{}
+	}
+	out = k.lookup(holder, query, false, 1, nil)
+	if string(out.value) != "value" || out.valueSource.Equals(holder) == false {
+		t.Error("Lookup did not return the value")
+	}
+}
+
+func TestDisjointLookup(t *testing.T) {
+	k := NewKademlia()
+	network := createContacts(40)
+	for _, con := range network[:K] {
+		k.UpdateContacts(con)
+	}
+	// every node knows a part of the network, so paths keep learning of
+	// nodes another path knows too
+	var queryMutex sync.Mutex
+	queried := make(map[ID]int)
+	query := func(node FoundNode) lookupReply {
+		queryMutex.Lock()
+		queried[node.NodeID] += 1
+		queryMutex.Unlock()
+		nodes := make([]FoundNode, 0, K)
+		for i := 0; i < K; i++ {
+			nodes = append(nodes, ContactToFoundNode(network[rand.Intn(len(network))]))
+		}
+		return lookupReply{nodes: nodes}
+	}
+	trace := new(LookupTrace)
+	out := k.lookup(NewRandomID(), query, false, DISJOINT_PATHS, trace)
+	if trace.Termination != LOOKUP_CONVERGED || len(out.closest) != K {
+		t.Fatalf("Lookup ended with %q and %d nodes", trace.Termination, len(out.closest))
+	}
+	paths := make(map[ID]int)
+	for _, round := range trace.Rounds {
+		for _, id := range round.Queried {
+			if path, ok := paths[id]; ok && path != round.Path {
+				t.Errorf("Node %s queried on paths %d and %d", id.AsString(), path, round.Path)
+			}
+			paths[id] = round.Path
+		}
+	}
+	for id, count := range queried {
+		if count > 1 {
+			t.Errorf("Node %s queried %d times", id.AsString(), count)
+		}
+	}
+	used := make(map[int]bool)
+	for _, node := range out.closest {
+		used[paths[node.NodeID]] = true
+	}
+	if len(used) < 2 {
+		t.Error("Closest nodes were not combined from several paths")
+	}
+}
+
+func TestCollectSeeds(t *testing.T) {
+	f, err := os.CreateTemp("", "seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# bootstrap nodes\n127.0.0.1:7891\n\n127.0.0.1:7892 # second\n127.0.0.1:7890\n")
+	f.Close()
+
+	seeds, err := CollectSeeds("127.0.0.1:7890, 127.0.0.1:7891", f.Name(), "", "", []string{"127.0.0.1:7890"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"127.0.0.1:7891", "127.0.0.1:7892"}
+	if fmt.Sprint(seeds) != fmt.Sprint(expected) {
+		t.Errorf("Collected seeds %v instead of %v", seeds, expected)
+	}
+
+	k := NewKademlia()
+	me := makeRandomContact()
+	if _, err = k.Join(me, []string{"127.0.0.1:1", "127.0.0.1:2"}); errors.Is(err, ErrNoBootstrap) == false {
+		t.Errorf("Join through dead seeds returned %v", err)
+	}
+}
+
+// encode a domain name as DNS labels
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// answer DNS queries over UDP from records, keyed by query type and name,
+// with the rdata of each answer. Names without records don't exist
+func startStubDNS(t *testing.T, records map[uint16]map[string][][]byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// the question follows the 12 byte header, a name then type and class
+			end, labels := 12, []string{}
+			for end < n && query[end] != 0 {
+				labels = append(labels, string(query[end+1:end+1+int(query[end])]))
+				end += 1 + int(query[end])
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			answers := records[qtype][strings.ToLower(strings.Join(labels, "."))]
+
+			res := append([]byte{}, query[:2]...)
+			if len(answers) == 0 {
+				res = append(res, 0x81, 0x83) // NXDOMAIN
+			} else {
+				res = append(res, 0x81, 0x80)
+			}
+			res = binary.BigEndian.AppendUint16(res, 1)
+			res = binary.BigEndian.AppendUint16(res, uint16(len(answers)))
+			res = append(res, 0, 0, 0, 0)
+			res = append(res, query[12:end]...)
+			for _, rdata := range answers {
+				// the name points back at the question
+				res = append(res, 0xc0, 12)
+				res = binary.BigEndian.AppendUint16(res, qtype)
+				res = binary.BigEndian.AppendUint16(res, 1)
+				res = binary.BigEndian.AppendUint32(res, 60)
+				res = binary.BigEndian.AppendUint16(res, uint16(len(rdata)))
+				res = append(res, rdata...)
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLookupSeeds(t *testing.T) {
+	const typeSRV, typeTXT = 33, 16
+	// SRV records of one priority come back in random order
+	srv := func(priority uint16, port uint16, target string) []byte {
+		rdata := binary.BigEndian.AppendUint16(nil, priority)
+		rdata = append(rdata, 0, 5)
+		rdata = binary.BigEndian.AppendUint16(rdata, port)
+		return append(rdata, dnsName(target)...)
+	}
+	txt := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	server := startStubDNS(t, map[uint16]map[string][][]byte{
+		typeSRV: {"_kademlia._tcp.seeds.test": {srv(20, 7891, "n2.seeds.test."), srv(10, 7890, "n1.seeds.test.")}},
+		typeTXT: {"seeds.test": {txt("v=spf1 -all"), txt("kademlia=127.0.0.1:7892,[::1]:7893")},
+			"txt.test": {txt("kademlia=127.0.0.1:7894")}},
+	})
+
+	seeds, err := LookupSeeds("seeds.test.", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"n1.seeds.test:7890", "n2.seeds.test:7891", "127.0.0.1:7892", "[::1]:7893"}
+	if fmt.Sprint(seeds) != fmt.Sprint(expected) {
+		t.Errorf("Looked up seeds %v instead of %v", seeds, expected)
+	}
+	// TXT records alone are enough
+	if seeds, err = LookupSeeds("txt.test.", server); err != nil || fmt.Sprint(seeds) != "[127.0.0.1:7894]" {
+		t.Errorf("Looked up seeds %v: %v", seeds, err)
+	}
+	if seeds, err = LookupSeeds("missing.test.", server); err == nil {
+		t.Errorf("Looked up seeds %v for a name without records", seeds)
+	}
+
+	seeds, err = CollectSeeds("127.0.0.1:7894", "", "seeds.test.", server, []string{"127.0.0.1:7892"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"127.0.0.1:7894", "n1.seeds.test:7890", "n2.seeds.test:7891", "[::1]:7893"}
+	if fmt.Sprint(seeds) != fmt.Sprint(expected) {
+		t.Errorf("Collected seeds %v instead of %v", seeds, expected)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	nodes, cons := startTestNetwork(t, 6)
+	k, me := startTestNode(t)
+	seed := JoinHostPort(cons[0].Host.String(), cons[0].Port)
+	stats, err := k.Join(me, []string{seed, "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Seeds != 2 || stats.Bootstrapped != 1 {
+		t.Errorf("Joined through %d of %d seeds", stats.Bootstrapped, stats.Seeds)
+	}
+	// the seed knows the whole network and tells us about it
+	contacts, buckets, closest := k.contactStats()
+	if stats.Contacts != len(nodes) || contacts != len(nodes) || stats.Buckets != buckets {
+		t.Errorf("Stats count %d contacts in %d buckets, %d in %d known", stats.Contacts, stats.Buckets, contacts, buckets)
+	}
+	if stats.Refreshed != closest {
+		t.Errorf("Refreshed %d buckets, expected the %d farther than the closest", stats.Refreshed, closest)
+	}
+	if strings.HasPrefix(stats.String(), "joined through 1 of 2 bootstrap nodes") == false {
+		t.Errorf("Stats read %q", stats)
+	}
+	// announcing looked us up, so the others learned about us
+	for i, node := range nodes {
+		if _, err = node.ContactFromID(k.NodeID); err != nil {
+			t.Errorf("Node %d doesn't know the joined node", i)
+		}
+	}
+}
+
+func TestBucketRandomID(t *testing.T) {
+	k := NewKademlia()
+	for _, i := range []int{0, 7, 8, 100, BucketCount - 1} {
+		if pre := k.NodeID.Xor(k.bucketRandomID(i)).PrefixLen(); pre != i {
+			t.Errorf("ID for bucket %d falls into bucket %d", i, pre)
+		}
+	}
+}
+
+func TestIPv6Contact(t *testing.T) {
+	con, err := NewContact(NewRandomID(), []string{"[::1]:7890", "localhost:7891"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if con.Host.Equal(net.IPv6loopback) == false || con.Port != 7890 {
+		t.Errorf("Parsed main address as %v port %d", con.Host, con.Port)
+	}
+	if len(con.Addrs) != 1 || con.Addrs[0] != "127.0.0.1:7891" {
+		t.Errorf("Parsed other addresses as %v", con.Addrs)
+	}
+	node := ContactToFoundNode(con)
+	if addrs := nodeAddrs(node); addrs[0] != "[::1]:7890" || len(addrs) != 2 {
+		t.Errorf("Node addresses are %v", addrs)
+	}
+	if _, _, err = ParseHostPort("::1:7890"); err == nil {
+		t.Error("Parsed an IPv6 address without brackets")
+	}
+	if ip, _, err := ParseHostPort("notlocalhost.invalid:7890"); err == nil && ip.IsLoopback() {
+		t.Error("Took a name containing localhost for localhost")
+	}
+}
+
+func TestNATDetection(t *testing.T) {
+	k := NewKademlia()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go k.Serve(l)
+
+	client, err := rpc.DialHTTP("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping := Ping{Sender: makeRandomContact(), MsgID: NewRandomID()}
+	var pong Pong
+	if err = client.Call("Kademlia.Ping", ping, &pong); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if host, _, _ := net.SplitHostPort(pong.Observed); host != "127.0.0.1" || pong.Sender.NodeID.Equals(k.NodeID) == false {
+		t.Errorf("Pong observed %q from %s", pong.Observed, pong.Sender.NodeID.AsString())
+	}
+
+	// reporters on one subnet, like one host with many node IDs, count once
+	me := Contact{NodeID: NewRandomID(), Host: net.ParseIP("10.0.0.5"), Port: 7890}
+	for i := 0; i < 2*OBSERVED_QUORUM; i++ {
+		k.observe(fmt.Sprintf("198.51.100.%d", i+1), "192.0.2.9:40000")
+	}
+	for i := 0; i < OBSERVED_QUORUM-1; i++ {
+		k.observe(fmt.Sprintf("10.%d.0.1", i+1), "203.0.113.7:40000")
+	}
+	if k.BehindNAT(me) {
+		t.Error("Detected NAT before a quorum of nodes agreed")
+	}
+	k.observe("10.9.0.1", "203.0.113.7:40001")
+	if k.BehindNAT(me) == false || k.ObservedIP().Equal(net.ParseIP("203.0.113.7")) == false {
+		t.Errorf("Did not detect NAT, observed %v", k.ObservedIP())
+	}
+
+	// old reports stop counting
+	k.observedMutex.Lock()
+	for key, obs := range k.observed {
+		obs.seen = obs.seen.Add(-2 * OBSERVED_MINUTES * time.Minute)
+		k.observed[key] = obs
+	}
+	k.observedMutex.Unlock()
+	if k.ObservedIP() != nil {
+		t.Errorf("Expired reports still give %v", k.ObservedIP())
+	}
+
+	me.Unreachable = true
+	k.UpdateContacts(me)
+	if _, err = k.ContactFromID(me.NodeID); err == nil {
+		t.Error("Unreachable contact was added to a bucket")
+	}
+}
+
+func TestBootstrapAnonymous(t *testing.T) {
+	seed, seedCon := startTestNode(t)
+	k, me := startTestNode(t)
+	seedAddr := JoinHostPort(seedCon.Host.String(), seedCon.Port)
+	stats, err := k.Bootstrap([]string{seedAddr})
+	if err != nil || stats.Bootstrapped != 1 {
+		t.Fatalf("Bootstrap failed: %v, %v", stats, err)
+	}
+	if _, err := k.ContactFromID(seed.NodeID); err != nil {
+		t.Error("Bootstrap node not added")
+	}
+	// the seed's answers are handled in the background
+	time.Sleep(50 * time.Millisecond)
+	if _, err := seed.ContactFromID(me.NodeID); err == nil {
+		t.Error("Bootstrap told the seed about us before we announced ourselves")
+	}
+	k.Announce(me, &stats)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := seed.ContactFromID(me.NodeID); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Seed did not learn about us from Announce")
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	relay := NewKademlia()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go relay.Serve(l)
+
+	relayed := NewKademlia()
+	addr, err := relayed.StartRelay(l.Addr().String())
+	if err != nil || addr != l.Addr().String() {
+		t.Fatalf("Relay not started: %v", err)
+	}
+	// the relay takes over the connection and checks the node in the
+	// background
+	registered := func() []byte {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			relay.relayMutex.Lock()
+			node, ok := relay.relayed[relayed.NodeID]
+			relay.relayMutex.Unlock()
+			if ok {
+				return node.key
+			}
+		}
+		t.Fatal("Node not registered with the relay")
+		return nil
+	}
+	key := registered()
+
+	node := FoundNode{NodeID: relayed.NodeID, Relay: addr}
+	k := NewKademlia()
+	sender := makeRandomContact()
+	storeReq := StoreRequest{Sender: sender, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte("relayed")}
+	storeRes := new(StoreResult)
+	k.makeStoreRequest(node, storeReq, storeRes)
+	if storeRes.Err != nil || storeReq.MsgID.Equals(storeRes.MsgID) == false {
+		t.Fatalf("Store through relay failed: %v", storeRes.Err)
+	}
+	fvRes := k.remoteFindValue(node, FindValueRequest{Sender: sender, Key: storeReq.Key})
+	if fvRes.Err != nil || string(fvRes.Value) != "relayed" {
+		t.Errorf("Find value through relay returned %q, %v", fvRes.Value, fvRes.Err)
+	}
+
+	fvRes = k.remoteFindValue(FoundNode{NodeID: NewRandomID(), Relay: addr}, FindValueRequest{Sender: sender, Key: storeReq.Key})
+	if errors.Is(fvRes.Err, ErrNotRelayed) == false {
+		t.Errorf("Call to a node not relayed returned %v", fvRes.Err)
+	}
+
+	// another node claiming the ID can't take the relay over
+	impostor := NewKademlia()
+	impostor.NodeID = CopyID(relayed.NodeID)
+	conn, err := impostor.connectRelay(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor.serveRelay(conn)
+	if bytes.Equal(registered(), key) == false {
+		t.Error("Impostor took over the relay")
+	}
+	fvRes = k.remoteFindValue(node, FindValueRequest{Sender: sender, Key: storeReq.Key})
+	if fvRes.Err != nil || string(fvRes.Value) != "relayed" {
+		t.Errorf("Find value through relay after the takeover attempt returned %q, %v", fvRes.Value, fvRes.Err)
+	}
+}
+
+// calls only count as relayed on our own connection to our relay, and the
+// relay can't pass them off as local ones
+func TestRelayedCalls(t *testing.T) {
+	k, con := startTestNode(t)
+	client, err := rpc.DialHTTP("tcp", JoinHostPort(con.Host.String(), con.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	call := RelayedCall{Sender: makeRandomContact(), Remote: "127.0.0.1:1", Method: "Kademlia.Ping"}
+	if err = client.Call("Kademlia.Relayed", call, new(RelayedReply)); err == nil {
+		t.Error("Relayed served to peers")
+	}
+
+	k.SetStorageLimits(StorageLimits{SenderStores: 1, SenderWindow: time.Minute})
+	r := &relayedKademlia{&peerKademlia{k: k, remote: "192.0.2.1:4000"}}
+	store := func() error {
+		sender := makeRandomContact()
+		var args bytes.Buffer
+		gob.NewEncoder(&args).Encode(StoreRequest{Sender: sender, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte{1}})
+		reply := new(RelayedReply)
+		r.Relayed(RelayedCall{Sender: sender, Remote: "127.0.0.1:1", Method: "Kademlia.Store", Args: args.Bytes()}, reply)
+		if reply.Err != nil {
+			return reply.Err
+		}
+		res := new(StoreResult)
+		if err := gob.NewDecoder(bytes.NewReader(reply.Reply)).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Err
+	}
+	if err = store(); err != nil {
+		t.Fatal(err)
+	}
+	if err = store(); errors.Is(err, ErrSenderLimit) == false {
+		t.Errorf("Relayed store claiming loopback returned %v", err)
+	}
+}
+
+func TestContactAddressProof(t *testing.T) {
+	node, con := startTestNode(t)
+	k := NewKademlia()
+	k.UpdateContacts(con)
+
+	// a claim of the node's ID from elsewhere leaves its address alone
+	forged := con
+	forged.Port = 1
+	k.UpdateContacts(forged)
+	if got, err := k.ContactFromID(con.NodeID); err != nil || got.Port != con.Port {
+		t.Errorf("Contact moved to an address the node doesn't answer on: %v, %v", got, err)
+	}
+
+	// the node itself answers on its new address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go node.Serve(l)
+	moved, err := NewContact(con.NodeID, []string{l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.UpdateContacts(moved)
+	if got, err := k.ContactFromID(con.NodeID); err != nil || got.Port != moved.Port {
+		t.Errorf("Contact not moved to the node's new address: %v, %v", got, err)
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	caPub, caKey, _ := ed25519.GenerateKey(crand.Reader)
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, caPub, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	cas := x509.NewCertPool()
+	cas.AddCert(caCert)
+
+	newNode := func() *Kademlia {
+		_, key, _ := ed25519.GenerateKey(crand.Reader)
+		cert, err := NewNodeCert(key, NewRandomID(), caCert, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := NewKademlia()
+		if err = k.SetTLS(cert, cas); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	server, client := newNode(), newNode()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	node := FoundNode{IPAddr: "127.0.0.1", Port: port, NodeID: server.NodeID}
+	me := Contact{NodeID: client.NodeID, Host: net.ParseIP("127.0.0.1"), Port: 1}
+	if res := client.remoteFindNode(node, FindNodeRequest{Sender: me}); res.Err != nil {
+		t.Errorf("Find node over TLS failed: %v", res.Err)
+	}
+	impostor := FoundNode{IPAddr: "127.0.0.1", Port: port, NodeID: NewRandomID()}
+	if res := client.remoteFindNode(impostor, FindNodeRequest{Sender: me}); res.Err == nil {
+		t.Error("Server proved an ID its certificate isn't bound to")
+	}
+	other := Contact{NodeID: NewRandomID(), Host: me.Host, Port: 1}
+	if res := client.remoteFindNode(node, FindNodeRequest{Sender: other}); errors.Is(res.Err, ErrSenderMismatch) == false {
+		t.Errorf("Request for another sender returned %v", res.Err)
+	}
+	if res := NewKademlia().remoteFindNode(node, FindNodeRequest{Sender: me}); res.Err == nil {
+		t.Error("Plain client talked to a TLS server")
+	}
+
+	// self-signed certificates must be bound to their key's ID
+	pub, key, _ := ed25519.GenerateKey(crand.Reader)
+	cert, _ := NewNodeCert(key, KeyNodeID(pub), nil, nil)
+	k := NewKademlia()
+	if err = k.SetTLS(cert, nil); err != nil || k.NodeID.Equals(KeyNodeID(pub)) == false {
+		t.Errorf("Self-signed certificate not taken: %v", err)
+	}
+	cert, _ = NewNodeCert(key, NewRandomID(), nil, nil)
+	if _, err = verifyNodeCert(cert.Certificate, nil); errors.Is(err, ErrPeerID) == false {
+		t.Errorf("Self-signed certificate for another ID returned %v", err)
+	}
+}
+
+// only the protocol's calls are served, not every method of the node that
+// happens to look like one
+func TestRPCMethods(t *testing.T) {
+	k, con := startTestNode(t)
+	id := CopyID(k.NodeID)
+	client, err := rpc.DialHTTP("tcp", JoinHostPort(con.Host.String(), con.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.Call("Kademlia.SetTLS", Ping{}, new(Pong)); err == nil || strings.Contains(err.Error(), "can't find method") == false {
+		t.Errorf("SetTLS over RPC returned %v", err)
+	}
+	if k.NodeID.Equals(id) == false {
+		t.Error("Remote call changed the node ID")
+	}
+	if err = client.Call("Kademlia.Ping", Ping{Sender: makeRandomContact(), MsgID: NewRandomID()}, new(Pong)); err != nil {
+		t.Errorf("Ping refused: %v", err)
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	p := Puzzle{Static: 6, Dynamic: 8}
+	node := NewKademlia()
+	node.SetPuzzle(mustPuzzleKey(t, p), p)
+	if puzzleStaticBits(node.NodeID) < p.Static || puzzleDynamicBits(node.NodeID, node.puzzleNonce) < p.Dynamic {
+		t.Error("Generated node ID does not solve the puzzle")
+	}
+	con := Contact{NodeID: node.NodeID, Host: net.ParseIP("127.0.0.1"), Port: 1}
+	node.ProvePuzzle(&con)
+
+	k := NewKademlia()
+	k.SetPuzzle(mustPuzzleKey(t, p), p)
+	k.UpdateContacts(con)
+	if _, err := k.ContactFromID(con.NodeID); err != nil {
+		t.Error("Contact solving the puzzle was not added")
+	}
+
+	// a freely picked ID, or a nonce that doesn't solve the dynamic puzzle,
+	// keeps a contact out
+	picked := Contact{NodeID: NewRandomID(), Host: net.ParseIP("127.0.0.1"), Port: 2, PublicKey: con.PublicKey}
+	badNonce := con
+	for badNonce.Nonce = NewRandomID(); puzzleDynamicBits(con.NodeID, badNonce.Nonce) >= p.Dynamic; {
+		badNonce.Nonce = NewRandomID()
+	}
+	k = NewKademlia()
+	k.SetPuzzle(mustPuzzleKey(t, p), p)
+	k.UpdateContacts(picked)
+	k.UpdateContacts(badNonce)
+	if _, err := k.ContactFromID(picked.NodeID); err == nil {
+		t.Error("Contact with a picked ID was added")
+	}
+	if _, err := k.ContactFromID(badNonce.NodeID); err == nil {
+		t.Error("Contact without a dynamic puzzle solution was added")
+	}
+
+	// without TLS nothing proves a peer holds its key
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = k.Serve(l); errors.Is(err, ErrPuzzleTLS) == false {
+		t.Errorf("Serving puzzles without TLS returned %v", err)
+	}
+}
+
+func mustPuzzleKey(t *testing.T, p Puzzle) ed25519.PrivateKey {
+	key, err := GeneratePuzzleKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestDiversityLimits(t *testing.T) {
+	k := NewKademlia()
+	k.SetDiversityLimits(DiversityLimits{BucketIP: 2, BucketSubnet: 3, TableIP: 4})
+	// a contact for bucket i, i < 8
+	inBucket := func(i int, ip string) Contact {
+		d := NewRandomID()
+		d[0] = d[0]&^byte(1<<uint(i)-1) | 1<<uint(i)
+		return Contact{NodeID: k.NodeID.Xor(d), Host: net.ParseIP(ip), Port: 7890}
+	}
+	admitted := func(con Contact) bool {
+		k.UpdateContacts(con)
+		_, err := k.ContactFromID(con.NodeID)
+		return err == nil
+	}
+
+	for i, c := range []struct {
+		bucket int
+		ip     string
+		ok     bool
+	}{
+		{0, "10.0.0.1", true}, {0, "10.0.0.1", true}, {0, "10.0.0.1", false},
+		{0, "10.0.0.2", true}, {0, "10.0.0.3", false}, {0, "10.0.1.1", true},
+		{1, "10.0.0.1", true}, {2, "10.0.0.1", true}, {3, "10.0.0.1", false},
+		{0, "127.0.0.1", true}, {0, "127.0.0.1", true}, {0, "127.0.0.1", true},
+	} {
+		if admitted(inBucket(c.bucket, c.ip)) != c.ok {
+			t.Errorf("Contact %d from %s in bucket %d admitted: %v", i, c.ip, c.bucket, !c.ok)
+		}
+	}
+
+	// other addresses and relays count too
+	viaAddrs := inBucket(5, "10.0.3.1")
+	viaAddrs.Addrs = []string{"10.0.0.1:7890"}
+	viaRelay := inBucket(6, "10.0.4.1")
+	viaRelay.Relay = "10.0.0.1:7890"
+	if admitted(viaAddrs) || admitted(viaRelay) {
+		t.Error("Contact reachable on a full IP through Addrs or Relay admitted")
+	}
+
+	// an address change that breaks a limit keeps the old address
+	con := inBucket(4, "10.0.2.1")
+	admitted(con)
+	moved := con
+	moved.Host = net.ParseIP("10.0.0.1")
+	pre := k.NodeID.Xor(con.NodeID).PrefixLen()
+	k.contactsMutex[pre].Lock()
+	if k.admitContact(k.Contacts[pre], moved, k.Contacts[pre].Front()) {
+		t.Error("Contact moved past the table limit")
+	}
+	k.contactsMutex[pre].Unlock()
+}
+
+func TestAbuseProtection(t *testing.T) {
+	serve := func(k *Kademlia) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go k.Serve(l)
+		return l.Addr().String()
+	}
+	me := makeRandomContact()
+	ping := func(client *rpc.Client) error {
+		var pong Pong
+		return callError(client.Call("Kademlia.Ping", Ping{Sender: me, MsgID: NewRandomID()}, &pong))
+	}
+
+	limited := NewKademlia()
+	limited.SetAbuseLimits(AbuseLimits{Rate: 1, Burst: 3})
+	client, err := limited.DialAddr(serve(limited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if err := ping(client); err != nil {
+			t.Fatalf("Ping %d within the burst failed: %v", i, err)
+		}
+	}
+	if err := ping(client); errors.Is(err, ErrRateLimited) == false {
+		t.Errorf("Ping over the rate answered with %v", err)
+	}
+	if limited.AbuseStats().RateLimited != 1 {
+		t.Errorf("Rate limited requests counted as %d", limited.AbuseStats().RateLimited)
+	}
+
+	// a new node ID for every request still counts against the IP
+	remote := "192.0.2.1:4000"
+	for i := 0; i < 3*RATE_LIMIT_IP_FACTOR; i++ {
+		if err := limited.checkRequest(NewRandomID(), remote); err != nil {
+			t.Fatalf("Request %d within the IP's burst refused: %v", i, err)
+		}
+	}
+	if err := limited.checkRequest(NewRandomID(), remote); errors.Is(err, ErrRateLimited) == false {
+		t.Errorf("Request over the IP's rate answered with %v", err)
+	}
+	for i := len(limited.rateBuckets); i < MAX_RATE_BUCKETS; i++ {
+		limited.rateBuckets[fmt.Sprint(i)] = &tokenBucket{last: time.Now()}
+	}
+	if err := limited.checkRequest(NewRandomID(), "192.0.2.2:4000"); errors.Is(err, ErrRateLimited) == false {
+		t.Errorf("Request from a new IP with all buckets used answered with %v", err)
+	}
+	if len(limited.rateBuckets) != MAX_RATE_BUCKETS {
+		t.Errorf("%d rate buckets kept", len(limited.rateBuckets))
+	}
+
+	// values over our own limit are refused but not held against anyone,
+	// the sender may be one of many behind a NAT
+	strict := NewKademlia()
+	strict.SetAbuseLimits(AbuseLimits{Strikes: 2, BanTime: time.Minute})
+	limits := DefaultStorageLimits()
+	limits.MaxValueSize = 8
+	strict.SetStorageLimits(limits)
+	client, err = strict.DialAddr(serve(strict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		req := StoreRequest{Sender: me, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte("too large a value")}
+		res := new(StoreResult)
+		if err := client.Call("Kademlia.Store", req, res); err != nil || errors.Is(res.Err, ErrValueTooLarge) == false {
+			t.Fatalf("Oversize store answered with %v, %v", err, res.Err)
+		}
+	}
+	if err := ping(client); err != nil {
+		t.Errorf("Ping after oversize stores answered with %v", err)
+	}
+
+	// a node answering with bad message IDs gets banned
+	strict.UpdateContacts(me)
+	for i := 0; i < 2; i++ {
+		strict.misbehaved(me.NodeID)
+	}
+	if err := ping(client); errors.Is(err, ErrBanned) == false {
+		t.Errorf("Ping from a banned node answered with %v", err)
+	}
+	if _, ok := strict.AbuseStats().Bans[me.NodeID.AsString()]; ok == false {
+		t.Errorf("Ban missing from %v", strict.AbuseStats())
+	}
+	if _, err := strict.ContactFromID(me.NodeID); err == nil {
+		t.Error("Banned node kept in the buckets")
+	}
+}
@@ -0,0 +1,326 @@
+package kademlia
+
+// The iterative lookup shared by IterFindNode, IterFindValue and IterDelete.
+// Each round queries the ALPHA closest known nodes not asked yet, the lookup
+// ends once the K closest nodes that answered have all been asked, when a
+// value turns up, or after LOOKUP_TIMEOUT_SECONDS. With a LookupTrace every
+// round is recorded so failed lookups can be diagnosed.
+//
+// As in S/Kademlia a lookup may follow several disjoint paths at once, so a
+// malicious node returning bogus contacts can only steer the path it is on.
+// The closest contacts are dealt out over the paths, each path then goes on
+// like a lookup of its own but a node is only ever on the path that learned
+// of it first. The value comes from whichever path finds it, the closest
+// nodes from all paths combined.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LOOKUP_TIMEOUT_SECONDS = 8
+
+// how many disjoint paths S/Kademlia suggests
+const DISJOINT_PATHS = 3
+
+// why a lookup ended
+const (
+	LOOKUP_CONVERGED   = "converged"
+	LOOKUP_VALUE_FOUND = "value found"
+	LOOKUP_TIMEOUT     = "timeout"
+	LOOKUP_NO_CONTACTS = "no contacts"
+)
+
+// one round of a lookup on one of its paths. Closest is the prefix length
+// the closest answering node on the path shares with the target after the
+// round, -1 while none answered
+type LookupRound struct {
+	Path     int
+	Queried  []ID
+	Replies  int
+	Errors   []string
+	Learned  int
+	Closest  int
+	Improved bool
+}
+
+type LookupTrace struct {
+	Target      ID
+	Paths       int
+	Rounds      []LookupRound
+	Termination string
+	Duration    time.Duration
+}
+
+func (t *LookupTrace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "lookup %s", t.Target.AsString())
+	if t.Paths > 1 {
+		fmt.Fprintf(&b, " on %d disjoint paths", t.Paths)
+	}
+	b.WriteString("\n")
+	for i, round := range t.Rounds {
+		fmt.Fprintf(&b, "round %d", i+1)
+		if t.Paths > 1 {
+			fmt.Fprintf(&b, " on path %d", round.Path+1)
+		}
+		fmt.Fprintf(&b, ": queried %d, replies %d, errors %d, learned %d, closest %d",
+			len(round.Queried), round.Replies, len(round.Errors), round.Learned, round.Closest)
+		if round.Improved {
+			b.WriteString(" (improved)")
+		}
+		b.WriteString("\n")
+		for _, id := range round.Queried {
+			fmt.Fprintf(&b, "  queried %s\n", id.AsString())
+		}
+		for _, err := range round.Errors {
+			fmt.Fprintf(&b, "  error %s\n", err)
+		}
+	}
+	fmt.Fprintf(&b, "%s after %d rounds in %v", t.Termination, len(t.Rounds), t.Duration)
+	return b.String()
+}
+
+// what a node answered to a lookup query, value is only set by find value
+type lookupReply struct {
+	source ID
+	nodes  []FoundNode
+	value  []byte
+	err    error
+}
+
+type lookupQuery func(node FoundNode) lookupReply
+
+type lookupCandidate struct {
+	node     FoundNode
+	dist     ID
+	queried  bool
+	answered bool
+}
+
+type lookupOutcome struct {
+	closest     []FoundNode
+	value       []byte
+	valueSource ID
+	timedOut    bool
+}
+
+// the candidates of one path
+type lookupPath struct {
+	index      int
+	candidates []*lookupCandidate
+	closest    int
+}
+
+// the state shared by a lookup's paths
+type lookupRun struct {
+	k           *Kademlia
+	target      ID
+	query       lookupQuery
+	keepGoing   bool
+	trace       *LookupTrace
+	mutex       sync.Mutex
+	owner       map[ID]int
+	out         lookupOutcome
+	termination string
+	timeout     chan bool
+	stop        chan bool
+	stopOnce    sync.Once
+}
+
+// look up target with query on paths disjoint paths, one with paths below 2.
+// Unless keepGoing is set the lookup stops at the first value found
+func (k *Kademlia) lookup(target ID, query lookupQuery, keepGoing bool, paths int, trace *LookupTrace) lookupOutcome {
+	start := time.Now()
+	if paths < 1 {
+		paths = 1
+	}
+	r := &lookupRun{k: k,
+		target:      target,
+		query:       query,
+		keepGoing:   keepGoing,
+		trace:       trace,
+		owner:       make(map[ID]int),
+		termination: LOOKUP_CONVERGED,
+		timeout:     make(chan bool),
+		stop:        make(chan bool)}
+	timer := time.AfterFunc(LOOKUP_TIMEOUT_SECONDS*time.Second, func() { close(r.timeout) })
+	defer timer.Stop()
+	if trace != nil {
+		trace.Target, trace.Paths = CopyID(target), paths
+	}
+
+	lanes := make([]*lookupPath, paths)
+	for i := range lanes {
+		lanes[i] = &lookupPath{index: i, candidates: make([]*lookupCandidate, 0, K), closest: -1}
+	}
+	initial := k.FindCloseNodes(target, k.NodeID, K)
+	sort.Slice(initial, func(i, j int) bool {
+		return target.Xor(initial[i].NodeID).Less(target.Xor(initial[j].NodeID))
+	})
+	dealt := 0
+	for _, node := range initial {
+		if r.claim(lanes[dealt%paths], node) {
+			dealt += 1
+		}
+	}
+	if dealt == 0 {
+		r.termination = LOOKUP_NO_CONTACTS
+	} else {
+		var wg sync.WaitGroup
+		for _, lane := range lanes {
+			wg.Add(1)
+			go func(lane *lookupPath) {
+				defer wg.Done()
+				r.follow(lane)
+			}(lane)
+		}
+		wg.Wait()
+	}
+
+	var all []*lookupCandidate
+	for _, lane := range lanes {
+		all = append(all, lane.candidates...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].dist.Less(all[j].dist) })
+	r.out.closest = make([]FoundNode, 0, K)
+	for _, c := range all {
+		if c.answered && len(r.out.closest) < K {
+			r.out.closest = append(r.out.closest, c.node)
+		}
+	}
+	if trace != nil {
+		trace.Termination, trace.Duration = r.termination, time.Since(start)
+	}
+	return r.out
+}
+
+// put node on lane unless it is us or on a path already
+func (r *lookupRun) claim(lane *lookupPath, node FoundNode) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.owner[node.NodeID]; ok || node.NodeID.Equals(r.k.NodeID) || r.k.isBanned(node.NodeID.AsString()) {
+		return false
+	}
+	r.owner[node.NodeID] = lane.index
+	lane.candidates = append(lane.candidates, &lookupCandidate{node: node, dist: r.target.Xor(node.NodeID)})
+	return true
+}
+
+func (r *lookupRun) found(reply lookupReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.out.value == nil {
+		r.out.value, r.out.valueSource = reply.value, CopyID(reply.source)
+	}
+	if r.keepGoing == false {
+		r.termination = LOOKUP_VALUE_FOUND
+		r.stopOnce.Do(func() { close(r.stop) })
+	}
+}
+
+func (r *lookupRun) timedOut() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.out.timedOut = true
+	if r.termination == LOOKUP_CONVERGED {
+		r.termination = LOOKUP_TIMEOUT
+	}
+}
+
+// query lane's closest nodes round by round until it converges, the lookup
+// times out or a value ends it
+func (r *lookupRun) follow(lane *lookupPath) {
+	for done := false; done == false; {
+		select {
+		case <-r.timeout:
+			r.timedOut()
+			return
+		case <-r.stop:
+			return
+		default:
+		}
+		candidates := lane.candidates
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist.Less(candidates[j].dist) })
+		if len(candidates) > K {
+			candidates = candidates[:K]
+		}
+		batch := make([]*lookupCandidate, 0, ALPHA)
+		for _, c := range candidates {
+			if c.queried == false && len(batch) < ALPHA {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		lane.candidates = candidates
+		if len(batch) == 0 {
+			return
+		}
+
+		round := LookupRound{Path: lane.index, Queried: make([]ID, 0, len(batch)), Closest: lane.closest}
+		replies := make(chan lookupReply, len(batch))
+		for _, c := range batch {
+			round.Queried = append(round.Queried, c.node.NodeID)
+			go func(node FoundNode) {
+				reply := r.query(node)
+				reply.source = node.NodeID
+				replies <- reply
+			}(c.node)
+		}
+
+		failed := make(map[ID]bool)
+	collect:
+		for range batch {
+			var reply lookupReply
+			select {
+			case reply = <-replies:
+			case <-r.timeout:
+				r.timedOut()
+				done = true
+				break collect
+			}
+			if reply.err != nil {
+				failed[reply.source] = true
+				round.Errors = append(round.Errors, fmt.Sprintf("%s: %v", reply.source.AsString(), reply.err))
+				continue
+			}
+			round.Replies += 1
+			for _, c := range batch {
+				if c.node.NodeID.Equals(reply.source) {
+					c.answered = true
+					if prefix := c.dist.PrefixLen(); prefix > lane.closest {
+						lane.closest = prefix
+					}
+				}
+			}
+			for _, node := range reply.nodes {
+				if r.claim(lane, node) {
+					round.Learned += 1
+					r.k.queueContact(FoundNodeToContact(node))
+				}
+			}
+			if reply.value != nil {
+				r.found(reply)
+				done = done || r.keepGoing == false
+			}
+		}
+
+		// nodes that failed to answer drop out
+		r.mutex.Lock()
+		kept := lane.candidates[:0]
+		for _, c := range lane.candidates {
+			if failed[c.node.NodeID] == false {
+				kept = append(kept, c)
+			}
+		}
+		lane.candidates = kept
+		round.Improved, round.Closest = lane.closest > round.Closest, lane.closest
+		if r.trace != nil {
+			r.trace.Rounds = append(r.trace.Rounds, round)
+		}
+		r.mutex.Unlock()
+	}
+}
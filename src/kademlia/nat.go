@@ -0,0 +1,174 @@
+package kademlia
+
+// NAT detection. Nodes answering a Ping or FindNode tell the caller the
+// address they saw its request come from. Once reporters from
+// OBSERVED_QUORUM different subnets agree on an IP and it's not one we
+// advertise, we are behind NAT and others can't reach us on the address we
+// give. Reports are counted per subnet of the address we reached the reporter
+// on, so one host running many node IDs has a single say, and are forgotten
+// after OBSERVED_MINUTES unless the reporter tells us again. Such a node marks
+// its contact Unreachable, which keeps it out of other nodes' buckets while it
+// can still make requests of its own. Bootstrap asks its first contacts
+// without telling them about us, so this is known before we announce ourselves.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// how many reporters must report the same address before we believe it
+const OBSERVED_QUORUM = 3
+
+// how many reporters' reports are kept
+const OBSERVED_MAX = 64
+
+// how long a report counts
+const OBSERVED_MINUTES = 30
+
+// how many contacts Bootstrap asks for our address
+const OBSERVED_PROBES = 16
+
+// the IP a reporter saw us at and when it told us
+type observation struct {
+	ip   string
+	seen time.Time
+}
+
+// the RPC receiver for a single connection, answering the protocol's calls
+// like the node does but also knowing the address the connection came from.
+// The node isn't embedded, so no other method of it is served
+type peerKademlia struct {
+	k      *Kademlia
+	remote string
+}
+
+func (p *peerKademlia) Ping(ping Ping, pong *Pong) error {
+	err := p.k.Ping(ping, pong)
+	pong.Observed = p.remote
+	return err
+}
+
+func (p *peerKademlia) FindNode(req FindNodeRequest, res *FindNodeResult) error {
+	err := p.k.FindNode(req, res)
+	res.Observed = p.remote
+	return err
+}
+
+func (p *peerKademlia) FindValue(req FindValueRequest, res *FindValueResult) error {
+	return p.k.FindValue(req, res)
+}
+
+// stores are charged to the IP they came from, see storeCharged
+func (p *peerKademlia) Store(req StoreRequest, res *StoreResult) error {
+	return p.k.serveStore(req, res, p.remote)
+}
+
+func (p *peerKademlia) StoreChunk(req StoreChunkRequest, res *StoreChunkResult) error {
+	return p.k.serveStoreChunk(req, res, p.remote)
+}
+
+func (p *peerKademlia) FetchChunk(req FetchChunkRequest, res *FetchChunkResult) error {
+	return p.k.FetchChunk(req, res)
+}
+
+func (p *peerKademlia) CompareAndStore(req CompareAndStoreRequest, res *CompareAndStoreResult) error {
+	return p.k.serveCompareAndStore(req, res, p.remote)
+}
+
+func (p *peerKademlia) Delete(req DeleteValueRequest, res *DeleteValueResult) error {
+	return p.k.Delete(req, res)
+}
+
+// a relay passes on the address calls came from
+func (p *peerKademlia) Relay(req RelayRequest, res *RelayResult) error {
+	return p.k.relay(req, res, p.remote)
+}
+
+// note that the node we reached at reporter, an IP, saw us at observed, a
+// HOST:PORT address. When all reporters' places are taken the oldest report
+// makes way
+func (k *Kademlia) observe(reporter string, observed string) {
+	host, _, err := net.SplitHostPort(observed)
+	from := net.ParseIP(reporter)
+	if err != nil || net.ParseIP(host) == nil || from == nil {
+		return
+	}
+	_, subnet := subnetOf(from)
+	k.observedMutex.Lock()
+	defer k.observedMutex.Unlock()
+	if _, ok := k.observed[subnet]; ok == false && len(k.observed) >= OBSERVED_MAX {
+		oldest := ""
+		for key, obs := range k.observed {
+			if oldest == "" || obs.seen.Before(k.observed[oldest].seen) {
+				oldest = key
+			}
+		}
+		delete(k.observed, oldest)
+	}
+	k.observed[subnet] = observation{ip: net.ParseIP(host).String(), seen: time.Now()}
+}
+
+// the IP most reporters saw our requests come from lately, nil until
+// OBSERVED_QUORUM of them agree on one that more than half of them report
+func (k *Kademlia) ObservedIP() net.IP {
+	k.observedMutex.Lock()
+	defer k.observedMutex.Unlock()
+	counts := make(map[string]int)
+	total := 0
+	for key, obs := range k.observed {
+		if time.Since(obs.seen) > OBSERVED_MINUTES*time.Minute {
+			delete(k.observed, key)
+			continue
+		}
+		counts[obs.ip] += 1
+		total += 1
+	}
+	for ip, count := range counts {
+		if count >= OBSERVED_QUORUM && 2*count > total {
+			return net.ParseIP(ip)
+		}
+	}
+	return nil
+}
+
+// ask up to OBSERVED_PROBES of our closest contacts where they see us,
+// without telling them who we are
+func (k *Kademlia) probeObserved() {
+	var wg sync.WaitGroup
+	for _, node := range k.FindCloseNodes(k.NodeID, k.NodeID, OBSERVED_PROBES) {
+		// a relayed node sees the relay's address, not ours
+		if node.Relay != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(node FoundNode) {
+			defer wg.Done()
+			client, err := k.dialNode(node)
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			ping := Ping{MsgID: NewRandomID()}
+			var pong Pong
+			if client.Call("Kademlia.Ping", ping, &pong) == nil && ping.MsgID.Equals(pong.MsgID) {
+				k.observe(node.IPAddr, pong.Observed)
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+// whether other nodes see us at an address me doesn't advertise
+func (k *Kademlia) BehindNAT(me Contact) bool {
+	observed := k.ObservedIP()
+	if observed == nil || observed.Equal(me.Host) {
+		return false
+	}
+	for _, addr := range me.Addrs {
+		if ip, _, err := ParseHostPort(addr); err == nil && observed.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package kademlia
+
+// Ownership and permissions for the DFS. Inodes carry the ed25519 public key
+// of their owner and unix style mode bits. Conditional stores of directory
+// inodes are signed, and the storing nodes refuse updates to an owned
+// directory unless the signer is the owner, or the directory is writable by
+// others and the update leaves owner and mode alone. File inodes are
+// immutable, so changing a file means changing its directory entry. Every
+// entry carries a copy of its inode's owner and mode, which lets the storing
+// nodes check the bits of files and subdirectories too. Read bits are
+// advisory, use encryption to keep contents private.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// modes of newly created inodes
+const DFS_DIR_MODE = 0755
+const DFS_FILE_MODE = 0644
+
+// write permission for everybody but the owner
+const modeOtherWrite = 0002
+
+var ErrPermission = errors.New("Permission denied")
+
+// set the key used to sign DFS updates, its public half becomes the owner of
+// everything we create
+func (k *Kademlia) SetSigningKey(priv ed25519.PrivateKey) {
+	k.signKey = priv
+}
+
+func (k *Kademlia) SigningPublicKey() []byte {
+	if k.signKey == nil {
+		return nil
+	}
+	return []byte(k.signKey.Public().(ed25519.PublicKey))
+}
+
+// load the hex encoded ed25519 seed at path, generating and saving a new one
+// if the file doesn't exist yet
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600)
+		return priv, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid signing key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// what a conditional store signature covers
+func casMessage(key ID, version uint64, value []byte) []byte {
+	sum := sha256.Sum256(value)
+	msg := make([]byte, 0, 8+IDBytes+8+len(sum))
+	msg = append(msg, []byte("KDFS-CAS")...)
+	msg = append(msg, key[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, version)
+	return append(msg, sum[:]...)
+}
+
+func (k *Kademlia) signCompareAndStore(req *CompareAndStoreRequest) {
+	if k.signKey == nil {
+		return
+	}
+	req.Signer = k.SigningPublicKey()
+	req.Signature = ed25519.Sign(k.signKey, casMessage(req.Key, req.Version, req.Value))
+}
+
+// whether key may change entries of an inode with meta, unowned inodes are
+// writable by anybody
+func canWrite(meta MetaData, key []byte) bool {
+	if len(meta.Owner) == 0 || meta.Mode&modeOtherWrite != 0 {
+		return true
+	}
+	return bytes.Equal(meta.Owner, key)
+}
+
+// the owner and mode of a file or directory as its entry in the parent
+// records them, entries of unowned inodes and entries in a trash have none and
+// are unprotected
+type EntryPerm struct {
+	Owner []byte
+	Mode  uint32
+}
+
+func entryPerm(meta MetaData) EntryPerm {
+	if len(meta.Owner) == 0 {
+		return EntryPerm{}
+	}
+	return EntryPerm{Owner: meta.Owner, Mode: meta.Mode}
+}
+
+// point the entry name of dir at key
+func linkEntry(dir *DirInode, name string, key ID, perm EntryPerm) {
+	dir.Files[name] = key
+	if len(perm.Owner) == 0 {
+		delete(dir.Perms, name)
+		return
+	}
+	if dir.Perms == nil {
+		dir.Perms = make(map[string]EntryPerm)
+	}
+	dir.Perms[name] = perm
+}
+
+func unlinkEntry(dir *DirInode, name string) {
+	delete(dir.Files, name)
+	delete(dir.Perms, name)
+}
+
+// node side check of a conditional store replacing the DFS value old. Besides
+// the directory's own bits, an owned entry can only be replaced by its owner
+// or with its others write bit, keeping owner and mode, and only removed,
+// which includes renaming it, by its owner, the directory's owner or with its
+// others write bit
+func checkDirUpdate(old []byte, req CompareAndStoreRequest) error {
+	oldDir := new(DirInode)
+	if decodeDFS(old, oldDir) != nil {
+		return nil
+	}
+	var signer []byte
+	if len(req.Signer) == ed25519.PublicKeySize &&
+		ed25519.Verify(req.Signer, casMessage(req.Key, req.Version, req.Value), req.Signature) {
+		signer = req.Signer
+	}
+	// a value that isn't a directory removes every entry
+	newDir := new(DirInode)
+	decodeDFS(req.Value, newDir)
+
+	owned := len(oldDir.Meta.Owner) > 0
+	dirOwner := owned && bytes.Equal(oldDir.Meta.Owner, signer)
+	if owned && dirOwner == false {
+		// others may add and remove entries but not take the directory over
+		if signer == nil || oldDir.Meta.Mode&modeOtherWrite == 0 ||
+			bytes.Equal(newDir.Meta.Owner, oldDir.Meta.Owner) == false || newDir.Meta.Mode != oldDir.Meta.Mode {
+			return ErrPermission
+		}
+	}
+	for name, key := range oldDir.Files {
+		perm := oldDir.Perms[name]
+		if len(perm.Owner) == 0 || bytes.Equal(perm.Owner, signer) {
+			continue
+		}
+		otherWrite := perm.Mode&modeOtherWrite != 0
+		newKey, ok := newDir.Files[name]
+		if ok == false {
+			if dirOwner || otherWrite {
+				continue
+			}
+			return ErrPermission
+		}
+		newPerm := newDir.Perms[name]
+		if bytes.Equal(newPerm.Owner, perm.Owner) == false || newPerm.Mode != perm.Mode {
+			return ErrPermission
+		}
+		if newKey.Equals(key) == false && otherWrite == false {
+			return ErrPermission
+		}
+	}
+	return nil
+}
+
+// node side check of a plain store replacing old, owned directories and
+// directories with owned entries can only be changed by signed conditional
+// stores
+func checkStoreOverwrite(old []byte, value []byte) error {
+	if bytes.Equal(old, value) {
+		return nil
+	}
+	oldDir := new(DirInode)
+	if decodeDFS(old, oldDir) == nil && (len(oldDir.Meta.Owner) > 0 || len(oldDir.Perms) > 0) {
+		return ErrPermission
+	}
+	return nil
+}
+
+// Chmod
+type ChmodRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Path      string
+	Mode      uint32
+	RootInode DirInode
+	RootKey   ID
+}
+
+type ChmodResult struct {
+	MsgID ID
+	Key   ID
+	Err   error
+}
+
+func (k *Kademlia) Chmod(req ChmodRequest, res *ChmodResult) {
+	res.MsgID = CopyID(req.MsgID)
+	res.Key, res.Err = k.changeMeta(req.Sender, req.MsgID, req.Path, req.RootInode, req.RootKey,
+		func(meta *MetaData) { meta.Mode = req.Mode & 0777 })
+}
+
+// Chown
+// Owner is the ed25519 public key of the new owner
+type ChownRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Path      string
+	Owner     []byte
+	RootInode DirInode
+	RootKey   ID
+}
+
+type ChownResult struct {
+	MsgID ID
+	Key   ID
+	Err   error
+}
+
+func (k *Kademlia) Chown(req ChownRequest, res *ChownResult) {
+	res.MsgID = CopyID(req.MsgID)
+	if len(req.Owner) != ed25519.PublicKeySize {
+		res.Err = errors.New("Invalid owner key")
+		return
+	}
+	res.Key, res.Err = k.changeMeta(req.Sender, req.MsgID, req.Path, req.RootInode, req.RootKey,
+		func(meta *MetaData) { meta.Owner = req.Owner })
+}
+
+// apply change to the metadata of the inode at path, only its owner may do
+// this. Directories are updated in place, files get a new inode which
+// replaces the old one in the parent directory
+func (k *Kademlia) changeMeta(sender Contact, msgID ID, path string, rootInode DirInode, rootKey ID,
+	change func(*MetaData)) (ID, error) {
+	dirPath, name := splitPath(path)
+	if name == "" {
+		// the root itself
+		root, err := k.findDirPath(sender, msgID, "/", rootInode, rootKey)
+		if err != nil {
+			return ID{}, err
+		}
+		return root.Key, k.changeDirMeta(sender, msgID, root.Key, change)
+	}
+	parent, err := k.findDirPath(sender, msgID, dirPath, rootInode, rootKey)
+	if err != nil {
+		return ID{}, err
+	}
+	key, ok := parent.Inode.Files[name]
+	if ok == false || name == ".." {
+		return ID{}, ErrFileNotFound
+	}
+	inode := new(FileInode)
+	if err = k.findContent(sender, msgID, key, inode); err != nil {
+		return ID{}, err
+	}
+	if len(inode.Meta.Owner) > 0 && bytes.Equal(inode.Meta.Owner, k.SigningPublicKey()) == false {
+		return ID{}, ErrPermission
+	}
+	if inode.Meta.IsDir {
+		if err = k.changeDirMeta(sender, msgID, key, change); err != nil {
+			return ID{}, err
+		}
+		// the entry in the parent keeps a copy of owner and mode
+		change(&inode.Meta)
+		return key, k.updateDirInode(sender, msgID, parent.Key, func(dir *DirInode) error {
+			if cur, ok := dir.Files[name]; ok == false || cur.Equals(key) == false {
+				return dfsError("Directory changed during update", ErrConflict)
+			}
+			linkEntry(dir, name, key, entryPerm(inode.Meta))
+			return nil
+		})
+	}
+
+	change(&inode.Meta)
+	newKey, err := k.storeContent(sender, msgID, *inode)
+	if err != nil {
+		return ID{}, err
+	}
+	err = k.updateDirInode(sender, msgID, parent.Key, func(dir *DirInode) error {
+		if cur, ok := dir.Files[name]; ok == false || cur.Equals(key) == false {
+			return dfsError("File changed during update", ErrConflict)
+		}
+		linkEntry(dir, name, newKey, entryPerm(inode.Meta))
+		return nil
+	})
+	return newKey, err
+}
+
+func (k *Kademlia) changeDirMeta(sender Contact, msgID ID, key ID, change func(*MetaData)) error {
+	return k.updateDirInode(sender, msgID, key, func(dir *DirInode) error {
+		if len(dir.Meta.Owner) > 0 && bytes.Equal(dir.Meta.Owner, k.SigningPublicKey()) == false {
+			return ErrPermission
+		}
+		change(&dir.Meta)
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package kademlia
+
+// Crypto puzzles for node IDs, as in S/Kademlia. A node's ID must be the
+// KeyNodeID of an ed25519 key it holds and, for the static puzzle, the SHA-1
+// of the ID must have Static zero bits, counted like PrefixLen. Since the ID
+// follows from the key, a node can't pick where it lands, only try keys until
+// one solves the puzzle. The dynamic puzzle asks for a Nonce whose xor with
+// the ID hashes to Dynamic zero bits, which can be made harder later without
+// changing IDs. Contacts carry the key and nonce and UpdateContacts checks
+// them once SetPuzzle was called. Anyone can copy another node's key and
+// nonce though, only TLS makes a peer prove it holds the key, so a node using
+// puzzles only serves over TLS with a certificate for its ID.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// default difficulties, in zero bits
+const PUZZLE_STATIC_BITS = 12
+const PUZZLE_DYNAMIC_BITS = 16
+
+var ErrPuzzle = errors.New("Node ID does not solve the crypto puzzle")
+var ErrPuzzleTLS = errors.New("Node ID puzzles need TLS")
+
+// zero difficulties disable the checks
+type Puzzle struct {
+	Static  int
+	Dynamic int
+}
+
+func (p Puzzle) enabled() bool {
+	return p.Static > 0 || p.Dynamic > 0
+}
+
+func puzzleStaticBits(id ID) int {
+	return FromBytes(id[:]).PrefixLen()
+}
+
+func puzzleDynamicBits(id ID, nonce ID) int {
+	x := id.Xor(nonce)
+	return FromBytes(x[:]).PrefixLen()
+}
+
+// generate keys until one's node ID solves the static puzzle
+func GeneratePuzzleKey(p Puzzle) (ed25519.PrivateKey, error) {
+	for {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if puzzleStaticBits(KeyNodeID(pub)) >= p.Static {
+			return priv, nil
+		}
+	}
+}
+
+// a nonce solving the dynamic puzzle for id
+func SolveDynamicPuzzle(id ID, bits int) ID {
+	var nonce ID
+	for puzzleDynamicBits(id, nonce) < bits {
+		for i := 0; i < IDBytes; i++ {
+			nonce[i] += 1
+			if nonce[i] != 0 {
+				break
+			}
+		}
+	}
+	return nonce
+}
+
+// load the hex encoded ed25519 seed at path like LoadSigningKey, generating a
+// key that solves the static puzzle if the file doesn't exist. With path
+// empty the key isn't saved
+func LoadPuzzleKey(path string, p Puzzle) (ed25519.PrivateKey, error) {
+	var err error
+	if path != "" {
+		_, err = os.Stat(path)
+	}
+	if path == "" || os.IsNotExist(err) {
+		priv, err := GeneratePuzzleKey(p)
+		if err != nil || path == "" {
+			return priv, err
+		}
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600)
+		return priv, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	priv, err := LoadSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if puzzleStaticBits(KeyNodeID(priv.Public().(ed25519.PublicKey))) < p.Static {
+		return nil, errors.New("Key in " + path + " does not solve the static puzzle")
+	}
+	return priv, nil
+}
+
+// check that con's node ID is its key's and solves p
+func VerifyPuzzle(con Contact, p Puzzle) error {
+	if len(con.PublicKey) != ed25519.PublicKeySize {
+		return ErrPuzzle
+	}
+	id := KeyNodeID(ed25519.PublicKey(con.PublicKey))
+	if id.Equals(con.NodeID) == false {
+		return ErrPuzzle
+	}
+	if puzzleStaticBits(id) < p.Static || puzzleDynamicBits(id, con.Nonce) < p.Dynamic {
+		return ErrPuzzle
+	}
+	return nil
+}
+
+// take our node ID from key, solving the dynamic puzzle of p, and only admit
+// contacts solving p to our buckets. Must be called before joining and before
+// SetTLS, which is needed to serve and takes a certificate for key's ID
+func (k *Kademlia) SetPuzzle(key ed25519.PrivateKey, p Puzzle) error {
+	pub := key.Public().(ed25519.PublicKey)
+	id := KeyNodeID(pub)
+	if puzzleStaticBits(id) < p.Static {
+		return ErrPuzzle
+	}
+	k.NodeID = id
+	k.puzzleKey = []byte(pub)
+	k.puzzlePrivate = key
+	k.puzzleNonce = SolveDynamicPuzzle(id, p.Dynamic)
+	k.puzzle = p
+	return nil
+}
+
+// add our puzzle solution to con, a contact for us
+func (k *Kademlia) ProvePuzzle(con *Contact) {
+	con.PublicKey = k.puzzleKey
+	con.Nonce = k.puzzleNonce
+}
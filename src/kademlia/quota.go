@@ -0,0 +1,175 @@
+package kademlia
+
+// Limits on what other nodes may store here. A single value can't exceed
+// MaxValueSize, all values together are kept under Quota by evicting the
+// values farthest from our ID, which we are the least responsible for, and
+// each sender, told apart by its IP since node IDs cost nothing, may only
+// store so many values and bytes per window.
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// default limits, see StorageLimits
+const MAX_VALUE_SIZE = 4 * 1024 * 1024
+const STORAGE_QUOTA = 256 * 1024 * 1024
+const SENDER_STORES = 1000
+const SENDER_BYTES = 64 * 1024 * 1024
+const SENDER_WINDOW_SECONDS = 60
+
+var ErrValueTooLarge = errors.New("Value too large")
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+var ErrSenderLimit = errors.New("Sender exceeded its store limit")
+
+// sizes are in bytes, zero disables a limit. An IP may make SenderStores
+// stores of SenderBytes bytes in total every SenderWindow
+type StorageLimits struct {
+	MaxValueSize int
+	Quota        int
+	SenderStores int
+	SenderBytes  int
+	SenderWindow time.Duration
+}
+
+func DefaultStorageLimits() StorageLimits {
+	return StorageLimits{MaxValueSize: MAX_VALUE_SIZE,
+		Quota:        STORAGE_QUOTA,
+		SenderStores: SENDER_STORES,
+		SenderBytes:  SENDER_BYTES,
+		SenderWindow: SENDER_WINDOW_SECONDS * time.Second}
+}
+
+func (k *Kademlia) SetStorageLimits(limits StorageLimits) {
+	k.storedDataMutex.Lock()
+	k.limits = limits
+	k.storedDataMutex.Unlock()
+}
+
+// what a sender stored in the current window
+type senderUsage struct {
+	start  time.Time
+	stores int
+	bytes  int
+}
+
+// the usage of the IP of remote, the HOST:PORT address a store of size bytes
+// came from, or an error if the store would take it over its limits. Our own
+// stores, with remote empty, and those from loopback aren't counted and get no
+// usage. Must be called with storedDataMutex held, which also keeps the usage
+// until the store is charged to it
+func (k *Kademlia) checkSender(remote string, size int) (*senderUsage, error) {
+	limits := k.limits
+	ip := remoteIP(remote)
+	if parsed := net.ParseIP(ip); remote == "" || (parsed != nil && parsed.IsLoopback()) {
+		return nil, nil
+	}
+
+	k.sendersMutex.Lock()
+	defer k.sendersMutex.Unlock()
+	usage, ok := k.senders[ip]
+	if ok == false || time.Since(usage.start) > limits.SenderWindow {
+		if ok == false && len(k.senders) >= MAX_RATE_BUCKETS {
+			return nil, ErrSenderLimit
+		}
+		usage = &senderUsage{start: time.Now()}
+		k.senders[ip] = usage
+	}
+	if (limits.SenderStores > 0 && usage.stores+1 > limits.SenderStores) ||
+		(limits.SenderBytes > 0 && usage.bytes+size > limits.SenderBytes) {
+		return nil, ErrSenderLimit
+	}
+	return usage, nil
+}
+
+// count an admitted store of size bytes against usage, see checkSender
+func (k *Kademlia) chargeSender(usage *senderUsage, size int) {
+	if usage == nil {
+		return
+	}
+	k.sendersMutex.Lock()
+	usage.stores, usage.bytes = usage.stores+1, usage.bytes+size
+	k.sendersMutex.Unlock()
+}
+
+// store val under key for the peer at remote, the only way values from peers
+// are stored: the store must fit the sender's limits and our quota, and is
+// charged to the sender once it does. Must be called with storedDataMutex held
+func (k *Kademlia) storeCharged(key ID, val TimeValue, remote string) error {
+	usage, err := k.checkSender(remote, len(val.Data))
+	if err != nil {
+		return err
+	}
+	if err := k.admitValue(key, len(val.Data)); err != nil {
+		return err
+	}
+	k.chargeSender(usage, len(val.Data))
+	k.putValue(key, val)
+	return nil
+}
+
+// forget senders whose window is over
+func (k *Kademlia) expireSenders() {
+	k.storedDataMutex.Lock()
+	window := k.limits.SenderWindow
+	k.storedDataMutex.Unlock()
+
+	k.sendersMutex.Lock()
+	for ip, usage := range k.senders {
+		if time.Since(usage.start) > window {
+			delete(k.senders, ip)
+		}
+	}
+	k.sendersMutex.Unlock()
+}
+
+// check that size bytes may be stored under key, evicting farther values if
+// the quota requires. Must be called with storedDataMutex held
+func (k *Kademlia) admitValue(key ID, size int) error {
+	if k.limits.MaxValueSize > 0 && size > k.limits.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	need := k.storedBytes + size - len(k.StoredData[key].Data) - k.limits.Quota
+	if k.limits.Quota == 0 || need <= 0 {
+		return nil
+	}
+
+	// only values farther from us than the new one make way for it
+	dist := key.Xor(k.NodeID)
+	farther := make([]ID, 0)
+	for other := range k.StoredData {
+		if dist.Less(other.Xor(k.NodeID)) {
+			farther = append(farther, other)
+		}
+	}
+	sort.Slice(farther, func(i, j int) bool {
+		return farther[j].Xor(k.NodeID).Less(farther[i].Xor(k.NodeID))
+	})
+	freed, evict := 0, 0
+	for evict < len(farther) && freed < need {
+		freed += len(k.StoredData[farther[evict]].Data)
+		evict += 1
+	}
+	if freed < need {
+		return ErrQuotaExceeded
+	}
+	for _, other := range farther[:evict] {
+		k.dropValue(other)
+	}
+	return nil
+}
+
+// set the value under key keeping track of the bytes used, must be called
+// with storedDataMutex held
+func (k *Kademlia) putValue(key ID, val TimeValue) {
+	k.storedBytes += len(val.Data) - len(k.StoredData[key].Data)
+	k.StoredData[CopyID(key)] = val
+}
+
+// remove the value under key, must be called with storedDataMutex held
+func (k *Kademlia) dropValue(key ID) {
+	k.storedBytes -= len(k.StoredData[key].Data)
+	delete(k.StoredData, key)
+}
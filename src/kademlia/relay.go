@@ -0,0 +1,435 @@
+package kademlia
+
+// Relaying for nodes that can't accept connections. Such a node dials a
+// reachable relay at RELAY_PATH and keeps the connection open, the relay
+// then acts as the client on it and the relayed node answers RPCs over it.
+// The relayed node advertises the relay's address in its contact's Relay
+// field. Others reach it by calling Kademlia.Relay on the relay, which
+// passes the gob encoded call on as a Kademlia.Relayed call, see relayCodec.
+// Before relaying, the relay has the node sign a challenge with its node ID's
+// key when puzzles are on, otherwise with a key it makes up, and a
+// registration that still answers can only be taken over with the same key.
+// Over TLS the certificate has proven the node ID already.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const RELAY_PATH = "/_kadRelay_"
+
+// how many nodes a relay serves at most
+const MAX_RELAYED = 32
+
+// how long a relayed node waits before reconnecting to its relay
+const RELAY_RETRY_SECONDS = 5
+
+// how long a relay waits for a node to prove itself
+const RELAY_PROOF_SECONDS = 5
+
+var ErrNotRelayed = errors.New("Node is not relayed here")
+
+// RELAY
+// Args is the gob encoded argument of Method, Reply the gob encoded reply
+type RelayRequest struct {
+	Sender Contact
+	MsgID  ID
+	Target ID
+	Method string
+	Args   []byte
+}
+
+type RelayResult struct {
+	MsgID ID
+	Reply []byte
+	Err   error
+}
+
+func (k *Kademlia) Relay(req RelayRequest, res *RelayResult) error {
+	return k.relay(req, res, "")
+}
+
+// pass on a call that came from remote
+func (k *Kademlia) relay(req RelayRequest, res *RelayResult, remote string) error {
+	k.queueContact(req.Sender)
+	res.MsgID = CopyID(req.MsgID)
+	k.relayMutex.Lock()
+	node, ok := k.relayed[req.Target]
+	k.relayMutex.Unlock()
+	if ok == false {
+		res.Err = wireError(ErrNotRelayed)
+		return nil
+	}
+	client := node.client
+
+	call := RelayedCall{Sender: req.Sender, Remote: remote, Method: req.Method, Args: req.Args}
+	reply := new(RelayedReply)
+	err := client.Call("Kademlia.Relayed", call, reply)
+	if err == rpc.ErrShutdown {
+		// the relayed node went away
+		k.relayMutex.Lock()
+		if k.relayed[req.Target] == node {
+			delete(k.relayed, req.Target)
+		}
+		k.relayMutex.Unlock()
+		err = ErrNotRelayed
+	}
+	if err != nil {
+		res.Err = wireError(callError(err))
+		return nil
+	}
+	res.Reply = reply.Reply
+	res.Err = reply.Err
+	return nil
+}
+
+// RELAYED
+// what a relay passes on to the node it relays for, Sender is the Sender of
+// the Relay call, which the call passed on must have too, and Remote the
+// address the relay saw the call come from
+type RelayedCall struct {
+	Sender Contact
+	Remote string
+	Method string
+	Args   []byte
+}
+
+// Err is set when the call couldn't be made, errors of the call itself are in
+// its encoded reply
+type RelayedReply struct {
+	Reply []byte
+	Err   error
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// make the call our relay passed on, any method served to peers may be
+// called. It is answered as if it came straight from call.Remote, but a relay
+// can't have its calls treated as our own or a local node's: with Remote empty
+// or loopback they are answered as coming from the relay
+func (r *relayedKademlia) Relayed(call RelayedCall, reply *RelayedReply) error {
+	remote := call.Remote
+	if ip := net.ParseIP(remoteIP(remote)); ip == nil || ip.IsLoopback() {
+		remote = r.remote
+	}
+	name := strings.TrimPrefix(call.Method, "Kademlia.")
+	method := reflect.ValueOf(&peerKademlia{k: r.k, remote: remote}).MethodByName(name)
+	if method.IsValid() == false || strings.HasPrefix(call.Method, "Kademlia.") == false {
+		reply.Err = wireError(errors.New("Unknown method " + call.Method))
+		return nil
+	}
+	typ := method.Type()
+	if typ.NumIn() != 2 || typ.In(1).Kind() != reflect.Ptr || typ.NumOut() != 1 || typ.Out(0) != errorType {
+		reply.Err = wireError(errors.New("Unknown method " + call.Method))
+		return nil
+	}
+
+	args := reflect.New(typ.In(0))
+	if err := gob.NewDecoder(bytes.NewReader(call.Args)).DecodeValue(args); err != nil {
+		reply.Err = wireError(err)
+		return nil
+	}
+	if sender, ok := requestSender(args.Interface()); ok && sender.NodeID.Equals(call.Sender.NodeID) == false {
+		reply.Err = wireError(ErrSenderMismatch)
+		return nil
+	}
+	res := reflect.New(typ.In(1).Elem())
+	out := method.Call([]reflect.Value{args.Elem(), res})
+	if err, _ := out[0].Interface().(error); err != nil {
+		reply.Err = wireError(err)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(res); err != nil {
+		reply.Err = wireError(err)
+		return nil
+	}
+	reply.Reply = buf.Bytes()
+	return nil
+}
+
+// take over a connection from a node asking us to relay for it
+func (k *Kademlia) acceptRelayed(w http.ResponseWriter, req *http.Request) {
+	id, err := FromString(req.URL.Query().Get("id"))
+	if req.Method != "CONNECT" || err != nil {
+		http.Error(w, "Invalid relay request", http.StatusBadRequest)
+		return
+	}
+	// over TLS only the node itself may ask
+	if req.TLS != nil {
+		if len(req.TLS.PeerCertificates) == 0 {
+			http.Error(w, "No certificate", http.StatusForbidden)
+			return
+		}
+		if peer, err := CertNodeID(req.TLS.PeerCertificates[0]); err != nil || peer.Equals(id) == false {
+			http.Error(w, ErrSenderMismatch.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	k.relayMutex.Lock()
+	if _, ok := k.relayed[id]; ok == false && len(k.relayed) >= MAX_RELAYED {
+		k.relayMutex.Unlock()
+		http.Error(w, "Too many relayed nodes", http.StatusServiceUnavailable)
+		return
+	}
+	k.relayMutex.Unlock()
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+	node := &relayedNode{client: rpc.NewClient(conn)}
+	if node.key, err = k.challengeRelayed(id, conn, node.client); err != nil {
+		node.client.Close()
+		return
+	}
+	k.relayMutex.Lock()
+	old, ok := k.relayed[id]
+	k.relayMutex.Unlock()
+	if ok && bytes.Equal(old.key, node.key) == false && old.alive() {
+		node.client.Close()
+		return
+	}
+	k.relayMutex.Lock()
+	if old, ok := k.relayed[id]; ok {
+		old.client.Close()
+	}
+	k.relayed[id] = node
+	k.relayMutex.Unlock()
+}
+
+// a node we relay for and the key it proved itself with
+type relayedNode struct {
+	client *rpc.Client
+	key    []byte
+}
+
+// whether the node still answers over its connection
+func (n *relayedNode) alive() bool {
+	call := n.client.Go("Kademlia.Ping", Ping{MsgID: NewRandomID()}, new(Pong), nil)
+	select {
+	case <-call.Done:
+		return call.Error == nil
+	case <-time.After(RELAY_PROOF_SECONDS * time.Second):
+		return false
+	}
+}
+
+func relayMessage(id ID, nonce ID) []byte {
+	msg := make([]byte, 0, 9+2*IDBytes)
+	msg = append(msg, []byte("KAD-RELAY")...)
+	msg = append(msg, id[:]...)
+	return append(msg, nonce[:]...)
+}
+
+// have the node asking to be relayed as id sign a challenge over client,
+// returning the key it signed with
+func (k *Kademlia) challengeRelayed(id ID, conn net.Conn, client *rpc.Client) ([]byte, error) {
+	challenge := RelayChallenge{Nonce: NewRandomID()}
+	proof := new(RelayProof)
+	conn.SetDeadline(time.Now().Add(RELAY_PROOF_SECONDS * time.Second))
+	err := client.Call("Kademlia.ProveRelayed", challenge, proof)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if verifySignature(proof.PublicKey, relayMessage(id, challenge.Nonce), proof.Signature) == false {
+		return nil, ErrSenderMismatch
+	}
+	if k.puzzle.enabled() && KeyNodeID(ed25519.PublicKey(proof.PublicKey)).Equals(id) == false {
+		return nil, ErrPuzzle
+	}
+	return proof.PublicKey, nil
+}
+
+// PROVE_RELAYED
+// only served on a node's connection to its relay, see relayedKademlia
+type RelayChallenge struct {
+	Nonce ID
+}
+
+type RelayProof struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// the RPC receiver on our connection to our relay, which also answers the
+// relay's challenge and the calls it passes on. It isn't served anywhere
+// else, so nobody else can have us sign one or pass calls off as relayed
+type relayedKademlia struct {
+	*peerKademlia
+}
+
+func (r *relayedKademlia) ProveRelayed(challenge RelayChallenge, proof *RelayProof) error {
+	key, err := r.k.relayKey()
+	if err != nil {
+		return err
+	}
+	proof.PublicKey = key.Public().(ed25519.PublicKey)
+	proof.Signature = ed25519.Sign(key, relayMessage(r.k.NodeID, challenge.Nonce))
+	return nil
+}
+
+// the key we prove ourselves to relays with, our node ID's with puzzles on
+func (k *Kademlia) relayKey() (ed25519.PrivateKey, error) {
+	if k.puzzlePrivate != nil {
+		return k.puzzlePrivate, nil
+	}
+	k.relayMutex.Lock()
+	defer k.relayMutex.Unlock()
+	if k.relayIdentity == nil {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.relayIdentity = priv
+	}
+	return k.relayIdentity, nil
+}
+
+// connect to the relay at addr and answer the calls it passes on
+func (k *Kademlia) connectRelay(addr string) (net.Conn, error) {
+	conn, err := k.dialConn(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = httpConnect(conn, RELAY_PATH+"?id="+k.NodeID.AsString()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (k *Kademlia) serveRelay(conn net.Conn) {
+	server := rpc.NewServer()
+	server.RegisterName("Kademlia", &relayedKademlia{&peerKademlia{k: k, remote: conn.RemoteAddr().String()}})
+	server.ServeConn(conn)
+}
+
+// serve conn to relay, reconnecting whenever it breaks
+func (k *Kademlia) keepRelay(relay string, conn net.Conn) {
+	for {
+		k.serveRelay(conn)
+		var err error
+		for {
+			time.Sleep(RELAY_RETRY_SECONDS * time.Second)
+			if conn, err = k.connectRelay(relay); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// have the relay at addr, a HOST:PORT address, relay for us. With addr empty
+// the closest contact that agrees is used. Returns the relay's address, the
+// connection is kept up in the background
+func (k *Kademlia) StartRelay(addr string) (string, error) {
+	candidates := []string{addr}
+	if addr == "" {
+		candidates = candidates[:0]
+		for _, node := range k.FindCloseNodes(k.NodeID, k.NodeID, K) {
+			if node.Relay == "" {
+				candidates = append(candidates, foundNodeToAddrStr(node))
+			}
+		}
+	}
+	err := ErrNotRelayed
+	for _, relay := range candidates {
+		var conn net.Conn
+		if conn, err = k.connectRelay(relay); err != nil {
+			continue
+		}
+		go k.keepRelay(relay, conn)
+		return relay, nil
+	}
+	return "", err
+}
+
+// a client codec sending each call through a relay as a Kademlia.Relay call
+type relayCodec struct {
+	relay   *rpc.Client
+	target  ID
+	replies chan relayReply
+	done    chan bool
+	cur     relayReply
+}
+
+type relayReply struct {
+	seq    uint64
+	method string
+	reply  []byte
+	err    error
+}
+
+func (c *relayCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+	req := RelayRequest{MsgID: NewRandomID(), Target: c.target, Method: r.ServiceMethod, Args: buf.Bytes()}
+	req.Sender, _ = requestSender(body)
+	seq, method := r.Seq, r.ServiceMethod
+	go func() {
+		res := new(RelayResult)
+		err := c.relay.Call("Kademlia.Relay", req, res)
+		if err != nil {
+			err = callError(err)
+		} else if res.Err != nil {
+			err = res.Err
+		}
+		select {
+		case c.replies <- relayReply{seq: seq, method: method, reply: res.Reply, err: err}:
+		case <-c.done:
+		}
+	}()
+	return nil
+}
+
+func (c *relayCodec) ReadResponseHeader(r *rpc.Response) error {
+	select {
+	case c.cur = <-c.replies:
+	case <-c.done:
+		return io.EOF
+	}
+	r.Seq, r.ServiceMethod = c.cur.seq, c.cur.method
+	if c.cur.err != nil {
+		r.Error = c.cur.err.Error()
+	}
+	return nil
+}
+
+func (c *relayCodec) ReadResponseBody(body interface{}) error {
+	if body == nil || c.cur.err != nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(c.cur.reply)).Decode(body)
+}
+
+func (c *relayCodec) Close() error {
+	close(c.done)
+	return c.relay.Close()
+}
+
+// a client for node reached through its relay
+func (k *Kademlia) dialRelayed(node FoundNode) (*rpc.Client, error) {
+	relay, err := k.dialRPC(node.Relay, nil)
+	if err != nil {
+		return nil, err
+	}
+	codec := &relayCodec{relay: relay,
+		target:  CopyID(node.NodeID),
+		replies: make(chan relayReply),
+		done:    make(chan bool)}
+	return rpc.NewClientWithCodec(codec), nil
+}
@@ -5,19 +5,26 @@ package kademlia
 // other groups' code.
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"net"
-	"net/rpc"
-	"sort"
+	"sync"
 	"time"
 )
 
-// Host identification.
+// Host identification. Addrs holds other HOST:PORT addresses the node is
+// reachable on, see addr.go. Unreachable nodes, e.g. behind NAT, aren't
+// added to buckets, see nat.go, unless they are reached through the relay at
+// the HOST:PORT address Relay, see relay.go
 type Contact struct {
-	NodeID ID
-	Host   net.IP
-	Port   uint16
+	NodeID      ID
+	Host        net.IP
+	Port        uint16
+	Addrs       []string
+	Unreachable bool
+	Relay       string
+	PublicKey   []byte
+	Nonce       ID
 }
 
 // PING
@@ -26,23 +33,33 @@ type Ping struct {
 	MsgID  ID
 }
 
+// Sender only carries the NodeID of the node answering, the caller knows its
+// address already. Observed is the address the caller's request came from
 type Pong struct {
-	MsgID  ID
-	Sender Contact
+	MsgID    ID
+	Sender   Contact
+	Observed string
 }
 
 func (k *Kademlia) Ping(ping Ping, pong *Pong) error {
-	go k.UpdateContacts(ping.Sender)
+	k.queueContact(ping.Sender)
 	pong.MsgID = CopyID(ping.MsgID)
+	pong.Sender.NodeID = CopyID(k.NodeID)
+	k.ProvePuzzle(&pong.Sender)
 	return nil
 }
 
 // STORE
+// A store may be signed by its Publisher, who can then delete the value
+// again, see tombstone.go
 type StoreRequest struct {
-	Sender Contact
-	MsgID  ID
-	Key    ID
-	Value  []byte
+	Sender    Contact
+	MsgID     ID
+	Key       ID
+	Value     []byte
+	Publisher []byte
+	Published time.Time
+	Signature []byte
 }
 
 type StoreResult struct {
@@ -51,26 +68,62 @@ type StoreResult struct {
 }
 
 func (k *Kademlia) Store(req StoreRequest, res *StoreResult) error {
-	go k.UpdateContacts(req.Sender)
+	return k.serveStore(req, res, "")
+}
+
+// answer a store from the peer at remote, empty for our own
+func (k *Kademlia) serveStore(req StoreRequest, res *StoreResult, remote string) error {
+	k.queueContact(req.Sender)
 	var sliceCopy []byte = make([]byte, len(req.Value))
 	copy(sliceCopy, req.Value)
-	k.storedDataMutex.Lock()
-	k.StoredData[CopyID(req.Key)] = TimeValue{Data: sliceCopy, time: time.Now()}
-	k.storedDataMutex.Unlock()
+	req.Value = sliceCopy
 	res.MsgID = CopyID(req.MsgID)
+	res.Err = wireError(k.storeLocal(req, remote))
 	return nil
 }
 
+// store req.Value on this node if our limits allow it and charge it to the
+// peer at remote, the value must not be changed afterwards
+func (k *Kademlia) storeLocal(req StoreRequest, remote string) error {
+	k.storedDataMutex.Lock()
+	defer k.storedDataMutex.Unlock()
+	if err := k.checkPublication(req); err != nil {
+		return err
+	}
+	old, ok := k.StoredData[req.Key]
+	if ok && isDFSValue(old.Data) {
+		if err := checkStoreOverwrite(old.Data, req.Value); err != nil {
+			return err
+		}
+	}
+	// the first publisher of a value keeps it, only it may store other data
+	// under the key. A plain store keeps the version so it can't undo a
+	// conditional store
+	publisher := req.Publisher
+	if ok && len(old.Publisher) > 0 && bytes.Equal(old.Publisher, req.Publisher) == false {
+		if bytes.Equal(old.Data, req.Value) == false {
+			return ErrPermission
+		}
+		publisher = old.Publisher
+	}
+	return k.storeCharged(req.Key, TimeValue{Data: req.Value, time: time.Now(), Version: old.Version, Publisher: publisher}, remote)
+}
+
 func contactToAddressString(con Contact) string {
-	return fmt.Sprintf("%s:%d", con.Host.String(), con.Port)
+	return JoinHostPort(con.Host.String(), con.Port)
 }
 
 func foundNodeToAddrStr(node FoundNode) string {
-	return fmt.Sprintf("%s:%d", node.IPAddr, node.Port)
+	return JoinHostPort(node.IPAddr, node.Port)
 }
 
-func makeStoreRequest(node FoundNode, req StoreRequest, res *StoreResult) {
-	client, err := rpc.DialHTTP("tcp", foundNodeToAddrStr(node))
+func (k *Kademlia) makeStoreRequest(node FoundNode, req StoreRequest, res *StoreResult) {
+	if len(req.Value) > STREAM_THRESHOLD {
+		res.MsgID = CopyID(req.MsgID)
+		res.Err = k.streamStore(node, req)
+		return
+	}
+	client, err := k.dialNode(node)
 	if err != nil {
 		res.Err = err
 		return
@@ -79,13 +132,14 @@ func makeStoreRequest(node FoundNode, req StoreRequest, res *StoreResult) {
 	defer client.Close()
 	err = client.Call("Kademlia.Store", req, res)
 	if err != nil && res.Err == nil {
-		res.Err = err
+		res.Err = callError(err)
 	}
 }
 
 func (k *Kademlia) IterStore(req StoreRequest, res *StoreResult) FoundNode {
 	//nodes := k.FindCloseContacts(req.Key, k.NodeID, K)
 	res.MsgID = CopyID(req.MsgID)
+	k.signStore(&req)
 	fnReq := FindNodeRequest{Sender: req.Sender, MsgID: NewRandomID(), NodeID: CopyID(req.Key)}
 	fnRes := new(FindNodeResult)
 	k.IterFindNode(fnReq, fnRes)
@@ -100,7 +154,7 @@ func (k *Kademlia) IterStore(req StoreRequest, res *StoreResult) FoundNode {
 
 		localRes := new(StoreResult)
 		for _, node := range fnRes.Nodes {
-			makeStoreRequest(node, req, localRes)
+			k.makeStoreRequest(node, req, localRes)
 			if localRes.Err != nil {
 				res.Err = localRes.Err
 			}
@@ -109,189 +163,252 @@ func (k *Kademlia) IterStore(req StoreRequest, res *StoreResult) FoundNode {
 	return lastNode
 }
 
-// FIND_NODE
-type FindNodeRequest struct {
-	Sender Contact
-	MsgID  ID
-	NodeID ID
+// COMPARE_AND_STORE
+// Replaces the value under Key only if the locally held version equals
+// Version, the stored version then becomes Version+1. A node without the key
+// or behind Version accepts any version so lost or outdated replicas catch up.
+// Updates of owned DFS directories must be signed by Signer, see perm.go
+type CompareAndStoreRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Key       ID
+	Value     []byte
+	Version   uint64
+	Signer    []byte
+	Signature []byte
 }
 
-type FoundNode struct {
-	IPAddr string
-	Port   uint16
-	NodeID ID
+// Version is the version held by the node after the call
+type CompareAndStoreResult struct {
+	MsgID   ID
+	Swapped bool
+	Version uint64
+	Err     error
 }
 
-type FindNodeResult struct {
-	MsgID ID
-	Nodes []FoundNode
-	Err   error
+var ErrVersionMismatch = errors.New("Stored version does not match expected version")
+
+func (k *Kademlia) CompareAndStore(req CompareAndStoreRequest, res *CompareAndStoreResult) error {
+	return k.serveCompareAndStore(req, res, "")
 }
 
-type FindNodeResultWithID struct {
-	Res      FindNodeResult
-	SourceID ID
+// answer a conditional store from the peer at remote, empty for our own
+func (k *Kademlia) serveCompareAndStore(req CompareAndStoreRequest, res *CompareAndStoreResult, remote string) error {
+	k.queueContact(req.Sender)
+	res.MsgID = CopyID(req.MsgID)
+	res.Err = wireError(k.compareAndStore(req, res, remote))
+	return nil
 }
 
-type foundNodeDistance struct {
-	Node      FoundNode
-	PrefixLen int
-	Queried   bool
+func (k *Kademlia) compareAndStore(req CompareAndStoreRequest, res *CompareAndStoreResult, remote string) error {
+	k.storedDataMutex.Lock()
+	defer k.storedDataMutex.Unlock()
+	if k.isDeleted(req.Key) {
+		return ErrDeleted
+	}
+	cur, ok := k.StoredData[req.Key]
+	if ok && cur.Version > req.Version {
+		res.Swapped, res.Version = false, cur.Version
+		return nil
+	}
+	if ok && isDFSValue(cur.Data) {
+		if err := checkDirUpdate(cur.Data, req); err != nil {
+			return err
+		}
+	}
+	var sliceCopy []byte = make([]byte, len(req.Value))
+	copy(sliceCopy, req.Value)
+	val := TimeValue{Data: sliceCopy, time: time.Now(), Version: req.Version + 1, Publisher: cur.Publisher}
+	if err := k.storeCharged(req.Key, val, remote); err != nil {
+		return err
+	}
+	res.Swapped, res.Version = true, req.Version+1
+	return nil
 }
 
-type nodeDistanceVector struct {
-	Closest int
-	Nodes   []foundNodeDistance
+func (k *Kademlia) makeCompareAndStoreRequest(node FoundNode, req CompareAndStoreRequest, res *CompareAndStoreResult) {
+	client, err := k.dialNode(node)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	defer client.Close()
+	err = client.Call("Kademlia.CompareAndStore", req, res)
+	if err != nil && res.Err == nil {
+		res.Err = callError(err)
+	}
 }
 
-func (ndv nodeDistanceVector) Len() int {
-	return len(ndv.Nodes)
+// the K closest nodes to key we know of after a lookup, and whether we are one
+// of them too. Conditional stores and the reads they are based on go to all
+// of them, so every client sees the same replicas however few nodes there are
+func (k *Kademlia) replicaNodes(sender Contact, key ID) ([]FoundNode, bool) {
+	fnReq := FindNodeRequest{Sender: sender, MsgID: NewRandomID(), NodeID: CopyID(key)}
+	fnRes := new(FindNodeResult)
+	k.IterFindNode(fnReq, fnRes)
+	nodes := fnRes.Nodes
+	self := len(nodes) < K || key.Xor(k.NodeID).Less(key.Xor(nodes[len(nodes)-1].NodeID))
+	return nodes, self
 }
 
-func (ndv nodeDistanceVector) Less(i, j int) bool {
-	return ndv.Nodes[i].PrefixLen > ndv.Nodes[j].PrefixLen
+// conditionally stores on the k closest nodes, us included, the swap succeeds
+// if a majority of the nodes that answered accepted it, otherwise res.Err is
+// ErrVersionMismatch and the caller should re-read the value and retry.
+// Like the other Iter methods it has no error result, so net/rpc and Relayed
+// don't serve it to peers
+func (k *Kademlia) IterCompareAndStore(req CompareAndStoreRequest, res *CompareAndStoreResult) {
+	res.MsgID = CopyID(req.MsgID)
+	nodes, self := k.replicaNodes(req.Sender, req.Key)
+
+	accepted, answered, refused := 0, 0, 0
+	count := func(localRes *CompareAndStoreResult) {
+		if localRes.Err != nil {
+			if errors.Is(localRes.Err, ErrPermission) {
+				refused += 1
+			}
+			return
+		}
+		answered += 1
+		if localRes.Swapped {
+			accepted += 1
+		} else if localRes.Version > res.Version {
+			res.Version = localRes.Version
+		}
+	}
+	if self {
+		localRes := new(CompareAndStoreResult)
+		localRes.Err = k.compareAndStore(req, localRes, "")
+		count(localRes)
+	}
+	for _, node := range nodes {
+		localRes := new(CompareAndStoreResult)
+		k.makeCompareAndStoreRequest(node, req, localRes)
+		count(localRes)
+	}
+
+	switch {
+	case refused > answered:
+		res.Err = ErrPermission
+	case answered == 0:
+		res.Err = errors.New("No node answered the conditional store")
+	case 2*accepted > answered:
+		res.Swapped, res.Version = true, req.Version+1
+	default:
+		res.Err = ErrVersionMismatch
+	}
 }
 
-func (ndv nodeDistanceVector) Swap(i, j int) {
-	temp := ndv.Nodes[i]
-	ndv.Nodes[i] = ndv.Nodes[j]
-	ndv.Nodes[j] = temp
+// FIND_NODE
+// With Trace set the iterative lookup records its rounds in the result, with
+// Paths above 1 it follows that many disjoint paths, see lookup.go
+type FindNodeRequest struct {
+	Sender Contact
+	MsgID  ID
+	NodeID ID
+	Trace  bool
+	Paths  int
 }
 
-func makeTimeout(b chan bool, seconds int) {
-	dur, err := time.ParseDuration(fmt.Sprintf("%d s", seconds))
-	if err != nil {
-		dur = 1 * time.Second
-	}
-	time.Sleep(dur)
-	b <- true
+type FoundNode struct {
+	IPAddr string
+	Port   uint16
+	NodeID ID
+	Addrs     []string
+	Relay     string
+	PublicKey []byte
+	Nonce     ID
+}
+
+// Observed is the address the request came from, as in Pong
+type FindNodeResult struct {
+	MsgID    ID
+	Nodes    []FoundNode
+	Trace    *LookupTrace
+	Observed string
+	Err      error
 }
 
 //SPEC: returns up to k triples for the contacts that it knows to be closest to the key
 //      should never return a triple with node id of requestor, or its own id
 //      primitive operation, not an iterative one
 func (k *Kademlia) FindNode(req FindNodeRequest, res *FindNodeResult) error {
-	go k.UpdateContacts(req.Sender)
+	k.queueContact(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
 	res.Nodes = k.FindCloseNodes(req.NodeID, req.Sender.NodeID, MaxBucketSize)
 	return nil
 }
 
-func remoteFindNode(node FoundNode, req FindNodeRequest, res chan FindNodeResultWithID) {
+func (k *Kademlia) remoteFindNode(node FoundNode, req FindNodeRequest) FindNodeResult {
 	retRes := new(FindNodeResult)
-	defer (func() { res <- FindNodeResultWithID{Res: *retRes, SourceID: CopyID(node.NodeID)} })()
-	client, err := rpc.DialHTTP("tcp", foundNodeToAddrStr(node))
+	client, err := k.dialNode(node)
 	if err != nil {
 		retRes.Err = err
-		return
+		return *retRes
 	}
 	req.MsgID = NewRandomID()
 
 	defer client.Close()
 	err = client.Call("Kademlia.FindNode", req, retRes)
 	if err != nil && retRes.Err == nil {
-		retRes.Err = err
+		retRes.Err = callError(err)
 	}
-	if false == req.MsgID.Equals(retRes.MsgID) {
-		retRes.Err = errors.New("Invalid message id returned")
+	if retRes.Err == nil && false == req.MsgID.Equals(retRes.MsgID) {
+		retRes.Err = ErrBadMsgID
+		k.misbehaved(node.NodeID)
 	}
+	return *retRes
 }
 
-func (k *Kademlia) IterFindNode(req FindNodeRequest, res *FindNodeResult) error {
-	// do iterative find node
-	nodes := k.FindCloseNodes(req.NodeID, k.NodeID, K)
+// finds the k closest nodes to req.NodeID that answered
+func (k *Kademlia) IterFindNode(req FindNodeRequest, res *FindNodeResult) {
 	res.MsgID = CopyID(req.MsgID)
-	nodes = nodes[0:ALPHA]
-	ndv := nodeDistanceVector{Nodes: make([]foundNodeDistance, 0, K)}
-	for _, node := range nodes {
-		ndv.Nodes = append(ndv.Nodes, foundNodeDistance{Node: node,
-			PrefixLen: req.NodeID.Xor(node.NodeID).PrefixLen(),
-			Queried:   false})
-	}
-	sort.Sort(ndv) // being lazy
-	ndv.Closest = ndv.Nodes[0].PrefixLen
-	resChan := make(chan FindNodeResultWithID, ALPHA)
-	doneYet := false
-
-	//timeout after 8 seconds
-	timeoutChan := make(chan bool, 1)
-	go makeTimeout(timeoutChan, 8)
-
-	for doneYet == false {
-		queryCount := 0
-		for _, node := range ndv.Nodes {
-			if node.Queried == false {
-				node.Queried, queryCount = true, queryCount+1
-				go remoteFindNode(node.Node, req, resChan)
-				if queryCount == ALPHA {
-					break
-				}
-			}
-		}
-		if queryCount == 0 {
-			doneYet = true
-		}
-		exit := false
-		for i := 0; i < queryCount; i++ {
-			var nodeRes FindNodeResultWithID
-			select {
-			case <-timeoutChan:
-				exit = true
-			case nodeRes = <-resChan:
-			}
-			if exit {
-				doneYet = true
-				break
-			}
-			if nodeRes.Res.Err != nil {
-				for index, node := range ndv.Nodes {
-					if node.Node.NodeID.Equals(nodeRes.SourceID) {
-						ndv.Nodes = append(ndv.Nodes[:index], ndv.Nodes[i+1:]...)
-						break
-					}
-				}
-				continue
-			}
-
-			mergeResults(k, &nodeRes.Res.Nodes, &ndv.Nodes, &req.NodeID)
-		}
+	if req.Trace {
+		res.Trace = new(LookupTrace)
 	}
-
-	res.Nodes = make([]FoundNode, len(ndv.Nodes))
-	for _, node := range ndv.Nodes {
-		res.Nodes = append(res.Nodes, node.Node)
+	query := func(node FoundNode) lookupReply {
+		nodeRes := k.remoteFindNode(node, req)
+		if nodeRes.Err == nil && node.Relay == "" {
+			k.observe(node.IPAddr, nodeRes.Observed)
+		}
+		return lookupReply{nodes: nodeRes.Nodes, err: nodeRes.Err}
 	}
-
-	return nil
+	out := k.lookup(req.NodeID, query, false, req.Paths, res.Trace)
+	res.Nodes = out.closest
 }
 
 // FIND_VALUE
+// With Stream set values larger than STREAM_THRESHOLD are left out of the
+// result, the caller fetches them with FetchChunk. With Trace set the
+// iterative lookup records its rounds in the result, Paths is as in
+// FindNodeRequest
 type FindValueRequest struct {
 	UpdateTimestamp bool
+	Stream          bool
+	Trace           bool
+	Paths           int
 	Sender          Contact
 	MsgID           ID
 	Key             ID
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
-// FindNodeResult.
+// FindNodeResult. A streamed value has Size and Hash set instead of Value.
 type FindValueResult struct {
 	MsgID ID
 	Value []byte
+	Size  int
+	Hash  ID
 	Nodes []FoundNode
+	Trace *LookupTrace
 	Err   error
 }
 
-type FindValueResultWithID struct {
-	Res      FindValueResult
-	SourceID ID
-}
-
 func (f *FindValueResult) SetErr(err error) { f.Err = err }
 
 // SPEC: if corresponding value is present, assocaited data is returned, other acts like FindNode
 func (k *Kademlia) FindValue(req FindValueRequest, res *FindValueResult) error {
-	go k.UpdateContacts(req.Sender)
+	k.queueContact(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
 	k.storedDataMutex.Lock()
 	val, hasKey := k.StoredData[req.Key]
@@ -300,8 +417,12 @@ func (k *Kademlia) FindValue(req FindValueRequest, res *FindValueResult) error {
 			val.time = time.Now()
 			k.StoredData[req.Key] = val
 		}
-		res.Value = make([]byte, len(val.Data))
-		copy(res.Value, val.Data)
+		if req.Stream && len(val.Data) > STREAM_THRESHOLD {
+			res.Size, res.Hash = len(val.Data), FromBytes(val.Data)
+		} else {
+			res.Value = make([]byte, len(val.Data))
+			copy(res.Value, val.Data)
+		}
 	} else {
 		res.Nodes = k.FindCloseNodes(req.Key, req.Sender.NodeID, MaxBucketSize)
 	}
@@ -309,166 +430,88 @@ func (k *Kademlia) FindValue(req FindValueRequest, res *FindValueResult) error {
 	return nil
 }
 
-func remoteFindValue(node FoundNode, req FindValueRequest, res chan FindValueResultWithID) {
+// ask node for the value, fetching it if it is streamed
+func (k *Kademlia) remoteFindValue(node FoundNode, req FindValueRequest) FindValueResult {
+	retRes := k.remoteFindValueHeader(node, req)
+	if retRes.Err == nil && retRes.Size > 0 {
+		retRes.Value, retRes.Err = k.fetchStream(node, req.Sender, req.Key, retRes.Size, retRes.Hash)
+	}
+	return retRes
+}
+
+// ask node for the value, a streamed value is only announced by its size
+func (k *Kademlia) remoteFindValueHeader(node FoundNode, req FindValueRequest) FindValueResult {
 	retRes := new(FindValueResult)
-	defer (func() { res <- FindValueResultWithID{Res: *retRes, SourceID: CopyID(node.NodeID)} })()
-	client, err := rpc.DialHTTP("tcp", foundNodeToAddrStr(node))
+	client, err := k.dialNode(node)
 	if err != nil {
 		retRes.Err = err
-		return
+		return *retRes
 	}
 	req.MsgID = NewRandomID()
+	req.Stream = true
 
 	defer client.Close()
 	err = client.Call("Kademlia.FindValue", req, retRes)
 	if err != nil && retRes.Err == nil {
-		retRes.Err = err
+		retRes.Err = callError(err)
 	}
-	if false == req.MsgID.Equals(retRes.MsgID) {
-		retRes.Err = errors.New("Invalid message id returned")
+	if retRes.Err == nil && false == req.MsgID.Equals(retRes.MsgID) {
+		retRes.Err = ErrBadMsgID
+		k.misbehaved(node.NodeID)
 	}
+	return *retRes
 }
 
 // if we find the value, the first foundnode in the result slice is the one that returned it
-// spec doesn't say to check if the value is locally available, so we don't
-func (k *Kademlia) IterFindValue(req FindValueRequest, res *FindValueResult) error {
-	// do iterative find value
-	nodes := k.FindCloseNodes(req.Key, k.NodeID, K)
+// spec doesn't say to check if the value is locally available, so we don't.
+// With UpdateTimestamp set the lookup goes on after finding the value so
+// every node holding it gets touched, a streamed value is still only fetched
+// from the first holder that delivers it
+func (k *Kademlia) IterFindValue(req FindValueRequest, res *FindValueResult) {
 	res.MsgID = CopyID(req.MsgID)
-	nodes = nodes[0:ALPHA]
-	ndv := nodeDistanceVector{Nodes: make([]foundNodeDistance, 0, K)}
-	for _, node := range nodes {
-		ndv.Nodes = append(ndv.Nodes, foundNodeDistance{Node: node,
-			PrefixLen: req.MsgID.Xor(node.NodeID).PrefixLen(),
-			Queried:   false})
-	}
-	sort.Sort(ndv) // being lazy
-	ndv.Closest = ndv.Nodes[0].PrefixLen
-	resChan := make(chan FindValueResultWithID, ALPHA)
-	doneYet := false
-
-	timeoutChan := make(chan bool, 1)
-	go makeTimeout(timeoutChan, 8)
-
-	var resultHolder FindValueResult = FindValueResult{Value: nil, Nodes: nil}
-	for doneYet == false {
-		queryCount := 0
-		for _, node := range ndv.Nodes {
-			if node.Queried == false {
-				node.Queried, queryCount = true, queryCount+1
-				go remoteFindValue(node.Node, req, resChan)
-				if queryCount == ALPHA {
-					break
-				}
-			}
-		}
-		if queryCount == 0 {
-			doneYet = true
-		}
-
-		exit := false
-
-		for i := 0; i < queryCount; i++ {
-			var nodeRes FindValueResultWithID
-			select {
-			case <-timeoutChan:
-				exit = true
-			case nodeRes = <-resChan:
-			}
-			if exit {
-				doneYet = true
-				break
-			}
-			if nodeRes.Res.Err != nil {
-				// TODO : remove node from list
-				for index, node := range ndv.Nodes {
-					if node.Node.NodeID.Equals(nodeRes.SourceID) {
-						ndv.Nodes = append(ndv.Nodes[:index], ndv.Nodes[i+1:]...)
-						break
-					}
-				}
-				continue
-			}
-
-			if nodeRes.Res.Value != nil && resultHolder.Value != nil {
-				resultHolder.Value = make([]byte, len(nodeRes.Res.Value))
-				copy(resultHolder.Value, nodeRes.Res.Value)
-				// these are here just for the command line to return the finder's ID
-				resultHolder.Nodes = make([]FoundNode, 0, 1)
-				resultHolder.Nodes = append(resultHolder.Nodes, FoundNode{NodeID: CopyID(nodeRes.SourceID)})
-
-				// exit when finding the first instance if not updateing timestamps
-				// otherwise keep going
-				if req.UpdateTimestamp == false {
-					doneYet = true
-					break
-				}
-			}
-
-			// incorporate results into list
-			// make a temp container to sort all known nodes so we can grab the closest
-			mergeResults(k, &nodeRes.Res.Nodes, &ndv.Nodes, &req.Key)
-		}
+	if req.Trace {
+		res.Trace = new(LookupTrace)
 	}
-
-	if resultHolder.Value == nil {
-		res.Nodes = make([]FoundNode, len(ndv.Nodes))
-		for _, node := range ndv.Nodes {
-			res.Nodes = append(res.Nodes, node.Node)
-		}
-	} else {
-		res.Value = make([]byte, len(resultHolder.Value))
-		copy(res.Value, resultHolder.Value)
-
-		res.Nodes = make([]FoundNode, 0, 1)
-		res.Nodes = append(res.Nodes, FoundNode{NodeID: CopyID(resultHolder.Nodes[0].NodeID)})
-	}
-	return nil
-}
-
-func mergeResults(k *Kademlia, src *[]FoundNode, dst *[]foundNodeDistance, id *ID) {
-	var foundNodes []foundNodeDistance = *dst
-	tempNdv := new(nodeDistanceVector)
-	tempNdv.Nodes = make([]foundNodeDistance, len(foundNodes), 2*K)
-	copy(tempNdv.Nodes, foundNodes)
-
-	for _, node := range *src {
-		go k.UpdateContacts(FoundNodeToContact(node))
-
-		known := false
-		for _, knownNode := range foundNodes {
-			if knownNode.Node.NodeID.Equals(node.NodeID) {
-				known = true
+	var fetchMutex sync.Mutex
+	fetched := false
+	query := func(node FoundNode) lookupReply {
+		nodeRes := k.remoteFindValueHeader(node, req)
+		if nodeRes.Err == nil && nodeRes.Size > 0 {
+			fetchMutex.Lock()
+			if fetched == false {
+				nodeRes.Value, nodeRes.Err = k.fetchStream(node, req.Sender, req.Key, nodeRes.Size, nodeRes.Hash)
+				fetched = nodeRes.Err == nil
 			}
+			fetchMutex.Unlock()
 		}
-		if known == false {
-			newNode := foundNodeDistance{Node: node,
-				PrefixLen: id.Xor(node.NodeID).PrefixLen(),
-				Queried:   false}
-			tempNdv.Nodes = append(tempNdv.Nodes, newNode)
-		}
+		return lookupReply{nodes: nodeRes.Nodes, value: nodeRes.Value, err: nodeRes.Err}
 	}
-
-	sort.Sort(tempNdv)
-
-	endIndex := K
-	if len(tempNdv.Nodes) < K {
-		endIndex = len(tempNdv.Nodes)
-	}
-
-	for index, node := range tempNdv.Nodes[0:endIndex] {
-		if index < len(foundNodes) {
-			foundNodes[index] = node
-		} else {
-			foundNodes = append(foundNodes, node)
+	out := k.lookup(req.Key, query, req.UpdateTimestamp, req.Paths, res.Trace)
+	if out.value == nil {
+		res.Nodes = out.closest
+		if out.timedOut {
+			res.Err = ErrTimeout
 		}
+		return
 	}
+	// these are here just for the command line to return the finder's ID
+	res.Value = out.value
+	res.Nodes = []FoundNode{FoundNode{NodeID: out.valueSource}}
 }
 
+// DELETE
+// Only a delete signed by the value's publisher at Time is carried out, see
+// tombstone.go. With Collect set it is a garbage collector's request to drop
+// an unreferenced DFS value, which needs no signature but is only carried out
+// by nodes whose own collector agrees, see collectLocal
 type DeleteValueRequest struct {
-	Sender Contact
-	MsgID  ID
-	Key    ID
+	Sender    Contact
+	MsgID     ID
+	Key       ID
+	Publisher []byte
+	Time      time.Time
+	Signature []byte
+	Collect   bool
 }
 
 type DeleteValueResult struct {
@@ -478,109 +521,52 @@ type DeleteValueResult struct {
 }
 
 func (k *Kademlia) Delete(req DeleteValueRequest, res *DeleteValueResult) error {
-	go k.UpdateContacts(req.Sender)
+	k.queueContact(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
-	k.storedDataMutex.Lock()
-	_, ok := k.StoredData[req.MsgID]
-	if ok {
-		delete(k.StoredData, req.MsgID)
-	}
-	k.storedDataMutex.Unlock()
+	res.Err = wireError(k.deleteLocal(req))
 	res.Nodes = k.FindCloseNodes(req.Key, req.Sender.NodeID, K)
 	return nil
 }
 
-type DeleteValueResultWithID struct {
-	Res      DeleteValueResult
-	SourceID ID
-}
-
-func remoteDeleteValue(node FoundNode, req DeleteValueRequest, res chan DeleteValueResultWithID) {
+func (k *Kademlia) remoteDeleteValue(node FoundNode, req DeleteValueRequest) DeleteValueResult {
 	retRes := new(DeleteValueResult)
-	defer (func() { res <- DeleteValueResultWithID{Res: *retRes, SourceID: CopyID(node.NodeID)} })()
-	client, err := rpc.DialHTTP("tcp", foundNodeToAddrStr(node))
+	client, err := k.dialNode(node)
 	if err != nil {
 		retRes.Err = err
-		return
+		return *retRes
 	}
 	req.MsgID = NewRandomID()
 
 	defer client.Close()
 	err = client.Call("Kademlia.Delete", req, retRes)
 	if err != nil && retRes.Err == nil {
-		retRes.Err = err
+		retRes.Err = callError(err)
 	}
-	if false == req.MsgID.Equals(retRes.MsgID) {
-		retRes.Err = errors.New("Invalid message id returned")
+	if retRes.Err == nil && false == req.MsgID.Equals(retRes.MsgID) {
+		retRes.Err = ErrBadMsgID
+		k.misbehaved(node.NodeID)
 	}
+	return *retRes
 }
 
-// does best effort deletion, it's possible key will still be present after
-func (k *Kademlia) IterDelete(req DeleteValueRequest, res *DeleteValueResult) error {
-	// third copy of this function......
-
-	nodes := k.FindCloseNodes(req.Key, k.NodeID, K)
+// does best effort deletion, it's possible key will still be present after.
+// A node refusing the delete still helps the lookup along, the refusal is
+// returned in the result. req is sent as it is, a delete of a published value
+// must be signed by the caller first with its own key
+func (k *Kademlia) IterDelete(req DeleteValueRequest, res *DeleteValueResult) {
 	res.MsgID = CopyID(req.MsgID)
-	nodes = nodes[0:ALPHA]
-	ndv := nodeDistanceVector{Nodes: make([]foundNodeDistance, 0, K)}
-	for _, node := range nodes {
-		ndv.Nodes = append(ndv.Nodes, foundNodeDistance{Node: node,
-			PrefixLen: req.Key.Xor(node.NodeID).PrefixLen(),
-			Queried:   false})
-	}
-	sort.Sort(ndv) // being lazy
-	ndv.Closest = ndv.Nodes[0].PrefixLen
-	resChan := make(chan DeleteValueResultWithID, ALPHA)
-	doneYet := false
-
-	//timeout after 8 seconds
-	timeoutChan := make(chan bool, 1)
-	go makeTimeout(timeoutChan, 8)
-
-	for doneYet == false {
-		queryCount := 0
-		for _, node := range ndv.Nodes {
-			if node.Queried == false {
-				node.Queried, queryCount = true, queryCount+1
-				go remoteDeleteValue(node.Node, req, resChan)
-				if queryCount == ALPHA {
-					break
-				}
-			}
-		}
-		if queryCount == 0 {
-			doneYet = true
-		}
-		exit := false
-		for i := 0; i < queryCount; i++ {
-			var nodeRes DeleteValueResultWithID
-			select {
-			case <-timeoutChan:
-				exit = true
-			case nodeRes = <-resChan:
-			}
-			if exit {
-				doneYet = true
-				break
-			}
-			if nodeRes.Res.Err != nil {
-				for index, node := range ndv.Nodes {
-					if node.Node.NodeID.Equals(nodeRes.SourceID) {
-						ndv.Nodes = append(ndv.Nodes[:index], ndv.Nodes[i+1:]...)
-						break
-					}
-				}
-				continue
-			}
-
-			mergeResults(k, &nodeRes.Res.Nodes, &ndv.Nodes, &req.Key)
+	var refusalMutex sync.Mutex
+	query := func(node FoundNode) lookupReply {
+		nodeRes := k.remoteDeleteValue(node, req)
+		var remote *RemoteError
+		if errors.As(nodeRes.Err, &remote) {
+			refusalMutex.Lock()
+			res.Err = remote
+			refusalMutex.Unlock()
+			nodeRes.Err = nil
 		}
+		return lookupReply{nodes: nodeRes.Nodes, err: nodeRes.Err}
 	}
-
-	res.Nodes = make([]FoundNode, len(ndv.Nodes))
-	for _, node := range ndv.Nodes {
-		res.Nodes = append(res.Nodes, node.Node)
-	}
-
-	return nil
+	out := k.lookup(req.Key, query, false, 1, nil)
+	res.Nodes = out.closest
 }
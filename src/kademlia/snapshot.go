@@ -0,0 +1,302 @@
+package kademlia
+
+// File history and tree snapshots for the DFS. File inodes are immutable and
+// link the inode they replaced, so old revisions stay readable. Directory
+// inodes are updated in place, a snapshot therefore freezes a copy of every
+// directory under its content hash and records the frozen root by name. The
+// name's entry is owned by whoever took the snapshot, so nobody else can
+// replace or remove it.
+
+import (
+	"errors"
+	"time"
+)
+
+// the table of snapshot names to frozen root keys lives under this key
+var DFSSnapshotsKey ID = FromBytes([]byte("kademlia dfs snapshots"))
+
+// Read File At
+// With At set the newest revision modified no later than At is read,
+// otherwise the revision numbered Revision
+type ReadFileAtRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Path      string
+	Revision  int
+	At        time.Time
+	RootInode DirInode
+	RootKey   ID
+}
+
+func (k *Kademlia) ReadFileAt(req ReadFileAtRequest, res *ReadFileResult) {
+	res.MsgID = CopyID(req.MsgID)
+	ffReq := FindFileRequest{Sender: req.Sender,
+		MsgID:     CopyID(req.MsgID),
+		Path:      req.Path,
+		RootInode: req.RootInode,
+		RootKey:   req.RootKey}
+	ffRes := new(FindFileResult)
+	k.FindFile(ffReq, ffRes)
+	if ffRes.Err != nil {
+		res.Err = ffRes.Err
+		return
+	}
+
+	inode, key := ffRes.Inode, ffRes.Key
+	for {
+		if inode.Meta.IsDir {
+			res.Err = ErrIsDir
+			return
+		}
+		if req.At.IsZero() && inode.Revision == req.Revision {
+			break
+		}
+		if req.At.IsZero() == false && inode.Meta.LastModified.After(req.At) == false {
+			break
+		}
+		if inode.Previous.Equals(ID{}) || (req.At.IsZero() && inode.Revision < req.Revision) {
+			res.Err = dfsError("No such revision", ErrNotFound)
+			return
+		}
+		key = inode.Previous
+		prev := new(FileInode)
+		if err := k.findContent(req.Sender, req.MsgID, key, prev); err != nil {
+			res.Err = err
+			return
+		}
+		inode = *prev
+	}
+
+	res.Inode, res.Key = inode, key
+	res.Content, res.Err = k.readFileBlocks(req.Sender, req.MsgID, inode)
+	return
+}
+
+// Create Snapshot
+type CreateSnapshotRequest struct {
+	Sender Contact
+	MsgID  ID
+	Name   string
+}
+
+// Key is the frozen root directory
+type CreateSnapshotResult struct {
+	MsgID ID
+	Key   ID
+	Err   error
+}
+
+// freeze the whole tree under Name. Directories changed while the snapshot
+// is taken may be captured before or after the change
+func (k *Kademlia) CreateSnapshot(req CreateSnapshotRequest, res *CreateSnapshotResult) {
+	res.MsgID = CopyID(req.MsgID)
+	if req.Name == "" {
+		res.Err = dfsError("Invalid snapshot name", ErrInvalidPath)
+		return
+	}
+
+	rootReq := FindDirRequest{Sender: req.Sender, MsgID: CopyID(req.MsgID)}
+	rootRes := new(FindDirResult)
+	k.FindRoot(rootReq, rootRes)
+	if rootRes.Err != nil {
+		res.Err = rootRes.Err
+		return
+	}
+	frozenKey, err := k.freezeDir(req.Sender, req.MsgID, rootRes.Inode, 0)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	if err = k.ensureDirInode(req.Sender, req.MsgID, DFSSnapshotsKey, "snapshots"); err != nil {
+		res.Err = err
+		return
+	}
+	res.Err = k.updateDirInode(req.Sender, req.MsgID, DFSSnapshotsKey, func(dir *DirInode) error {
+		if _, ok := dir.Files[req.Name]; ok {
+			return dfsError("Snapshot already exists", ErrExists)
+		}
+		linkEntry(dir, req.Name, frozenKey, EntryPerm{Owner: k.SigningPublicKey(), Mode: DFS_FILE_MODE})
+		return nil
+	})
+	if res.Err == nil {
+		res.Key = frozenKey
+	}
+	return
+}
+
+// store a content addressed copy of dir and of every directory below it.
+// Frozen copies have no ".." entry since a child can't know the hash of its
+// parent, they are browsed from the top only
+func (k *Kademlia) freezeDir(sender Contact, msgID ID, dir DirInode, depth int) (ID, error) {
+	if depth > DFS_MAX_DEPTH {
+		return ID{}, errors.New("Directory tree too deep")
+	}
+	frozen := DirInode{Meta: dir.Meta, Files: make(map[string]ID), Perms: dir.Perms}
+	for name, key := range dir.Files {
+		if name == ".." {
+			continue
+		}
+		entry := new(anyInode)
+		if err := k.findContent(sender, msgID, key, entry); err != nil {
+			return ID{}, err
+		}
+		if entry.Meta.IsDir {
+			child, err := k.findDirInode(sender, msgID, key)
+			if err != nil {
+				return ID{}, err
+			}
+			if key, err = k.freezeDir(sender, msgID, *child, depth+1); err != nil {
+				return ID{}, err
+			}
+		}
+		frozen.Files[name] = key
+	}
+	return k.storeContent(sender, msgID, frozen)
+}
+
+// Find Snapshot
+type FindSnapshotRequest struct {
+	Sender Contact
+	MsgID  ID
+	Name   string
+}
+
+// Inode and Key can be passed as RootInode and RootKey of the other DFS
+// requests to browse the snapshot
+type FindSnapshotResult struct {
+	MsgID ID
+	Inode DirInode
+	Key   ID
+	Err   error
+}
+
+func (k *Kademlia) FindSnapshot(req FindSnapshotRequest, res *FindSnapshotResult) {
+	res.MsgID = CopyID(req.MsgID)
+	table, err := k.findDirInode(req.Sender, req.MsgID, DFSSnapshotsKey)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	key, ok := table.Files[req.Name]
+	if ok == false || req.Name == ".." {
+		res.Err = dfsError("No such snapshot", ErrNotFound)
+		return
+	}
+	frozen, err := k.findDirInode(req.Sender, req.MsgID, key)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	res.Inode, res.Key = *frozen, key
+	return
+}
+
+// Restore Snapshot
+// Copies the directory at SnapshotPath inside snapshot Name back to the live
+// tree at Path, which must not exist yet
+type RestoreSnapshotRequest struct {
+	Sender       Contact
+	MsgID        ID
+	Name         string
+	SnapshotPath string
+	Path         string
+}
+
+type RestoreSnapshotResult struct {
+	MsgID ID
+	Key   ID
+	Err   error
+}
+
+func (k *Kademlia) RestoreSnapshot(req RestoreSnapshotRequest, res *RestoreSnapshotResult) {
+	res.MsgID = CopyID(req.MsgID)
+	fsReq := FindSnapshotRequest{Sender: req.Sender, MsgID: CopyID(req.MsgID), Name: req.Name}
+	fsRes := new(FindSnapshotResult)
+	k.FindSnapshot(fsReq, fsRes)
+	if fsRes.Err != nil {
+		res.Err = fsRes.Err
+		return
+	}
+	frozen, err := k.findDirPath(req.Sender, req.MsgID, req.SnapshotPath, fsRes.Inode, fsRes.Key)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	dirPath, name := splitPath(req.Path)
+	if name == "" || name == "." || name == ".." {
+		res.Err = dfsError("Invalid file name", ErrInvalidPath)
+		return
+	}
+	parent, err := k.findDirPath(req.Sender, req.MsgID, dirPath, DirInode{}, ID{})
+	if err != nil {
+		res.Err = err
+		return
+	}
+	if _, ok := parent.Inode.Files[name]; ok {
+		res.Err = dfsError("Destination already exists", ErrExists)
+		return
+	}
+
+	frozen.Inode.Meta.Name = name
+	key, err := k.thawDir(req.Sender, req.MsgID, frozen.Inode, parent.Key, 0)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	res.Err = k.updateDirInode(req.Sender, req.MsgID, parent.Key, func(dir *DirInode) error {
+		if _, ok := dir.Files[name]; ok {
+			return dfsError("Destination already exists", ErrExists)
+		}
+		linkEntry(dir, name, key, entryPerm(frozen.Inode.Meta))
+		return nil
+	})
+	if res.Err == nil {
+		res.Key = key
+	}
+	return
+}
+
+// recreate a frozen directory tree as live directories with their owners and
+// modes. Each directory is stored unowned with only its ".." entry first,
+// which fixes its key, and filled and given its owner once its children
+// exist, so anybody may restore. Files are immutable and linked as they are
+func (k *Kademlia) thawDir(sender Contact, msgID ID, frozen DirInode, parentKey ID, depth int) (ID, error) {
+	if depth > DFS_MAX_DEPTH {
+		return ID{}, errors.New("Directory tree too deep")
+	}
+	meta := frozen.Meta
+	meta.Version, meta.LastModified, meta.Owner = 0, time.Now(), nil
+	key, err := k.storeContent(sender, msgID, DirInode{Meta: meta, Files: map[string]ID{"..": parentKey}})
+	if err != nil {
+		return ID{}, err
+	}
+
+	files := make(map[string]ID)
+	for name, childKey := range frozen.Files {
+		if name == ".." {
+			continue
+		}
+		entry := new(anyInode)
+		if err = k.findContent(sender, msgID, childKey, entry); err != nil {
+			return ID{}, err
+		}
+		if entry.Meta.IsDir {
+			child := DirInode{Meta: entry.Meta, Files: entry.Files}
+			if childKey, err = k.thawDir(sender, msgID, child, key, depth+1); err != nil {
+				return ID{}, err
+			}
+		}
+		files[name] = childKey
+	}
+
+	err = k.updateDirInode(sender, msgID, key, func(dir *DirInode) error {
+		for name, childKey := range files {
+			linkEntry(dir, name, childKey, frozen.Perms[name])
+		}
+		dir.Meta.Owner = frozen.Meta.Owner
+		return nil
+	})
+	return key, err
+}
@@ -0,0 +1,320 @@
+package kademlia
+
+// Chunked transfer of large values. Values above STREAM_THRESHOLD aren't
+// sent inline in a Store or FindValue call but in STREAM_CHUNK_SIZE pieces,
+// each carrying a CRC-32 of its bytes, and the whole value is checked against
+// its SHA-1 at the end. The receiver reports how much it has got so far, so a
+// transfer interrupted by a broken connection resumes where it stopped.
+// A node takes at most MAX_UPLOADS transfers at once, and their data only
+// grows as chunks arrive, within the storage quota.
+
+import (
+	"errors"
+	"hash/crc32"
+	"net/rpc"
+	"time"
+)
+
+// values larger than this many bytes are streamed
+const STREAM_THRESHOLD = 64 * 1024
+
+const STREAM_CHUNK_SIZE = 32 * 1024
+
+// how many values a node receives at once
+const MAX_UPLOADS = 64
+
+// how often a chunk is retried, reconnecting in between, before giving up
+const STREAM_RETRIES = 3
+
+var ErrChunkChecksum = errors.New("Chunk checksum mismatch")
+var ErrValueChecksum = errors.New("Value checksum mismatch")
+var ErrTooManyUploads = errors.New("Too many values being received")
+
+// a value being received, uploads are keyed by value key and hash so an
+// interrupted transfer of the same value picks up the partial data
+type upload struct {
+	hash    ID
+	total   int
+	data    []byte
+	touched time.Time
+}
+
+func uploadID(key ID, hash ID) ID {
+	return FromBytes(append(key[:], hash[:]...))
+}
+
+// STORE_CHUNK
+// Hash is the SHA-1 of the whole value, Total its length and Checksum the
+// CRC-32 of Chunk, which starts at Offset. The publisher fields are those of
+// the StoreRequest the value came with
+type StoreChunkRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Key       ID
+	Hash      ID
+	Total     int
+	Offset    int
+	Chunk     []byte
+	Checksum  uint32
+	Publisher []byte
+	Published time.Time
+	Signature []byte
+}
+
+// Received is how many bytes of the value the node holds, the sender
+// continues from there. Done is set once the value is stored
+type StoreChunkResult struct {
+	MsgID    ID
+	Received int
+	Done     bool
+	Err      error
+}
+
+func (k *Kademlia) StoreChunk(req StoreChunkRequest, res *StoreChunkResult) error {
+	return k.serveStoreChunk(req, res, "")
+}
+
+// answer a chunk from the peer at remote, empty for our own
+func (k *Kademlia) serveStoreChunk(req StoreChunkRequest, res *StoreChunkResult, remote string) error {
+	k.queueContact(req.Sender)
+	res.MsgID = CopyID(req.MsgID)
+	res.Err = wireError(k.storeChunk(req, res, remote))
+	return nil
+}
+
+// take a chunk from the peer at remote, the whole value is charged to it
+func (k *Kademlia) storeChunk(req StoreChunkRequest, res *StoreChunkResult, remote string) error {
+	if req.Total <= 0 || req.Offset < 0 || req.Offset+len(req.Chunk) > req.Total {
+		return errors.New("Invalid chunk")
+	}
+	if crc32.ChecksumIEEE(req.Chunk) != req.Checksum {
+		return ErrChunkChecksum
+	}
+	k.storedDataMutex.Lock()
+	maxSize, quota := k.limits.MaxValueSize, k.limits.Quota
+	k.storedDataMutex.Unlock()
+	if maxSize > 0 && req.Total > maxSize {
+		return ErrValueTooLarge
+	}
+
+	id := uploadID(req.Key, req.Hash)
+	k.uploadsMutex.Lock()
+	up, ok := k.uploads[id]
+	if ok == false {
+		if len(k.uploads) >= MAX_UPLOADS {
+			k.uploadsMutex.Unlock()
+			return ErrTooManyUploads
+		}
+		up = &upload{hash: CopyID(req.Hash), total: req.Total}
+		k.uploads[id] = up
+	}
+	if up.total != req.Total {
+		k.uploadsMutex.Unlock()
+		return errors.New("Chunk does not match the transfer")
+	}
+	// chunks are taken in order only, anything else tells the sender where
+	// to continue
+	if req.Offset == len(up.data) {
+		if quota > 0 && k.uploadBytes+len(req.Chunk) > quota {
+			k.uploadsMutex.Unlock()
+			return ErrQuotaExceeded
+		}
+		up.data = append(up.data, req.Chunk...)
+		k.uploadBytes += len(req.Chunk)
+	}
+	up.touched = time.Now()
+	res.Received = len(up.data)
+	if len(up.data) < up.total {
+		k.uploadsMutex.Unlock()
+		return nil
+	}
+	k.dropUpload(id)
+	k.uploadsMutex.Unlock()
+
+	if FromBytes(up.data).Equals(up.hash) == false {
+		return ErrValueChecksum
+	}
+	storeReq := StoreRequest{Sender: req.Sender,
+		MsgID:     req.MsgID,
+		Key:       req.Key,
+		Value:     up.data,
+		Publisher: req.Publisher,
+		Published: req.Published,
+		Signature: req.Signature}
+	if err := k.storeLocal(storeReq, remote); err != nil {
+		return err
+	}
+	res.Done = true
+	return nil
+}
+
+// forget the upload with id, must be called with uploadsMutex held
+func (k *Kademlia) dropUpload(id ID) {
+	if up, ok := k.uploads[id]; ok {
+		k.uploadBytes -= len(up.data)
+		delete(k.uploads, id)
+	}
+}
+
+// whether err is the node turning the chunk down for good, which retrying
+// won't change
+func refused(err error) bool {
+	var remote *RemoteError
+	return errors.As(err, &remote) && remote.Code != ERR_CHUNK_CHECKSUM
+}
+
+// send req.Value to node in chunks
+func (k *Kademlia) streamStore(node FoundNode, req StoreRequest) error {
+	var client *rpc.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	hash := FromBytes(req.Value)
+	offset, failures := 0, 0
+	for {
+		var err error
+		if client == nil {
+			client, err = k.dialNode(node)
+		}
+		if err == nil {
+			end := offset + STREAM_CHUNK_SIZE
+			if end > len(req.Value) {
+				end = len(req.Value)
+			}
+			chunkReq := StoreChunkRequest{Sender: req.Sender,
+				MsgID:     NewRandomID(),
+				Key:       req.Key,
+				Hash:      hash,
+				Total:     len(req.Value),
+				Offset:    offset,
+				Chunk:     req.Value[offset:end],
+				Checksum:  crc32.ChecksumIEEE(req.Value[offset:end]),
+				Publisher: req.Publisher,
+				Published: req.Published,
+				Signature: req.Signature}
+			chunkRes := new(StoreChunkResult)
+			if err = client.Call("Kademlia.StoreChunk", chunkReq, chunkRes); err != nil {
+				err = callError(err)
+			} else {
+				err = chunkRes.Err
+			}
+			if err == nil && chunkRes.Done {
+				return nil
+			}
+			if err == nil {
+				offset, failures = chunkRes.Received, 0
+				continue
+			}
+		}
+		if failures += 1; failures > STREAM_RETRIES || refused(err) {
+			return err
+		}
+		// the connection may be broken, start over on a new one
+		if client != nil {
+			client.Close()
+			client = nil
+		}
+	}
+}
+
+// FETCH_CHUNK
+type FetchChunkRequest struct {
+	Sender Contact
+	MsgID  ID
+	Key    ID
+	Offset int
+	Length int
+}
+
+// Total is the length of the whole value, Checksum the CRC-32 of Chunk
+type FetchChunkResult struct {
+	MsgID    ID
+	Chunk    []byte
+	Total    int
+	Checksum uint32
+	Err      error
+}
+
+func (k *Kademlia) FetchChunk(req FetchChunkRequest, res *FetchChunkResult) error {
+	k.queueContact(req.Sender)
+	res.MsgID = CopyID(req.MsgID)
+	res.Err = wireError(k.fetchChunk(req, res))
+	return nil
+}
+
+func (k *Kademlia) fetchChunk(req FetchChunkRequest, res *FetchChunkResult) error {
+	k.storedDataMutex.Lock()
+	val, ok := k.StoredData[req.Key]
+	k.storedDataMutex.Unlock()
+	if ok == false {
+		return ErrNotFound
+	}
+	if req.Offset < 0 || req.Offset > len(val.Data) || req.Length <= 0 {
+		return errors.New("Invalid chunk")
+	}
+	end := req.Offset + req.Length
+	if end > len(val.Data) {
+		end = len(val.Data)
+	}
+	// stored values are replaced, never changed in place, so no copy needed
+	res.Chunk = val.Data[req.Offset:end]
+	res.Total = len(val.Data)
+	res.Checksum = crc32.ChecksumIEEE(res.Chunk)
+	return nil
+}
+
+// fetch the value under key, size bytes with SHA-1 hash, from node in chunks
+func (k *Kademlia) fetchStream(node FoundNode, sender Contact, key ID, size int, hash ID) ([]byte, error) {
+	var client *rpc.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	data := make([]byte, 0, size)
+	failures := 0
+	for len(data) < size {
+		var err error
+		if client == nil {
+			client, err = k.dialNode(node)
+		}
+		if err == nil {
+			chunkReq := FetchChunkRequest{Sender: sender,
+				MsgID:  NewRandomID(),
+				Key:    key,
+				Offset: len(data),
+				Length: STREAM_CHUNK_SIZE}
+			chunkRes := new(FetchChunkResult)
+			if err = client.Call("Kademlia.FetchChunk", chunkReq, chunkRes); err != nil {
+				err = callError(err)
+			} else {
+				err = chunkRes.Err
+			}
+			switch {
+			case err != nil:
+			case chunkRes.Total != size:
+				return nil, errors.New("Value changed during transfer")
+			case len(chunkRes.Chunk) == 0 || crc32.ChecksumIEEE(chunkRes.Chunk) != chunkRes.Checksum:
+				err = ErrChunkChecksum
+			default:
+				data, failures = append(data, chunkRes.Chunk...), 0
+				continue
+			}
+		}
+		if failures += 1; failures > STREAM_RETRIES || refused(err) {
+			return nil, err
+		}
+		if client != nil {
+			client.Close()
+			client = nil
+		}
+	}
+	if FromBytes(data).Equals(hash) == false {
+		return nil, ErrValueChecksum
+	}
+	return data, nil
+}
@@ -0,0 +1,214 @@
+package kademlia
+
+// Node certificates. A node certificate names the node's ID as its subject
+// common name. Signed by a CA the CA vouches for the binding; without a CA a
+// certificate must be self-signed and the ID must be the SHA-1 of its public
+// key, so only the key's holder can claim the ID.
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// how long generated certificates are valid
+const CERT_VALID_DAYS = 365
+
+var ErrPeerID = errors.New("Peer certificate is not bound to the expected node")
+
+// the node ID of the holder of pub when certificates are self-signed
+func KeyNodeID(pub ed25519.PublicKey) ID {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	return FromBytes(der)
+}
+
+// the node ID cert is bound to
+func CertNodeID(cert *x509.Certificate) (ID, error) {
+	id, err := FromString(cert.Subject.CommonName)
+	if err != nil || len(cert.Subject.CommonName) != 2*IDBytes {
+		return ID{}, errors.New("Certificate names no node ID")
+	}
+	return id, nil
+}
+
+// a certificate for key bound to id, signed by caCert with caKey, or
+// self-signed with caCert nil in which case id must be KeyNodeID of the key
+func NewNodeCert(key ed25519.PrivateKey, id ID, caCert *x509.Certificate, caKey crypto.Signer) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:     pkix.Name{CommonName: id.AsString()},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(CERT_VALID_DAYS * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	parent, signer := template, crypto.Signer(key)
+	if caCert != nil {
+		parent, signer = caCert, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// the TLS identity from the ed25519 key in keyPath, created if missing, with
+// the PEM certificate chain in certPath or, if that's empty, a self-signed
+// certificate. caPath holds the PEM CA certificates peers must be signed by,
+// empty for self-signed peers
+func LoadNodeTLS(keyPath string, certPath string, caPath string) (tls.Certificate, *x509.CertPool, error) {
+	var cert tls.Certificate
+	key, err := LoadSigningKey(keyPath)
+	if err != nil {
+		return cert, nil, err
+	}
+	if certPath == "" {
+		cert, err = NewNodeCert(key, KeyNodeID(key.Public().(ed25519.PublicKey)), nil, nil)
+	} else {
+		cert.PrivateKey = key
+		var data []byte
+		if data, err = ioutil.ReadFile(certPath); err == nil {
+			for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+				cert.Certificate = append(cert.Certificate, block.Bytes)
+			}
+		}
+	}
+	if err != nil {
+		return cert, nil, err
+	}
+
+	var cas *x509.CertPool
+	if caPath != "" {
+		data, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return cert, nil, err
+		}
+		cas = x509.NewCertPool()
+		if cas.AppendCertsFromPEM(data) == false {
+			return cert, nil, errors.New("No CA certificates in " + caPath)
+		}
+	}
+	return cert, cas, nil
+}
+
+// check a peer's certificate chain, returning the node ID it is bound to
+func verifyNodeCert(raw [][]byte, cas *x509.CertPool) (ID, error) {
+	if len(raw) == 0 {
+		return ID{}, errors.New("No peer certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return ID{}, err
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+	id, err := CertNodeID(leaf)
+	if err != nil {
+		return id, err
+	}
+
+	if cas != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: cas,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		return id, err
+	}
+	if err = leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature); err != nil {
+		return id, err
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return id, errors.New("Peer certificate expired")
+	}
+	if FromBytes(leaf.RawSubjectPublicKeyInfo).Equals(id) == false {
+		return id, ErrPeerID
+	}
+	return id, nil
+}
+
+// use TLS with cert for all RPCs, peers must have certificates signed by one
+// of cas or, with cas nil, self-signed ones. Our node ID becomes the one
+// cert is bound to, so this must be called before joining
+func (k *Kademlia) SetTLS(cert tls.Certificate, cas *x509.CertPool) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("No certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	id, err := CertNodeID(leaf)
+	if err != nil {
+		return err
+	}
+	if cas == nil && FromBytes(leaf.RawSubjectPublicKeyInfo).Equals(id) == false {
+		return ErrPeerID
+	}
+	if k.puzzle.enabled() && id.Equals(k.NodeID) == false {
+		return errors.New("Certificate is not for the puzzle key")
+	}
+	k.NodeID = id
+	k.tlsCert, k.tlsCAs = &cert, cas
+	return nil
+}
+
+func (k *Kademlia) serverTLSConfig() *tls.Config {
+	if k.tlsCert == nil {
+		return nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*k.tlsCert},
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			_, err := verifyNodeCert(raw, k.tlsCAs)
+			return err
+		}}
+}
+
+// with id set the server must be that node
+func (k *Kademlia) clientTLSConfig(id *ID) *tls.Config {
+	if k.tlsCert == nil {
+		return nil
+	}
+	// the usual host name checks don't apply, the certificate is checked
+	// against the node ID instead
+	return &tls.Config{Certificates: []tls.Certificate{*k.tlsCert},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			peer, err := verifyNodeCert(raw, k.tlsCAs)
+			if err == nil && id != nil && peer.Equals(*id) == false {
+				err = ErrPeerID
+			}
+			return err
+		}}
+}
+
+// the node ID the peer on conn proved with its certificate, ok is false
+// without TLS
+func connNodeID(conn net.Conn) (id ID, ok bool) {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS == false || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+		return id, false
+	}
+	id, err := CertNodeID(tlsConn.ConnectionState().PeerCertificates[0])
+	return id, err == nil
+}
@@ -0,0 +1,193 @@
+package kademlia
+
+// Authorized deletes. A store signed with the publisher's ed25519 key records
+// the publisher with the value, only a store signed by that same key may
+// replace it with other data, and only a delete signed by it removes it. A
+// deleted key leaves a tombstone for TOMBSTONE_HOURS which refuses stores of
+// the key, so replicas elsewhere can't bring the value back by republishing
+// it. The publisher itself may store the key again with a signature made
+// after the delete. Nodes that don't hold the key keep a tombstone too, but as
+// they can't tell whose the key was it only refuses the signer's own earlier
+// stores, so a signed delete of someone else's key blocks nothing.
+// DFS values are unsigned or signed by whoever wrote them first, so they are
+// removed by the garbage collectors instead, see collectLocal.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// how long a tombstone blocks stores of a deleted key
+const TOMBSTONE_HOURS = 24
+
+// how far a delete's signing time may be from our clock, in minutes, older
+// deletes could be replays
+const DELETE_SKEW_MIN = 10
+
+// how many tombstones we keep for keys we didn't hold
+const MAX_FOREIGN_TOMBSTONES = 10000
+
+var ErrDeleted = errors.New("Value was deleted")
+
+// held is set for keys we held when they were deleted, collected for DFS
+// values removed by garbage collection
+type tombstone struct {
+	publisher []byte
+	deleted   time.Time
+	held      bool
+	collected bool
+}
+
+func storeMessage(key ID, published time.Time, value []byte) []byte {
+	sum := sha256.Sum256(value)
+	msg := make([]byte, 0, 9+IDBytes+8+len(sum))
+	msg = append(msg, []byte("KAD-STORE")...)
+	msg = append(msg, key[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(published.UnixNano()))
+	return append(msg, sum[:]...)
+}
+
+func deleteMessage(key ID, at time.Time) []byte {
+	msg := make([]byte, 0, 10+IDBytes+8)
+	msg = append(msg, []byte("KAD-DELETE")...)
+	msg = append(msg, key[:]...)
+	return binary.BigEndian.AppendUint64(msg, uint64(at.UnixNano()))
+}
+
+// sign req as its publisher, requests already signed are left alone
+func (k *Kademlia) signStore(req *StoreRequest) {
+	if k.signKey == nil || req.Signature != nil {
+		return
+	}
+	req.Publisher, req.Published = k.SigningPublicKey(), time.Now()
+	req.Signature = ed25519.Sign(k.signKey, storeMessage(req.Key, req.Published, req.Value))
+}
+
+func (k *Kademlia) signDelete(req *DeleteValueRequest) {
+	if k.signKey == nil || req.Signature != nil {
+		return
+	}
+	req.Publisher, req.Time = k.SigningPublicKey(), time.Now()
+	req.Signature = ed25519.Sign(k.signKey, deleteMessage(req.Key, req.Time))
+}
+
+func verifySignature(pub []byte, msg []byte, sig []byte) bool {
+	return len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, msg, sig)
+}
+
+// check a store of req against the publisher signature and any tombstone of
+// the key, must be called with storedDataMutex held
+func (k *Kademlia) checkPublication(req StoreRequest) error {
+	signed := len(req.Publisher) > 0
+	if signed && verifySignature(req.Publisher, storeMessage(req.Key, req.Published, req.Value), req.Signature) == false {
+		return ErrPermission
+	}
+	tomb, ok := k.tombstones[req.Key]
+	if ok == false || time.Since(tomb.deleted) > TOMBSTONE_HOURS*time.Hour {
+		return nil
+	}
+	mine := signed && bytes.Equal(req.Publisher, tomb.publisher)
+	if mine && req.Published.After(tomb.deleted) {
+		delete(k.tombstones, req.Key)
+		return nil
+	}
+	if tomb.collected {
+		// a copy signed before the collection is a republish, anything else
+		// is a new write, and collected again if nothing links it
+		if signed && req.Published.After(tomb.deleted) == false {
+			return ErrDeleted
+		}
+		delete(k.tombstones, req.Key)
+		return nil
+	}
+	if tomb.held || mine {
+		return ErrDeleted
+	}
+	return nil
+}
+
+// whether a value we held under key was deleted, must be called with
+// storedDataMutex held
+func (k *Kademlia) isDeleted(key ID) bool {
+	tomb, ok := k.tombstones[key]
+	return ok && tomb.held && time.Since(tomb.deleted) <= TOMBSTONE_HOURS*time.Hour
+}
+
+// carry out req, a delete signed by the publisher of the value under req.Key
+// or, with Collect set, a garbage collector's request, leaving a tombstone
+// behind. Keys we don't hold get a tombstone against the signer's stores
+func (k *Kademlia) deleteLocal(req DeleteValueRequest) error {
+	k.storedDataMutex.Lock()
+	defer k.storedDataMutex.Unlock()
+	if req.Collect {
+		return k.collectLocal(req.Key)
+	}
+	skew := time.Since(req.Time)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > DELETE_SKEW_MIN*time.Minute ||
+		verifySignature(req.Publisher, deleteMessage(req.Key, req.Time), req.Signature) == false {
+		return ErrPermission
+	}
+	val, ok := k.StoredData[req.Key]
+	if ok == false {
+		if tomb, ok := k.tombstones[req.Key]; (ok && tomb.held) || len(k.tombstones) >= MAX_FOREIGN_TOMBSTONES {
+			return nil
+		}
+		k.tombstones[CopyID(req.Key)] = tombstone{publisher: req.Publisher, deleted: req.Time}
+		return nil
+	}
+	if len(val.Publisher) == 0 || bytes.Equal(val.Publisher, req.Publisher) == false {
+		return ErrPermission
+	}
+	k.dropValue(req.Key)
+	k.tombstones[CopyID(req.Key)] = tombstone{publisher: val.Publisher, deleted: req.Time, held: true}
+	return nil
+}
+
+// drop the DFS value under key if our own garbage collector has found it
+// unreferenced for the retention period too. Any node may ask for this, so
+// a value still linked, or linked too recently for us to know, is kept and
+// only collected by us later. Must be called with storedDataMutex held
+func (k *Kademlia) collectLocal(key ID) error {
+	val, ok := k.StoredData[key]
+	if ok == false {
+		return nil
+	}
+	since, ok := k.unreferenced[key]
+	if ok == false || time.Since(since) <= k.gcRetention {
+		return ErrPermission
+	}
+	delete(k.unreferenced, key)
+	k.dropValue(key)
+	k.tombstones[CopyID(key)] = tombstone{publisher: val.Publisher, deleted: time.Now(), held: true, collected: true}
+	return nil
+}
+
+// delete the value we published under key from the closest nodes, signing
+// the delete with our key. Not an RPC, peers can't make us sign
+func (k *Kademlia) Unpublish(sender Contact, key ID) error {
+	if k.signKey == nil {
+		return errors.New("No signing key to delete with")
+	}
+	req := DeleteValueRequest{Sender: sender, MsgID: NewRandomID(), Key: CopyID(key)}
+	k.signDelete(&req)
+	res := new(DeleteValueResult)
+	k.IterDelete(req, res)
+	return res.Err
+}
+
+// forget tombstones past their retention, must be called with
+// storedDataMutex held
+func (k *Kademlia) expireTombstones() {
+	for key, tomb := range k.tombstones {
+		if time.Since(tomb.deleted) > TOMBSTONE_HOURS*time.Hour {
+			delete(k.tombstones, key)
+		}
+	}
+}
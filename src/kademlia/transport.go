@@ -0,0 +1,194 @@
+package kademlia
+
+// The RPC transport, net/rpc over an HTTP CONNECT like rpc.DialHTTP and
+// rpc.HandleHTTP, but over TLS when SetTLS was called. With TLS every
+// connection is mutually authenticated and a request's Sender must be the
+// node the caller's certificate is bound to, see tls.go.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"time"
+)
+
+// how long connecting to a node may take
+const DIAL_TIMEOUT_SECONDS = 10
+
+const rpcConnected = "200 Connected to Go RPC"
+
+var ErrSenderMismatch = errors.New("Sender does not match the peer certificate")
+
+type rpcHandler struct {
+	k *Kademlia
+}
+
+func (h rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == RELAY_PATH {
+		h.k.acceptRelayed(w, req)
+		return
+	}
+	if req.Method != "CONNECT" {
+		http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+
+	server := rpc.NewServer()
+	server.RegisterName("Kademlia", &peerKademlia{k: h.k, remote: req.RemoteAddr})
+	codec := newServerCodec(h.k, conn, req.RemoteAddr)
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		if peer, err := CertNodeID(req.TLS.PeerCertificates[0]); err == nil {
+			codec.peer = &peer
+		}
+	}
+	server.ServeCodec(codec)
+}
+
+// answer RPCs arriving on l, reporting callers their observed address. With
+// puzzles on the node must use TLS
+func (k *Kademlia) Serve(l net.Listener) error {
+	if k.puzzle.enabled() && k.tlsCert == nil {
+		return ErrPuzzleTLS
+	}
+	if config := k.serverTLSConfig(); config != nil {
+		l = tls.NewListener(l, config)
+	}
+	return http.Serve(l, rpcHandler{k})
+}
+
+// the gob codec of net/rpc, which also checks the Sender of each request
+// against peer, the node the connection's certificate is bound to, and
+// refuses requests from banned senders or over their rate, see abuse.go
+type serverCodec struct {
+	k      *Kademlia
+	remote string
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	peer   *ID
+	closed bool
+}
+
+func newServerCodec(k *Kademlia, conn io.ReadWriteCloser, remote string) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{k: k, remote: remote, rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	sender, ok := requestSender(body)
+	if c.peer != nil && ok && sender.NodeID.Equals(*c.peer) == false {
+		return ErrSenderMismatch
+	}
+	return c.k.checkRequest(sender.NodeID, c.remote)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+var contactType = reflect.TypeOf(Contact{})
+
+// the Sender of a request, requests without one and anonymous ones, with a
+// zero NodeID, aren't checked
+func requestSender(body interface{}) (Contact, bool) {
+	v := reflect.Indirect(reflect.ValueOf(body))
+	if v.Kind() != reflect.Struct {
+		return Contact{}, false
+	}
+	field := v.FieldByName("Sender")
+	if field.IsValid() == false || field.Type() != contactType {
+		return Contact{}, false
+	}
+	sender := field.Interface().(Contact)
+	return sender, sender.NodeID.Equals(ID{}) == false
+}
+
+// connect to addr, over TLS if configured. With id set the peer must prove
+// it is that node
+func (k *Kademlia) dialConn(addr string, id *ID) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT_SECONDS * time.Second}
+	config := k.clientTLSConfig(id)
+	if config == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+// ask the server on conn for the RPC or relay connection at path, the
+// returned connection also reads what the server sent right after its answer
+func httpConnect(conn net.Conn, path string) (net.Conn, error) {
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	return &connectedConn{Conn: conn, r: r}, err
+}
+
+type connectedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *connectedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// an RPC client for the node at addr, with id set the node must prove it is
+// that node
+func (k *Kademlia) dialRPC(addr string, id *ID) (*rpc.Client, error) {
+	conn, err := k.dialConn(addr, id)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = httpConnect(conn, rpc.DefaultRPCPath); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// an RPC client for whichever node listens on addr
+func (k *Kademlia) DialAddr(addr string) (*rpc.Client, error) {
+	return k.dialRPC(addr, nil)
+}
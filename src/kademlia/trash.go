@@ -0,0 +1,362 @@
+package kademlia
+
+// Soft delete and garbage collection for the DFS. Deleted entries are moved to
+// the trash directory of their namespace, the top level directory they live
+// under, and purged once DFS_RETENTION_HOURS have passed. Every node then
+// periodically marks all values reachable from the root and the snapshots and
+// deletes the DFS values it holds that stayed unreferenced for the same period.
+// DFS values have no owner that could sign their deletion, so any node may
+// ask the others to collect a value, and each holder only drops it once its
+// own collector found it unreferenced for the retention period as well. The
+// tombstone left then refuses republished copies.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// name of the trash directory kept in every namespace
+const DFS_TRASH_NAME = ".trash"
+
+// mode of trash directories, which are unowned so every deleter may use them
+const DFS_TRASH_MODE = 0777
+
+// how long trashed entries and unreferenced values are kept, in hours
+const DFS_RETENTION_HOURS = 24
+
+// how long to wait between garbage collection runs, in seconds
+const DFS_GC_SECONDS = 10 * 60
+
+// "/proj/a/b" keeps its trash in "/proj/.trash", entries directly below the
+// root use "/.trash"
+func trashDirPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) <= 1 {
+		return "/" + DFS_TRASH_NAME
+	}
+	return "/" + parts[0] + "/" + DFS_TRASH_NAME
+}
+
+// find the trash directory for path, creating it if needed
+func (k *Kademlia) findTrashDir(sender Contact, msgID ID, path string, rootInode DirInode, rootKey ID) (ID, error) {
+	dirPath, _ := splitPath(trashDirPath(path))
+	parent, err := k.findDirPath(sender, msgID, dirPath, rootInode, rootKey)
+	if err != nil {
+		return ID{}, err
+	}
+	if key, ok := parent.Inode.Files[DFS_TRASH_NAME]; ok {
+		return key, nil
+	}
+
+	// nobody owns a trash, everybody deleting in the namespace moves entries
+	// into it
+	cdReq := CreateDirRequest{Sender: sender, MsgID: CopyID(msgID), Name: DFS_TRASH_NAME, DirKey: parent.Key}
+	cdRes := new(CreateDirResult)
+	k.createDir(cdReq, cdRes, nil, DFS_TRASH_MODE)
+	if cdRes.Err == nil {
+		return cdRes.Key, nil
+	}
+
+	// lost the race against another client creating it
+	parent, err = k.findDirPath(sender, msgID, dirPath, rootInode, rootKey)
+	if err != nil {
+		return ID{}, err
+	}
+	if key, ok := parent.Inode.Files[DFS_TRASH_NAME]; ok {
+		return key, nil
+	}
+	return ID{}, cdRes.Err
+}
+
+// Soft Delete
+type SoftDeleteRequest struct {
+	Sender    Contact
+	MsgID     ID
+	Path      string
+	RootInode DirInode
+	RootKey   ID
+}
+
+// TrashPath is where the entry can be restored from
+type SoftDeleteResult struct {
+	MsgID     ID
+	Key       ID
+	TrashPath string
+	Err       error
+}
+
+// move the entry at Path to its namespace's trash, stamping DeleteTime
+func (k *Kademlia) SoftDelete(req SoftDeleteRequest, res *SoftDeleteResult) {
+	res.MsgID = CopyID(req.MsgID)
+	dirPath, name := splitPath(req.Path)
+	if name == "" || name == "." || name == ".." || name == DFS_TRASH_NAME {
+		res.Err = dfsError("Invalid file name", ErrInvalidPath)
+		return
+	}
+
+	parent, err := k.findDirPath(req.Sender, req.MsgID, dirPath, req.RootInode, req.RootKey)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	key, ok := parent.Inode.Files[name]
+	if ok == false {
+		res.Err = ErrFileNotFound
+		return
+	}
+	inode := new(FileInode)
+	if err = k.findContent(req.Sender, req.MsgID, key, inode); err != nil {
+		res.Err = err
+		return
+	}
+	trashKey, err := k.findTrashDir(req.Sender, req.MsgID, req.Path, req.RootInode, req.RootKey)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	now := time.Now()
+	trashName := fmt.Sprintf("%s.%d", name, now.UnixNano())
+	newKey := key
+	var fix, undo func(*DirInode)
+	if inode.Meta.IsDir {
+		fix = func(dir *DirInode) {
+			dir.Meta.DeleteTime, dir.Meta.TrashedFrom = now, req.Path
+			dir.Files[".."] = trashKey
+		}
+		undo = func(dir *DirInode) {
+			dir.Meta.DeleteTime, dir.Meta.TrashedFrom = time.Time{}, ""
+			dir.Files[".."] = parent.Key
+		}
+	} else {
+		inode.Meta.DeleteTime, inode.Meta.TrashedFrom = now, req.Path
+		if newKey, err = k.storeContent(req.Sender, req.MsgID, *inode); err != nil {
+			res.Err = err
+			return
+		}
+	}
+
+	// trashed files are unprotected, only their owner can have moved them there
+	res.Err = k.moveEntry(req.Sender, req.MsgID, parent.Key, name, key, trashKey, trashName, newKey, EntryPerm{}, fix, undo)
+	if res.Err == nil {
+		res.Key = newKey
+		res.TrashPath = trashDirPath(req.Path) + "/" + trashName
+	}
+	return
+}
+
+// Restore
+type RestoreRequest struct {
+	Sender    Contact
+	MsgID     ID
+	TrashPath string
+	RootInode DirInode
+	RootKey   ID
+}
+
+// Path is where the entry was restored to
+type RestoreResult struct {
+	MsgID ID
+	Key   ID
+	Path  string
+	Err   error
+}
+
+// move a trashed entry back to the path it was deleted from, failing if that
+// path has been taken since
+func (k *Kademlia) Restore(req RestoreRequest, res *RestoreResult) {
+	res.MsgID = CopyID(req.MsgID)
+	trashPath, trashName := splitPath(req.TrashPath)
+	trash, err := k.findDirPath(req.Sender, req.MsgID, trashPath, req.RootInode, req.RootKey)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	key, ok := trash.Inode.Files[trashName]
+	if ok == false || trashName == ".." {
+		res.Err = ErrFileNotFound
+		return
+	}
+	inode := new(FileInode)
+	if err = k.findContent(req.Sender, req.MsgID, key, inode); err != nil {
+		res.Err = err
+		return
+	}
+	origPath := inode.Meta.TrashedFrom
+	if origPath == "" {
+		res.Err = errors.New("Entry was not soft deleted")
+		return
+	}
+	dirPath, name := splitPath(origPath)
+	parent, err := k.findDirPath(req.Sender, req.MsgID, dirPath, req.RootInode, req.RootKey)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	newKey := key
+	var fix, undo func(*DirInode)
+	if inode.Meta.IsDir {
+		deleted := inode.Meta.DeleteTime
+		fix = func(dir *DirInode) {
+			dir.Meta.DeleteTime, dir.Meta.TrashedFrom = time.Time{}, ""
+			dir.Files[".."] = parent.Key
+		}
+		undo = func(dir *DirInode) {
+			dir.Meta.DeleteTime, dir.Meta.TrashedFrom = deleted, origPath
+			dir.Files[".."] = trash.Key
+		}
+	} else {
+		inode.Meta.DeleteTime, inode.Meta.TrashedFrom = time.Time{}, ""
+		if newKey, err = k.storeContent(req.Sender, req.MsgID, *inode); err != nil {
+			res.Err = err
+			return
+		}
+	}
+
+	res.Err = k.moveEntry(req.Sender, req.MsgID, trash.Key, trashName, key, parent.Key, name, newKey, entryPerm(inode.Meta), fix, undo)
+	if res.Err == nil {
+		res.Key, res.Path = newKey, origPath
+	}
+	return
+}
+
+// decodes both file and directory inodes, Meta.IsDir tells them apart
+type anyInode struct {
+	Meta     MetaData
+	Blocks   []ID
+	Previous ID
+	Files    map[string]ID
+}
+
+// start the garbage collector, me is used as the sender of its requests
+func (k *Kademlia) StartGC(me Contact) {
+	go k.collectGarbage(me)
+}
+
+func (k *Kademlia) collectGarbage(me Contact) {
+	dur := time.Duration(DFS_GC_SECONDS) * time.Second
+	retention := time.Duration(DFS_RETENTION_HOURS) * time.Hour
+	for {
+		time.Sleep(dur)
+		marked, err := k.markDFS(me, retention)
+		if err != nil {
+			// an incomplete mark would sweep live values
+			continue
+		}
+		k.sweepDFS(me, marked, retention)
+	}
+}
+
+// walk the tree from the root and the snapshots and return every reachable
+// inode and block key, including old file revisions. Trash entries past the
+// retention period are unlinked on the way and left unmarked, unless they are
+// part of a frozen snapshot
+func (k *Kademlia) markDFS(me Contact, retention time.Duration) (map[ID]bool, error) {
+	type pendingDir struct {
+		key    ID
+		frozen bool
+	}
+	if err := k.ensureDirInode(me, NewRandomID(), DFSSnapshotsKey, "snapshots"); err != nil {
+		return nil, err
+	}
+	marked := make(map[ID]bool)
+	marked[DFSRootKey], marked[DFSSnapshotsKey] = true, true
+	pending := []pendingDir{{key: DFSRootKey}, {key: DFSSnapshotsKey, frozen: true}}
+	for len(pending) > 0 {
+		cur := pending[0]
+		pending = pending[1:]
+		dir := new(anyInode)
+		if err := k.findContent(me, NewRandomID(), cur.key, dir); err != nil {
+			return nil, err
+		}
+
+		isTrash := dir.Meta.Name == DFS_TRASH_NAME && cur.frozen == false
+		for name, key := range dir.Files {
+			if name == ".." || marked[key] {
+				continue
+			}
+			entry := new(anyInode)
+			if err := k.findContent(me, NewRandomID(), key, entry); err != nil {
+				return nil, err
+			}
+			if isTrash && entry.Meta.DeleteTime.IsZero() == false &&
+				time.Since(entry.Meta.DeleteTime) > retention {
+				k.purgeTrashEntry(me, cur.key, name, key)
+				continue
+			}
+			marked[key] = true
+			if entry.Meta.IsDir {
+				pending = append(pending, pendingDir{key: key, frozen: cur.frozen})
+				continue
+			}
+			for {
+				for _, block := range entry.Blocks {
+					marked[block] = true
+				}
+				if entry.Previous.Equals(ID{}) || marked[entry.Previous] {
+					break
+				}
+				marked[entry.Previous] = true
+				if err := k.findContent(me, NewRandomID(), entry.Previous, entry); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return marked, nil
+}
+
+func (k *Kademlia) purgeTrashEntry(me Contact, trashKey ID, name string, key ID) {
+	k.updateDirInode(me, NewRandomID(), trashKey, func(dir *DirInode) error {
+		if cur, ok := dir.Files[name]; ok && cur.Equals(key) {
+			unlinkEntry(dir, name)
+		}
+		return nil
+	})
+}
+
+// delete the DFS values that have been unreferenced for longer than the
+// retention period, values written but not linked yet are protected by it.
+// Other holders are asked to collect them too, they do if their own collector
+// agrees, see collectLocal
+func (k *Kademlia) sweepDFS(me Contact, marked map[ID]bool, retention time.Duration) {
+	now := time.Now()
+	expired := make([]ID, 0)
+	k.storedDataMutex.Lock()
+	k.gcRetention = retention
+	for key, val := range k.StoredData {
+		if marked[key] || isDFSValue(val.Data) == false {
+			continue
+		}
+		// shards live as long as the block they belong to
+		shard := new(BlockShard)
+		if decodeDFS(val.Data, shard) == nil && marked[shard.Block] {
+			marked[key] = true
+			continue
+		}
+		since, ok := k.unreferenced[key]
+		if ok == false {
+			k.unreferenced[key] = now
+		} else if now.Sub(since) > retention {
+			expired = append(expired, key)
+		}
+	}
+	for key := range k.unreferenced {
+		if _, ok := k.StoredData[key]; marked[key] || ok == false {
+			delete(k.unreferenced, key)
+		}
+	}
+	for _, key := range expired {
+		k.collectLocal(key)
+	}
+	k.storedDataMutex.Unlock()
+
+	for _, key := range expired {
+		delReq := DeleteValueRequest{Sender: me, MsgID: NewRandomID(), Key: key, Collect: true}
+		delRes := new(DeleteValueResult)
+		k.IterDelete(delReq, delRes)
+	}
+}
@@ -0,0 +1,194 @@
+package kadnode
+
+// Command line flags and startup of a node, shared by the main shell and
+// kadfs so both take the same options.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"kademlia"
+	"net"
+	"time"
+)
+
+type Flags struct {
+	DFSKeyPath        *string
+	SignKeyPath       *string
+	MaxValue          *int
+	Quota             *int
+	BucketIPLimit     *int
+	BucketSubnetLimit *int
+	TableIPLimit      *int
+	TableSubnetLimit  *int
+	RateLimit         *float64
+	RateBurst         *int
+	BanStrikes        *int
+	BanTime           *time.Duration
+	SeedFile          *string
+	SeedDNS           *string
+	DNSServer         *string
+	TLSKeyPath        *string
+	TLSCertPath       *string
+	TLSCAPath         *string
+	Puzzle            *bool
+	PuzzleStatic      *int
+	PuzzleDynamic     *int
+	IDKeyPath         *string
+	RelayAddr         *string
+	Reachable         *bool
+}
+
+// define the node flags on fs, flag.CommandLine for a command's own flags
+func AddFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		DFSKeyPath:        fs.String("dfs_key", "", "file holding the key for encrypted DFS files, created if missing"),
+		SignKeyPath:       fs.String("sign_key", "", "file holding the key owning and signing DFS updates, created if missing"),
+		MaxValue:          fs.Int("max_value", kademlia.MAX_VALUE_SIZE, "largest value in bytes other nodes may store here, 0 for no limit"),
+		Quota:             fs.Int("quota", kademlia.STORAGE_QUOTA, "bytes of values stored here before the farthest are evicted, 0 for no limit"),
+		BucketIPLimit:     fs.Int("bucket_ip_limit", kademlia.BUCKET_IP_LIMIT, "contacts per IP in a bucket, 0 for no limit"),
+		BucketSubnetLimit: fs.Int("bucket_subnet_limit", kademlia.BUCKET_SUBNET_LIMIT, "contacts per /24 or IPv6 /64 in a bucket, 0 for no limit"),
+		TableIPLimit:      fs.Int("table_ip_limit", kademlia.TABLE_IP_LIMIT, "contacts per IP in all buckets, 0 for no limit"),
+		TableSubnetLimit:  fs.Int("table_subnet_limit", kademlia.TABLE_SUBNET_LIMIT, "contacts per /24 or IPv6 /64 in all buckets, 0 for no limit"),
+		RateLimit:         fs.Float64("rate_limit", kademlia.RATE_LIMIT_PER_SECOND, "requests a second each node may make, an IP four times as many, 0 for no limit"),
+		RateBurst:         fs.Int("rate_burst", kademlia.RATE_LIMIT_BURST, "requests a sender may make at once"),
+		BanStrikes:        fs.Int("ban_strikes", kademlia.BAN_STRIKES, "misbehaviours before a peer is banned, 0 to never ban"),
+		BanTime:           fs.Duration("ban_time", kademlia.BAN_MINUTES*time.Minute, "how long bans last"),
+		SeedFile:          fs.String("seed_file", "", "file listing bootstrap nodes, one IP:PORT per line"),
+		SeedDNS:           fs.String("seed_dns", "", "DNS name whose SRV or TXT records list bootstrap nodes"),
+		DNSServer:         fs.String("dns_server", "", "DNS server IP:PORT to resolve -seed_dns with instead of the system resolver"),
+		TLSKeyPath:        fs.String("tls_key", "", "file holding the key of our TLS certificate, created if missing, enables TLS"),
+		TLSCertPath:       fs.String("tls_cert", "", "PEM certificate for -tls_key signed by a CA, self-signed if not given"),
+		TLSCAPath:         fs.String("tls_ca", "", "PEM certificates of the CA peers must be signed by, without it peers must be self-signed"),
+		Puzzle:            fs.Bool("puzzle", false, "take our node ID from -id_key and only accept nodes whose IDs solve the crypto puzzles, turns on TLS"),
+		PuzzleStatic:      fs.Int("puzzle_static", kademlia.PUZZLE_STATIC_BITS, "zero bits of the static puzzle with -puzzle"),
+		PuzzleDynamic:     fs.Int("puzzle_dynamic", kademlia.PUZZLE_DYNAMIC_BITS, "zero bits of the dynamic puzzle with -puzzle"),
+		IDKeyPath:         fs.String("id_key", "", "file holding the key our node ID is the hash of with -puzzle, created if missing, defaults to -tls_key"),
+		RelayAddr:         fs.String("relay", "", "IP:PORT of a node to reach us through, for nodes that can't accept connections"),
+		Reachable:         fs.Bool("reachable", false, "the listen port is forwarded, behind NAT advertise the observed public IP instead of staying unreachable"),
+	}
+}
+
+// create a node as the flags say, without listening yet
+func (f *Flags) NewNode() (*kademlia.Kademlia, error) {
+	kadem := kademlia.NewKademlia()
+	limits := kademlia.DefaultStorageLimits()
+	limits.MaxValueSize, limits.Quota = *f.MaxValue, *f.Quota
+	kadem.SetStorageLimits(limits)
+	kadem.SetAbuseLimits(kademlia.AbuseLimits{Rate: *f.RateLimit, Burst: *f.RateBurst, Strikes: *f.BanStrikes, BanTime: *f.BanTime})
+	kadem.SetDiversityLimits(kademlia.DiversityLimits{BucketIP: *f.BucketIPLimit,
+		BucketSubnet: *f.BucketSubnetLimit,
+		TableIP:      *f.TableIPLimit,
+		TableSubnet:  *f.TableSubnetLimit})
+	if *f.DFSKeyPath != "" {
+		dfsKey, err := kademlia.LoadDFSKey(*f.DFSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Loading DFS key: %w", err)
+		}
+		kadem.SetDFSKey(dfsKey)
+	}
+	if *f.SignKeyPath != "" {
+		signKey, err := kademlia.LoadSigningKey(*f.SignKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Loading signing key: %w", err)
+		}
+		kadem.SetSigningKey(signKey)
+	}
+	// with a self-signed certificate the node ID must be the same key's
+	idKeyPath, tlsKeyPath := *f.IDKeyPath, *f.TLSKeyPath
+	if *f.Puzzle {
+		if idKeyPath == "" {
+			idKeyPath = tlsKeyPath
+		}
+		// only TLS proves that a peer holds the key its ID is the hash of
+		if idKeyPath == "" {
+			return nil, errors.New("-puzzle needs -id_key or -tls_key")
+		}
+		if tlsKeyPath == "" {
+			tlsKeyPath = idKeyPath
+		}
+		p := kademlia.Puzzle{Static: *f.PuzzleStatic, Dynamic: *f.PuzzleDynamic}
+		idKey, err := kademlia.LoadPuzzleKey(idKeyPath, p)
+		if err != nil {
+			return nil, fmt.Errorf("Loading node ID key: %w", err)
+		}
+		if err = kadem.SetPuzzle(idKey, p); err != nil {
+			return nil, fmt.Errorf("Using node ID key: %w", err)
+		}
+	}
+	// our node ID is the one our certificate is bound to
+	if tlsKeyPath != "" {
+		cert, cas, err := kademlia.LoadNodeTLS(tlsKeyPath, *f.TLSCertPath, *f.TLSCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("Loading TLS certificate: %w", err)
+		}
+		if err = kadem.SetTLS(cert, cas); err != nil {
+			return nil, fmt.Errorf("Using TLS certificate: %w", err)
+		}
+	}
+	return kadem, nil
+}
+
+// create a node, listen on listenStr and join the network through peersStr
+// and the seed flags. Without any seeds the node starts a new network
+func (f *Flags) Start(listenStr string, peersStr string) (*kademlia.Kademlia, kademlia.Contact, error) {
+	var me kademlia.Contact
+	kadem, err := f.NewNode()
+	if err != nil {
+		return nil, me, err
+	}
+	// several listen addresses, e.g. an IPv4 and an IPv6 one, are all
+	// advertised, the first one as our main address
+	listenAddrs := kademlia.ParseSeedList(listenStr)
+	if me, err = kademlia.NewContact(kadem.NodeID, listenAddrs); err != nil {
+		return nil, me, fmt.Errorf("Invalid format of arg one, expected IP:PORT or [IPv6]:PORT: %w", err)
+	}
+	kadem.ProvePuzzle(&me)
+
+	seeds, err := kademlia.CollectSeeds(peersStr, *f.SeedFile, *f.SeedDNS, *f.DNSServer, listenAddrs)
+	if err != nil {
+		return nil, me, fmt.Errorf("Finding bootstrap nodes: %w", err)
+	}
+	for _, addr := range listenAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, me, fmt.Errorf("Listen: %w", err)
+		}
+		go kadem.Serve(l)
+	}
+
+	// bootstrapping doesn't make us known yet, we first find out how others
+	// reach us
+	var stats kademlia.JoinStats
+	if len(seeds) > 0 {
+		if stats, err = kadem.Bootstrap(seeds); err != nil {
+			return nil, me, fmt.Errorf("Error joining network: %w", err)
+		}
+	}
+	// behind NAT others can't reach us on our own address, unless the port
+	// is forwarded and we advertise the public one instead
+	if kadem.BehindNAT(me) {
+		if *f.Reachable {
+			me.Host = kadem.ObservedIP()
+		} else {
+			me.Unreachable = true
+		}
+		fmt.Printf("Behind NAT, seen as %s\n", kadem.ObservedIP())
+	}
+	// others reach an unreachable node through a relay
+	if *f.RelayAddr != "" || me.Unreachable {
+		relay, err := kadem.StartRelay(*f.RelayAddr)
+		if err != nil {
+			return nil, me, fmt.Errorf("Starting relay: %w", err)
+		}
+		me.Relay = relay
+		fmt.Printf("Relayed through %s\n", relay)
+	}
+	if len(seeds) > 0 {
+		kadem.Announce(me, &stats)
+		fmt.Println(stats)
+	}
+	kadem.StartGC(me)
+	kadem.StartErasureRepair(me)
+	return kadem, me, nil
+}
@@ -0,0 +1,71 @@
+package kadnode
+
+import (
+	"flag"
+	"kademlia"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a loopback address nothing listens on yet
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func parseFlags(t *testing.T, args ...string) *Flags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestStart(t *testing.T) {
+	dir := t.TempDir()
+	first, firstCon, err := parseFlags(t).Start(freeAddr(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second node joins through the first and takes its keys from files
+	signKey, dfsKey := filepath.Join(dir, "sign"), filepath.Join(dir, "dfs")
+	f := parseFlags(t, "-sign_key", signKey, "-dfs_key", dfsKey, "-max_value", "100")
+	second, secondCon, err := f.Start(freeAddr(t), kademlia.JoinHostPort(firstCon.Host.String(), firstCon.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = second.ContactFromID(first.NodeID); err != nil {
+		t.Error("Joined node doesn't know the seed")
+	}
+	if _, err = first.ContactFromID(second.NodeID); err != nil {
+		t.Error("Seed doesn't know the joined node")
+	}
+	for _, p := range []string{signKey, dfsKey} {
+		if _, err = os.Stat(p); err != nil {
+			t.Errorf("Key %s not created: %v", p, err)
+		}
+	}
+	if second.SigningPublicKey() == nil || second.DFSPublicKey() == nil {
+		t.Error("Keys not loaded")
+	}
+	if secondCon.Unreachable {
+		t.Error("Loopback node considered behind NAT")
+	}
+}
+
+func TestNewNodeErrors(t *testing.T) {
+	if _, err := parseFlags(t, "-puzzle").NewNode(); err == nil {
+		t.Error("-puzzle without a key accepted")
+	}
+	if _, _, err := parseFlags(t).Start("nonsense", ""); err == nil {
+		t.Error("Invalid listen address accepted")
+	}
+}
@@ -0,0 +1,217 @@
+package kadshell
+
+// Commands copying directory trees between the local filesystem and the DFS,
+// and changing ownership and permissions of DFS paths.
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kademlia"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type transferStats struct {
+	files, dirs, bytes, errors int
+}
+
+func (s transferStats) String() string {
+	return fmt.Sprintf("%d files, %d directories, %d bytes, %d errors", s.files, s.dirs, s.bytes, s.errors)
+}
+
+func findDfsDir(kadem *kademlia.Kademlia, me kademlia.Contact, p string) (*kademlia.FindDirResult, error) {
+	req := kademlia.FindDirRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: p}
+	res := new(kademlia.FindDirResult)
+	kadem.FindDir(req, res)
+	if res.Err == nil && res.Inode.Meta.IsDir == false {
+		res.Err = fmt.Errorf("%s is not a directory", p)
+	}
+	return res, res.Err
+}
+
+// create every missing directory along the absolute path p, like mkdir -p
+func dfsMkdirAll(kadem *kademlia.Kademlia, me kademlia.Contact, p string) error {
+	cur, err := findDfsDir(kadem, me, "/")
+	if err != nil {
+		return err
+	}
+	sofar := "/"
+	for _, name := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		sofar = path.Join(sofar, name)
+		if _, ok := cur.Inode.Files[name]; ok == false {
+			req := kademlia.CreateDirRequest{Sender: me, MsgID: kademlia.NewRandomID(), Name: name, DirKey: cur.Key}
+			res := new(kademlia.CreateDirResult)
+			kadem.CreateDir(req, res)
+			// somebody else may have created it meanwhile, the lookup tells
+			if res.Err != nil && errors.Is(res.Err, kademlia.ErrExists) == false {
+				return res.Err
+			}
+		}
+		if cur, err = findDfsDir(kadem, me, sofar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy the local file or directory tree at localPath to remotePath, with
+// encrypt the new files are encrypted. Replaced encrypted files stay so anyway
+func DfsPut(kadem *kademlia.Kademlia, me kademlia.Contact, localPath string, remotePath string, encrypt bool) {
+	var stats transferStats
+	err := filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Printf("ERR %s: %v\n", p, err)
+			stats.errors += 1
+			return nil
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(remotePath, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			if err = dfsMkdirAll(kadem, me, remote); err != nil {
+				fmt.Printf("ERR %s: %v\n", remote, err)
+				stats.errors += 1
+				return filepath.SkipDir
+			}
+			stats.dirs += 1
+		case info.Mode().IsRegular():
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				fmt.Printf("ERR %s: %v\n", p, err)
+				stats.errors += 1
+				return nil
+			}
+			req := kademlia.WriteFileRequest{Sender: me,
+				MsgID:   kademlia.NewRandomID(),
+				Path:    remote,
+				Content: content,
+				Encrypt: encrypt,
+				ModTime: info.ModTime()}
+			res := new(kademlia.WriteFileResult)
+			kadem.WriteFile(req, res)
+			if res.Err != nil {
+				fmt.Printf("ERR %s: %v\n", remote, res.Err)
+				stats.errors += 1
+				return nil
+			}
+			stats.files, stats.bytes = stats.files+1, stats.bytes+len(content)
+			fmt.Printf("put %s %d bytes\n", remote, len(content))
+		default:
+			fmt.Printf("ERR %s: not a regular file, skipped\n", p)
+			stats.errors += 1
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("ERR: %v\n", err)
+	}
+	fmt.Printf("OK %v\n", stats)
+}
+
+// copy the DFS file or directory tree at remotePath to localPath
+func DfsGet(kadem *kademlia.Kademlia, me kademlia.Contact, remotePath string, localPath string) {
+	var stats transferStats
+	dfsGet(kadem, me, path.Clean(remotePath), localPath, &stats)
+	fmt.Printf("OK %v\n", stats)
+}
+
+func dfsGet(kadem *kademlia.Kademlia, me kademlia.Contact, remote string, local string, stats *transferStats) {
+	if dir, err := findDfsDir(kadem, me, remote); err == nil {
+		if err = os.MkdirAll(local, 0755); err != nil {
+			fmt.Printf("ERR %s: %v\n", local, err)
+			stats.errors += 1
+			return
+		}
+		stats.dirs += 1
+		names := make([]string, 0, len(dir.Inode.Files))
+		for name := range dir.Inode.Files {
+			if name != ".." {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if safeName(name) == false {
+				fmt.Printf("ERR %s: invalid name %q\n", remote, name)
+				stats.errors += 1
+				continue
+			}
+			dfsGet(kadem, me, path.Join(remote, name), filepath.Join(local, name), stats)
+		}
+		return
+	}
+
+	req := kademlia.ReadFileRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: remote}
+	res := new(kademlia.ReadFileResult)
+	kadem.ReadFile(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", remote, res.Err)
+		stats.errors += 1
+		return
+	}
+	err := ioutil.WriteFile(local, res.Content, 0644)
+	if err == nil {
+		err = os.Chtimes(local, res.Inode.Meta.LastRead, res.Inode.Meta.LastModified)
+	}
+	if err != nil {
+		fmt.Printf("ERR %s: %v\n", local, err)
+		stats.errors += 1
+		return
+	}
+	stats.files, stats.bytes = stats.files+1, stats.bytes+len(res.Content)
+	fmt.Printf("get %s %d bytes\n", remote, len(res.Content))
+}
+
+// whether the DFS entry name may be used as a local one, directory entries
+// come from other nodes and must not lead out of the directory copied to
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." && strings.ContainsAny(name, "/\\") == false &&
+		filepath.Base(name) == name
+}
+
+// set the octal mode of the DFS path p
+func DfsChmod(kadem *kademlia.Kademlia, me kademlia.Contact, mode string, p string) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		fmt.Printf("ERR invalid mode %s\n", mode)
+		return
+	}
+	req := kademlia.ChmodRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: p, Mode: uint32(bits)}
+	res := new(kademlia.ChmodResult)
+	kadem.Chmod(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", p, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Key.AsString())
+}
+
+// give the DFS path p to the owner with the hex encoded public key owner
+func DfsChown(kadem *kademlia.Kademlia, me kademlia.Contact, owner string, p string) {
+	key, err := hex.DecodeString(owner)
+	if err != nil {
+		fmt.Printf("ERR invalid owner key %s\n", owner)
+		return
+	}
+	req := kademlia.ChownRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: p, Owner: key}
+	res := new(kademlia.ChownResult)
+	kadem.Chown(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", p, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Key.AsString())
+}
@@ -0,0 +1,233 @@
+package kadshell
+
+import (
+	"io/ioutil"
+	"kademlia"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// two nodes serving on loopback ports with a DFS root, the second is used by
+// the commands since a node alone can't read back what it stored
+func startTestNodes(t *testing.T) (*kademlia.Kademlia, kademlia.Contact) {
+	nodes, cons := make([]*kademlia.Kademlia, 2), make([]kademlia.Contact, 2)
+	for i := range nodes {
+		nodes[i] = kademlia.NewKademlia()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go nodes[i].Serve(l)
+		if cons[i], err = kademlia.NewContact(nodes[i].NodeID, []string{l.Addr().String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes[0].UpdateContacts(cons[1])
+	nodes[1].UpdateContacts(cons[0])
+	res := new(kademlia.FindDirResult)
+	nodes[0].FindRoot(kademlia.FindDirRequest{Sender: cons[0], MsgID: kademlia.NewRandomID()}, res)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	return nodes[1], cons[1]
+}
+
+// what command prints
+func capture(t *testing.T, command func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	command()
+	os.Stdout = stdout
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestAbs(t *testing.T) {
+	tests := []struct{ cwd, p, abs string }{
+		{"/", "a", "/a"},
+		{"/a", "b/../c", "/a/c"},
+		{"/a", "/b/", "/b"},
+		{"/a/b", "..", "/a"},
+	}
+	for _, test := range tests {
+		if abs := Abs(test.cwd, test.p); abs != test.abs {
+			t.Errorf("%s in %s resolved to %s instead of %s", test.p, test.cwd, abs, test.abs)
+		}
+	}
+}
+
+func TestPathCommands(t *testing.T) {
+	kadem, me := startTestNodes(t)
+	if out := capture(t, func() { Mkdir(kadem, me, "/", "proj") }); strings.HasPrefix(out, "OK ") == false {
+		t.Fatalf("mkdir printed %q", out)
+	}
+	if out := capture(t, func() { Mkdir(kadem, me, "/", "proj") }); strings.HasPrefix(out, "ERR") == false {
+		t.Errorf("Second mkdir printed %q", out)
+	}
+	var cwd string
+	if out := capture(t, func() { cwd = Cd(kadem, me, "/", "proj") }); out != "" || cwd != "/proj" {
+		t.Errorf("cd printed %q and changed to %s", out, cwd)
+	}
+	if out := capture(t, func() { cwd = Cd(kadem, me, cwd, "missing") }); strings.HasPrefix(out, "ERR") == false || cwd != "/proj" {
+		t.Errorf("cd to a missing directory printed %q and changed to %s", out, cwd)
+	}
+
+	capture(t, func() { Mkdir(kadem, me, cwd, "sub") })
+	if out := capture(t, func() { Put(kadem, me, cwd, "f", "hello", false) }); strings.HasPrefix(out, "OK ") == false {
+		t.Fatalf("put printed %q", out)
+	}
+	if out := capture(t, func() { Cat(kadem, me, "/", "proj/f") }); out != "hello\n" {
+		t.Errorf("cat printed %q", out)
+	}
+	out := capture(t, func() { Ls(kadem, me, cwd, ".") })
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || strings.HasSuffix(lines[0], " f") == false || strings.HasSuffix(lines[1], " sub/") == false ||
+		strings.HasPrefix(lines[1], "drwxr-xr-x") == false {
+		t.Errorf("ls printed %q", out)
+	}
+
+	// into an existing directory keeps the name
+	if out = capture(t, func() { Mv(kadem, me, cwd, "f", "sub") }); out != "OK /proj/sub/f\n" {
+		t.Fatalf("mv printed %q", out)
+	}
+	if out = capture(t, func() { Mv(kadem, me, cwd, "sub/f", "g") }); out != "OK /proj/g\n" {
+		t.Fatalf("mv printed %q", out)
+	}
+	out = capture(t, func() { Stat(kadem, me, cwd, "g") })
+	for _, line := range []string{"Path: /proj/g\n", "Size: 5\n", "Revision: 0\n", "Encrypted: false\n"} {
+		if strings.Contains(out, line) == false {
+			t.Errorf("stat printed %q, without %q", out, line)
+		}
+	}
+}
+
+func TestRmRestore(t *testing.T) {
+	kadem, me := startTestNodes(t)
+	capture(t, func() { Mkdir(kadem, me, "/", "proj") })
+	capture(t, func() { Put(kadem, me, "/proj", "f", "hello", false) })
+
+	out := capture(t, func() { Rm(kadem, me, "/proj", "f") })
+	if strings.HasPrefix(out, "OK /proj/.trash/f.") == false {
+		t.Fatalf("rm printed %q", out)
+	}
+	trashPath := strings.TrimSpace(strings.TrimPrefix(out, "OK "))
+	if out = capture(t, func() { Cat(kadem, me, "/", "/proj/f") }); strings.HasPrefix(out, "ERR") == false {
+		t.Errorf("Removed file still reads as %q", out)
+	}
+
+	if out = capture(t, func() { Restore(kadem, me, "/", trashPath) }); out != "OK /proj/f\n" {
+		t.Fatalf("restore printed %q", out)
+	}
+	if out = capture(t, func() { Cat(kadem, me, "/proj", "f") }); out != "hello\n" {
+		t.Errorf("Restored file reads as %q", out)
+	}
+
+	// removing from the trash is for good
+	out = capture(t, func() { Rm(kadem, me, "/proj", "f") })
+	trashPath = strings.TrimSpace(strings.TrimPrefix(out, "OK "))
+	if out = capture(t, func() { Rm(kadem, me, "/", trashPath) }); out != "OK\n" {
+		t.Fatalf("rm in the trash printed %q", out)
+	}
+	if out = capture(t, func() { Restore(kadem, me, "/", trashPath) }); strings.HasPrefix(out, "ERR") == false {
+		t.Errorf("Purged file restored: %q", out)
+	}
+}
+
+func TestDfsPutGet(t *testing.T) {
+	kadem, me := startTestNodes(t)
+	local := t.TempDir()
+	files := map[string]string{"a": "first", "d/b": "second", "d/e/c": "third"}
+	for name, content := range files {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := capture(t, func() { DfsPut(kadem, me, local, "/backup/tree", false) })
+	if strings.HasSuffix(out, "OK 3 files, 3 directories, 16 bytes, 0 errors\n") == false {
+		t.Fatalf("dfs_put printed %q", out)
+	}
+	if out = capture(t, func() { Cat(kadem, me, "/", "/backup/tree/d/e/c") }); out != "third\n" {
+		t.Errorf("Copied file reads as %q", out)
+	}
+
+	copied := t.TempDir()
+	out = capture(t, func() { DfsGet(kadem, me, "/backup/tree", copied) })
+	if strings.HasSuffix(out, "OK 3 files, 3 directories, 16 bytes, 0 errors\n") == false {
+		t.Fatalf("dfs_get printed %q", out)
+	}
+	for name, content := range files {
+		read, err := ioutil.ReadFile(filepath.Join(copied, filepath.FromSlash(name)))
+		if err != nil || string(read) != content {
+			t.Errorf("Copied back %s as %q: %v", name, read, err)
+		}
+	}
+
+	if out = capture(t, func() { DfsChmod(kadem, me, "9", "/backup") }); out != "ERR invalid mode 9\n" {
+		t.Errorf("chmod with a bad mode printed %q", out)
+	}
+	if out = capture(t, func() { DfsChmod(kadem, me, "700", "/backup/tree/a") }); strings.HasPrefix(out, "OK ") == false {
+		t.Fatalf("chmod printed %q", out)
+	}
+	if out = capture(t, func() { Stat(kadem, me, "/", "/backup/tree/a") }); strings.Contains(out, "Mode: -rwx------\n") == false {
+		t.Errorf("stat after chmod printed %q", out)
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	for _, name := range []string{"f", "a.txt", "..f", ".hidden"} {
+		if safeName(name) == false {
+			t.Errorf("%q refused", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../../escape", "a/b", "/abs", `a\b`} {
+		if safeName(name) {
+			t.Errorf("%q taken as a local name", name)
+		}
+	}
+}
+
+func TestSnapshotCommands(t *testing.T) {
+	kadem, me := startTestNodes(t)
+	capture(t, func() { Mkdir(kadem, me, "/", "proj") })
+	capture(t, func() { Put(kadem, me, "/proj", "f", "old", false) })
+	if out := capture(t, func() { Snapshot(kadem, me, "before") }); strings.HasPrefix(out, "OK ") == false {
+		t.Fatalf("snapshot printed %q", out)
+	}
+	capture(t, func() { Put(kadem, me, "/proj", "f", "new", false) })
+
+	if out := capture(t, func() { CatAt(kadem, me, "/proj", "f", "0") }); out != "old\n" {
+		t.Errorf("cat_at printed %q", out)
+	}
+	if out := capture(t, func() { CatAt(kadem, me, "/proj", "f", "yesterday") }); strings.HasPrefix(out, "ERR") == false {
+		t.Errorf("cat_at with a bad revision printed %q", out)
+	}
+	if out := capture(t, func() { SnapshotCat(kadem, me, "before", "/proj/f") }); out != "old\n" {
+		t.Errorf("snapshot_cat printed %q", out)
+	}
+	if out := capture(t, func() { SnapshotLs(kadem, me, "before", "/proj") }); strings.HasSuffix(out, " f\n") == false {
+		t.Errorf("snapshot_ls printed %q", out)
+	}
+	if out := capture(t, func() { SnapshotRestore(kadem, me, "/", "before", "/proj", "again") }); out != "OK /again\n" {
+		t.Fatalf("snapshot_restore printed %q", out)
+	}
+	if out := capture(t, func() { Cat(kadem, me, "/", "/again/f") }); out != "old\n" {
+		t.Errorf("Restored file reads as %q", out)
+	}
+}
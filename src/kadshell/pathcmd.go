@@ -0,0 +1,234 @@
+package kadshell
+
+// Shell commands working on DFS paths. Relative paths are resolved against
+// the session's working directory, which starts at the root.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"kademlia"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// resolve p against the working directory cwd
+func Abs(cwd string, p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join(cwd, p)
+}
+
+func dfsMode(meta kademlia.MetaData) os.FileMode {
+	mode := os.FileMode(meta.Mode)
+	if mode == 0 {
+		mode = kademlia.DFS_FILE_MODE
+		if meta.IsDir {
+			mode = kademlia.DFS_DIR_MODE
+		}
+	}
+	if meta.IsDir {
+		mode |= os.ModeDir
+	}
+	return mode
+}
+
+// change to the directory p, returning the new working directory
+func Cd(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) string {
+	dir := Abs(cwd, p)
+	if _, err := findDfsDir(kadem, me, dir); err != nil {
+		fmt.Printf("ERR %s: %v\n", dir, err)
+		return cwd
+	}
+	return dir
+}
+
+func Mkdir(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	target := Abs(cwd, p)
+	if target == "/" {
+		fmt.Println("ERR directory already exists")
+		return
+	}
+	dirPath, name := path.Dir(target), path.Base(target)
+	parent, err := findDfsDir(kadem, me, dirPath)
+	if err != nil {
+		fmt.Printf("ERR %s: %v\n", dirPath, err)
+		return
+	}
+	req := kademlia.CreateDirRequest{Sender: me, MsgID: kademlia.NewRandomID(), Name: name, DirKey: parent.Key}
+	res := new(kademlia.CreateDirResult)
+	kadem.CreateDir(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR: %v\n", res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Key.AsString())
+}
+
+// list the directory p, one entry per line with mode, size, modification time
+// and name, directories get a trailing slash
+func Ls(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	dirPath := Abs(cwd, p)
+	dir, err := findDfsDir(kadem, me, dirPath)
+	if err != nil {
+		fmt.Printf("ERR %s: %v\n", dirPath, err)
+		return
+	}
+	listDir(kadem, me, dir)
+}
+
+func listDir(kadem *kademlia.Kademlia, me kademlia.Contact, dir *kademlia.FindDirResult) {
+	names := make([]string, 0, len(dir.Inode.Files))
+	for name := range dir.Inode.Files {
+		if name != ".." {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// look the entry up from the listed directory instead of the root
+		req := kademlia.FindFileRequest{Sender: me,
+			MsgID:     kademlia.NewRandomID(),
+			Path:      name,
+			RootInode: dir.Inode,
+			RootKey:   dir.Key}
+		res := new(kademlia.FindFileResult)
+		kadem.FindFile(req, res)
+		if res.Err != nil {
+			fmt.Printf("ERR %s: %v\n", name, res.Err)
+			continue
+		}
+		meta := res.Inode.Meta
+		if meta.IsDir {
+			name += "/"
+		}
+		fmt.Printf("%v %8d %s %s\n", dfsMode(meta), meta.Size, meta.LastModified.Format("2006-01-02 15:04"), name)
+	}
+}
+
+func Cat(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	req := kademlia.ReadFileRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: Abs(cwd, p)}
+	res := new(kademlia.ReadFileResult)
+	kadem.ReadFile(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	printContent(res.Content)
+}
+
+// print a file's content, ending it with a newline if it has none
+func printContent(content []byte) {
+	fmt.Print(string(content))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		fmt.Println()
+	}
+}
+
+// write content to the file p, creating or replacing it, encrypted with
+// encrypt or if it already was
+func Put(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string, content string, encrypt bool) {
+	req := kademlia.WriteFileRequest{Sender: me,
+		MsgID:   kademlia.NewRandomID(),
+		Path:    Abs(cwd, p),
+		Content: []byte(content),
+		Encrypt: encrypt}
+	res := new(kademlia.WriteFileResult)
+	kadem.WriteFile(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Key.AsString())
+}
+
+// move p to the trash, from where restore brings it back. Entries already in
+// the trash are removed for good
+func Rm(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	target := Abs(cwd, p)
+	if path.Base(path.Dir(target)) == kademlia.DFS_TRASH_NAME {
+		req := kademlia.RemoveRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: target}
+		res := new(kademlia.RemoveResult)
+		kadem.Remove(req, res)
+		if res.Err != nil {
+			fmt.Printf("ERR %s: %v\n", target, res.Err)
+			return
+		}
+		fmt.Println("OK")
+		return
+	}
+	req := kademlia.SoftDeleteRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: target}
+	res := new(kademlia.SoftDeleteResult)
+	kadem.SoftDelete(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", target, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.TrashPath)
+}
+
+// move the trashed entry p back to where it was deleted from
+func Restore(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	req := kademlia.RestoreRequest{Sender: me, MsgID: kademlia.NewRandomID(), TrashPath: Abs(cwd, p)}
+	res := new(kademlia.RestoreResult)
+	kadem.Restore(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.TrashPath, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Path)
+}
+
+// move src to dst, or into dst if that is an existing directory
+func Mv(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, src string, dst string) {
+	srcPath, dstPath := Abs(cwd, src), Abs(cwd, dst)
+	if _, err := findDfsDir(kadem, me, dstPath); err == nil {
+		dstPath = path.Join(dstPath, path.Base(srcPath))
+	}
+	req := kademlia.RenameRequest{Sender: me, MsgID: kademlia.NewRandomID(), SrcPath: srcPath, DstPath: dstPath}
+	res := new(kademlia.RenameResult)
+	kadem.Rename(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", srcPath, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", dstPath)
+}
+
+func Stat(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string) {
+	target := Abs(cwd, p)
+	var meta kademlia.MetaData
+	var key kademlia.ID
+	revision, encrypted := 0, false
+	if dir, err := findDfsDir(kadem, me, target); err == nil {
+		meta, key = dir.Inode.Meta, dir.Key
+	} else {
+		req := kademlia.FindFileRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: target}
+		res := new(kademlia.FindFileResult)
+		kadem.FindFile(req, res)
+		if res.Err != nil {
+			fmt.Printf("ERR %s: %v\n", target, res.Err)
+			return
+		}
+		meta, key = res.Inode.Meta, res.Key
+		revision, encrypted = res.Inode.Revision, res.Inode.Encrypted
+	}
+
+	owner := "-"
+	if len(meta.Owner) > 0 {
+		owner = hex.EncodeToString(meta.Owner)
+	}
+	fmt.Printf("Path: %s\n", target)
+	fmt.Printf("Key: %s\n", key.AsString())
+	fmt.Printf("Mode: %v\n", dfsMode(meta))
+	fmt.Printf("Owner: %s\n", owner)
+	fmt.Printf("Size: %d\n", meta.Size)
+	fmt.Printf("Modified: %v\n", meta.LastModified)
+	fmt.Printf("Accessed: %v\n", meta.LastRead)
+	if meta.IsDir == false {
+		fmt.Printf("Revision: %d\n", revision)
+		fmt.Printf("Encrypted: %v\n", encrypted)
+	}
+}
@@ -0,0 +1,108 @@
+package kadshell
+
+// Commands reading old revisions of DFS files and taking, browsing and
+// restoring snapshots of the whole tree. Paths inside a snapshot are absolute.
+
+import (
+	"fmt"
+	"kademlia"
+	"strconv"
+	"time"
+)
+
+// print the file p as it was at revision at, a number, or at a time in
+// RFC 3339 format
+func CatAt(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, p string, at string) {
+	req := kademlia.ReadFileAtRequest{Sender: me, MsgID: kademlia.NewRandomID(), Path: Abs(cwd, p)}
+	if revision, err := strconv.Atoi(at); err == nil {
+		req.Revision = revision
+	} else if req.At, err = time.Parse(time.RFC3339, at); err != nil {
+		fmt.Printf("ERR %s: not a revision or time\n", at)
+		return
+	}
+	res := new(kademlia.ReadFileResult)
+	kadem.ReadFileAt(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	printContent(res.Content)
+}
+
+func Snapshot(kadem *kademlia.Kademlia, me kademlia.Contact, name string) {
+	req := kademlia.CreateSnapshotRequest{Sender: me, MsgID: kademlia.NewRandomID(), Name: name}
+	res := new(kademlia.CreateSnapshotResult)
+	kadem.CreateSnapshot(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", name, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", res.Key.AsString())
+}
+
+func findSnapshot(kadem *kademlia.Kademlia, me kademlia.Contact, name string) (*kademlia.FindSnapshotResult, error) {
+	req := kademlia.FindSnapshotRequest{Sender: me, MsgID: kademlia.NewRandomID(), Name: name}
+	res := new(kademlia.FindSnapshotResult)
+	kadem.FindSnapshot(req, res)
+	return res, res.Err
+}
+
+// list the directory p of snapshot name like ls
+func SnapshotLs(kadem *kademlia.Kademlia, me kademlia.Contact, name string, p string) {
+	snap, err := findSnapshot(kadem, me, name)
+	if err != nil {
+		fmt.Printf("ERR %s: %v\n", name, err)
+		return
+	}
+	req := kademlia.FindDirRequest{Sender: me,
+		MsgID:      kademlia.NewRandomID(),
+		Path:       Abs("/", p),
+		StartInode: snap.Inode,
+		StartKey:   snap.Key}
+	res := new(kademlia.FindDirResult)
+	kadem.FindDir(req, res)
+	if res.Err == nil && res.Inode.Meta.IsDir == false {
+		res.Err = fmt.Errorf("%s is not a directory", req.Path)
+	}
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	listDir(kadem, me, res)
+}
+
+func SnapshotCat(kadem *kademlia.Kademlia, me kademlia.Contact, name string, p string) {
+	snap, err := findSnapshot(kadem, me, name)
+	if err != nil {
+		fmt.Printf("ERR %s: %v\n", name, err)
+		return
+	}
+	req := kademlia.ReadFileRequest{Sender: me,
+		MsgID:     kademlia.NewRandomID(),
+		Path:      Abs("/", p),
+		RootInode: snap.Inode,
+		RootKey:   snap.Key}
+	res := new(kademlia.ReadFileResult)
+	kadem.ReadFile(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	printContent(res.Content)
+}
+
+// copy the directory snapPath of snapshot name to the new directory dst
+func SnapshotRestore(kadem *kademlia.Kademlia, me kademlia.Contact, cwd string, name string, snapPath string, dst string) {
+	req := kademlia.RestoreSnapshotRequest{Sender: me,
+		MsgID:        kademlia.NewRandomID(),
+		Name:         name,
+		SnapshotPath: Abs("/", snapPath),
+		Path:         Abs(cwd, dst)}
+	res := new(kademlia.RestoreSnapshotResult)
+	kadem.RestoreSnapshot(req, res)
+	if res.Err != nil {
+		fmt.Printf("ERR %s: %v\n", req.Path, res.Err)
+		return
+	}
+	fmt.Printf("OK %s\n", req.Path)
+}
@@ -3,14 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"kademlia"
+	"kadnode"
+	"kadshell"
 	"log"
 	"math/rand"
 	"net"
-	"net/http"
-	"net/rpc"
 	"os"
 	"strconv"
 	"strings"
@@ -18,12 +20,12 @@ import (
 )
 
 func contactToAddrString(con kademlia.Contact) string {
-	return fmt.Sprintf("%s:%d", con.Host.String(), con.Port)
+	return kademlia.JoinHostPort(con.Host.String(), con.Port)
 }
 
 func doPing(kadem *kademlia.Kademlia, con kademlia.Contact, addressOrId string) {
 	var pingAddress string
-	if len(strings.Split(addressOrId, string(":"))) == 2 {
+	if _, _, err := net.SplitHostPort(addressOrId); err == nil {
 		pingAddress = addressOrId
 	} else {
 		id, err := kademlia.FromString(addressOrId)
@@ -38,7 +40,7 @@ func doPing(kadem *kademlia.Kademlia, con kademlia.Contact, addressOrId string)
 		}
 		pingAddress = contactToAddrString(con)
 	}
-	client, err := rpc.DialHTTP("tcp", pingAddress)
+	client, err := kadem.DialAddr(pingAddress)
 	if err != nil {
 		log.Fatal("DialHTTP: ", err)
 	}
@@ -58,55 +60,41 @@ func doPing(kadem *kademlia.Kademlia, con kademlia.Contact, addressOrId string)
 	_ = client.Close()
 }
 
+// the optional number of disjoint lookup paths following the ID of a lookup
+// command, 0 for the default
+func parsePaths(command_parts []string) (int, error) {
+	if len(command_parts) < 3 {
+		return 0, nil
+	}
+	paths, err := strconv.Atoi(command_parts[2])
+	if err == nil && paths < 1 {
+		err = errors.New("Invalid number of paths")
+	}
+	return paths, err
+}
+
 func main() {
 	// By default, Go seeds its RNG with 1. This would cause every program to
 	// generate the same sequence of IDs.
 	rand.Seed(time.Now().UnixNano())
 
 	// Get the bind and connect connection strings from command-line arguments.
+	node := kadnode.AddFlags(flag.CommandLine)
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatal("Must be invoked with exactly two arguments!\n")
+	if len(args) != 1 && len(args) != 2 {
+		log.Fatal("Usage: main [flags] LISTEN_IP:PORT[,LISTEN_IP:PORT...] [PEER_IP:PORT[,PEER_IP:PORT...]]\n")
 	}
 	listenStr := args[0]
-	firstPeerStr := args[1]
-
-	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia()
-	myIpPort := strings.Split(listenStr, ":")
-	if len(myIpPort) != 2 {
-		log.Fatal("Invalid format of arg one, expected IP:PORT\n")
-	}
-	if strings.Contains(myIpPort[0], "localhost") {
-		myIpPort[0] = "127.0.0.1"
+	peersStr := ""
+	if len(args) == 2 {
+		peersStr = args[1]
 	}
 
-	ipAndPort := strings.Split(firstPeerStr, ":")
-	if len(ipAndPort) != 2 {
-		log.Fatal("Invalid format of arg two, expected IP:PORT\n")
-	}
-	port, err := strconv.Atoi(myIpPort[1])
-	if err != nil {
-		log.Fatal("Could not parse local port\n")
-	}
-
-	rpc.Register(kadem)
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", listenStr)
+	fmt.Printf("kademlia starting up!\n")
+	kadem, me, err := node.Start(listenStr, peersStr)
 	if err != nil {
-		log.Fatal("Listen: ", err)
-	}
-
-	// Serve forever.
-	go http.Serve(l, nil)
-
-	me := kademlia.Contact{NodeID: kademlia.CopyID(kadem.NodeID), Host: net.ParseIP(myIpPort[0]), Port: uint16(port)}
-	if false == strings.Contains(listenStr, firstPeerStr) {
-		err = kadem.Join(me, ipAndPort[0], ipAndPort[1])
-		if err != nil {
-			log.Fatal("Error joinging network", err)
-		}
+		log.Fatal(err)
 	}
 
 	fmt.Println("Finished starting up")
@@ -115,6 +103,8 @@ func main() {
 	// Your code should loop forever, reading instructions from stdin and
 	// printing their results to stdout. See README.txt for more details.
 	input := bufio.NewReader(os.Stdin)
+	// working directory of the DFS path commands
+	cwd := "/"
 	for {
 		commandStr, err := input.ReadString('\n')
 		commandStr = strings.TrimRight(strings.TrimRight(commandStr, string('\n')), string(' '))
@@ -149,8 +139,7 @@ func main() {
 				fmt.Println("ERR : unknown node")
 				continue
 			}
-			remoteAddr := contactToAddrString(con)
-			client, err := rpc.DialHTTP("tcp", remoteAddr)
+			client, err := kadem.DialContact(con)
 			if err != nil {
 				log.Fatal("DialHTTP: ", err)
 			}
@@ -186,9 +175,7 @@ func main() {
 				fmt.Println("ERR : unknown node")
 				continue
 			}
-			remoteAddr := contactToAddrString(con)
-
-			client, err := rpc.DialHTTP("tcp", remoteAddr)
+			client, err := kadem.DialContact(con)
 			if err != nil {
 				log.Fatal("DialHTTP: ", err)
 			}
@@ -229,9 +216,7 @@ func main() {
 				fmt.Println("ERR : unknown node")
 				continue
 			}
-			remoteAddr := contactToAddrString(con)
-
-			client, err := rpc.DialHTTP("tcp", remoteAddr)
+			client, err := kadem.DialContact(con)
 			if err != nil {
 				log.Fatal("ERR: DialHTTP -> ", err)
 			}
@@ -264,6 +249,12 @@ func main() {
 				continue
 			}
 			fmt.Printf("%s\n", kadem.NodeID.AsString())
+		case bytes.Equal(command, []byte("abuse_stats")):
+			if len(command_parts) != 1 {
+				fmt.Println("Invalid format abuse_stats\n\tabuse_stats")
+				continue
+			}
+			fmt.Println(kadem.AbuseStats().String())
 		case bytes.Equal(command, []byte("local_find_value")):
 			if len(command_parts) != 2 {
 				fmt.Println("Invalid format get_local_value\n\tlocal_find_value key")
@@ -314,8 +305,23 @@ func main() {
 			} else {
 				fmt.Println("Could not find a neighbor")
 			}
-		case bytes.Equal(command, []byte("iterativefindnode")):
+		case bytes.Equal(command, []byte("iterativedelete")):
 			if len(command_parts) != 2 {
+				fmt.Println("Invalid format iterativeDelete")
+				continue
+			}
+			key, err := kademlia.FromString(command_parts[1])
+			if err != nil {
+				fmt.Printf("ERR: %v\n", err)
+				continue
+			}
+			if err = kadem.Unpublish(me, key); err != nil {
+				fmt.Printf("ERR: %v\n", err)
+			} else {
+				fmt.Println("OK")
+			}
+		case bytes.Equal(command, []byte("iterativefindnode")):
+			if len(command_parts) != 2 && len(command_parts) != 3 {
 				fmt.Println("Invalid format iterativeFindNode")
 				continue
 			}
@@ -325,9 +331,13 @@ func main() {
 				fmt.Printf("ERR: %v\n", err)
 				continue
 			}
+			if req.Paths, err = parsePaths(command_parts); err != nil {
+				fmt.Println("Invalid number of paths")
+				continue
+			}
 			res := new(kademlia.FindNodeResult)
-			err := kadem.IterFindNode(req, res)
-			if err != nil {
+			kadem.IterFindNode(req, res)
+			if err := res.Err; err != nil {
 				fmt.Printf("ERR: %v", err)
 			} else {
 				for _, node := range res.Nodes {
@@ -335,7 +345,7 @@ func main() {
 				}
 			}
 		case bytes.Equal(command, []byte("iterativefindvalue")):
-			if len(command_parts) != 2 {
+			if len(command_parts) != 2 && len(command_parts) != 3 {
 				fmt.Println("Invalid format iterativeFindValue")
 				continue
 			}
@@ -345,9 +355,13 @@ func main() {
 				fmt.Printf("ERR: %v\n", err)
 				continue
 			}
+			if req.Paths, err = parsePaths(command_parts); err != nil {
+				fmt.Println("Invalid number of paths")
+				continue
+			}
 			res := new(kademlia.FindValueResult)
-			err := kadem.IterFindValue(req, res)
-			if err != nil {
+			kadem.IterFindValue(req, res)
+			if err := res.Err; err != nil {
 				fmt.Printf("ERR: %v", err)
 			} else {
 				if res.Value != nil {
@@ -356,6 +370,192 @@ func main() {
 					fmt.Println("ERR")
 				}
 			}
+		case bytes.Equal(command, []byte("trace_find_node")):
+			if len(command_parts) != 2 && len(command_parts) != 3 {
+				fmt.Println("Invalid format trace_find_node\n\ttrace_find_node id [paths]")
+				continue
+			}
+			req := kademlia.FindNodeRequest{MsgID: kademlia.NewRandomID(), Sender: me, Trace: true}
+			req.NodeID, err = kademlia.FromString(command_parts[1])
+			if err != nil {
+				fmt.Printf("ERR: %v\n", err)
+				continue
+			}
+			if req.Paths, err = parsePaths(command_parts); err != nil {
+				fmt.Println("Invalid number of paths")
+				continue
+			}
+			res := new(kademlia.FindNodeResult)
+			kadem.IterFindNode(req, res)
+			fmt.Println(res.Trace.String())
+			for _, node := range res.Nodes {
+				fmt.Printf("%s %s\n", node.NodeID.AsString(), kademlia.JoinHostPort(node.IPAddr, node.Port))
+			}
+		case bytes.Equal(command, []byte("trace_find_value")):
+			if len(command_parts) != 2 && len(command_parts) != 3 {
+				fmt.Println("Invalid format trace_find_value\n\ttrace_find_value key [paths]")
+				continue
+			}
+			req := kademlia.FindValueRequest{MsgID: kademlia.NewRandomID(), Sender: me, Trace: true}
+			req.Key, err = kademlia.FromString(command_parts[1])
+			if err != nil {
+				fmt.Printf("ERR: %v\n", err)
+				continue
+			}
+			if req.Paths, err = parsePaths(command_parts); err != nil {
+				fmt.Println("Invalid number of paths")
+				continue
+			}
+			res := new(kademlia.FindValueResult)
+			kadem.IterFindValue(req, res)
+			fmt.Println(res.Trace.String())
+			if err := res.Err; err != nil {
+				fmt.Printf("ERR: %v\n", err)
+			} else if res.Value != nil {
+				fmt.Printf("%s %s\n", res.Nodes[0].NodeID.AsString(), string(res.Value))
+			} else {
+				fmt.Println("ERR")
+			}
+		case bytes.Equal(command, []byte("dfs_put")):
+			encrypt := len(command_parts) > 1 && command_parts[1] == "-encrypt"
+			if encrypt {
+				command_parts = command_parts[1:]
+			}
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format dfs_put\n\tdfs_put [-encrypt] localdir /remote/path")
+				continue
+			}
+			kadshell.DfsPut(kadem, me, command_parts[1], kadshell.Abs(cwd, command_parts[2]), encrypt)
+		case bytes.Equal(command, []byte("dfs_get")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format dfs_get\n\tdfs_get /remote/path localdir")
+				continue
+			}
+			kadshell.DfsGet(kadem, me, kadshell.Abs(cwd, command_parts[1]), command_parts[2])
+		case bytes.Equal(command, []byte("chmod")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format chmod\n\tchmod mode /remote/path")
+				continue
+			}
+			kadshell.DfsChmod(kadem, me, command_parts[1], kadshell.Abs(cwd, command_parts[2]))
+		case bytes.Equal(command, []byte("chown")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format chown\n\tchown ownerkey /remote/path")
+				continue
+			}
+			kadshell.DfsChown(kadem, me, command_parts[1], kadshell.Abs(cwd, command_parts[2]))
+		case bytes.Equal(command, []byte("pubkey")):
+			if len(command_parts) != 1 {
+				fmt.Println("Invalid format pubkey\n\tpubkey")
+				continue
+			}
+			if pub := kadem.SigningPublicKey(); pub != nil {
+				fmt.Printf("%s\n", hex.EncodeToString(pub))
+			} else {
+				fmt.Println("ERR no signing key, start with -sign_key")
+			}
+		case bytes.Equal(command, []byte("pwd")):
+			fmt.Println(cwd)
+		case bytes.Equal(command, []byte("cd")):
+			if len(command_parts) > 2 {
+				fmt.Println("Invalid format cd\n\tcd [path]")
+				continue
+			}
+			if len(command_parts) == 1 {
+				cwd = "/"
+			} else {
+				cwd = kadshell.Cd(kadem, me, cwd, command_parts[1])
+			}
+		case bytes.Equal(command, []byte("mkdir")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format mkdir\n\tmkdir path")
+				continue
+			}
+			kadshell.Mkdir(kadem, me, cwd, command_parts[1])
+		case bytes.Equal(command, []byte("ls")):
+			if len(command_parts) > 2 {
+				fmt.Println("Invalid format ls\n\tls [path]")
+				continue
+			}
+			if len(command_parts) == 1 {
+				kadshell.Ls(kadem, me, cwd, ".")
+			} else {
+				kadshell.Ls(kadem, me, cwd, command_parts[1])
+			}
+		case bytes.Equal(command, []byte("cat")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format cat\n\tcat path")
+				continue
+			}
+			kadshell.Cat(kadem, me, cwd, command_parts[1])
+		case bytes.Equal(command, []byte("put")):
+			encrypt := len(command_parts) > 1 && command_parts[1] == "-encrypt"
+			if encrypt {
+				command_parts = command_parts[1:]
+			}
+			if len(command_parts) < 2 {
+				fmt.Println("Invalid format put\n\tput [-encrypt] path [content...]")
+				continue
+			}
+			kadshell.Put(kadem, me, cwd, command_parts[1], strings.Join(command_parts[2:], " "), encrypt)
+		case bytes.Equal(command, []byte("rm")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format rm\n\trm path")
+				continue
+			}
+			kadshell.Rm(kadem, me, cwd, command_parts[1])
+		case bytes.Equal(command, []byte("restore")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format restore\n\trestore trashpath")
+				continue
+			}
+			kadshell.Restore(kadem, me, cwd, command_parts[1])
+		case bytes.Equal(command, []byte("mv")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format mv\n\tmv src dst")
+				continue
+			}
+			kadshell.Mv(kadem, me, cwd, command_parts[1], command_parts[2])
+		case bytes.Equal(command, []byte("cat_at")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format cat_at\n\tcat_at path revision|time")
+				continue
+			}
+			kadshell.CatAt(kadem, me, cwd, command_parts[1], command_parts[2])
+		case bytes.Equal(command, []byte("snapshot")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format snapshot\n\tsnapshot name")
+				continue
+			}
+			kadshell.Snapshot(kadem, me, command_parts[1])
+		case bytes.Equal(command, []byte("snapshot_ls")):
+			if len(command_parts) != 2 && len(command_parts) != 3 {
+				fmt.Println("Invalid format snapshot_ls\n\tsnapshot_ls name [/path]")
+				continue
+			}
+			if len(command_parts) == 2 {
+				kadshell.SnapshotLs(kadem, me, command_parts[1], "/")
+			} else {
+				kadshell.SnapshotLs(kadem, me, command_parts[1], command_parts[2])
+			}
+		case bytes.Equal(command, []byte("snapshot_cat")):
+			if len(command_parts) != 3 {
+				fmt.Println("Invalid format snapshot_cat\n\tsnapshot_cat name /path")
+				continue
+			}
+			kadshell.SnapshotCat(kadem, me, command_parts[1], command_parts[2])
+		case bytes.Equal(command, []byte("snapshot_restore")):
+			if len(command_parts) != 4 {
+				fmt.Println("Invalid format snapshot_restore\n\tsnapshot_restore name /snapshot/path path")
+				continue
+			}
+			kadshell.SnapshotRestore(kadem, me, cwd, command_parts[1], command_parts[2], command_parts[3])
+		case bytes.Equal(command, []byte("stat")):
+			if len(command_parts) != 2 {
+				fmt.Println("Invalid format stat\n\tstat path")
+				continue
+			}
+			kadshell.Stat(kadem, me, cwd, command_parts[1])
 		default:
 			fmt.Printf("Unknown command: %s\n", command_parts[0])
 		}